@@ -0,0 +1,158 @@
+package pebbleds
+
+import (
+	"sync"
+	"time"
+)
+
+// AmplificationSample is a reading of the amplification metrics of the store
+// taken by the sampler of WithAmplificationSampling.
+type AmplificationSample struct {
+	Time time.Time
+	// ReadAmp is the number of sorted runs a read may have to look into.
+	ReadAmp int
+	// WriteAmp is the number of bytes written to disk per byte written to
+	// the store, since it was opened.
+	WriteAmp float64
+}
+
+// Trend is the direction a metric is heading to over the sampled window.
+type Trend int
+
+const (
+	// TrendFlat means the metric is stable, or there are not enough samples
+	// to tell.
+	TrendFlat Trend = iota
+	// TrendRising means the metric is growing, which for amplification
+	// suggests compactions are falling behind or the store needs retuning.
+	TrendRising
+	// TrendFalling means the metric is shrinking.
+	TrendFalling
+)
+
+func (t Trend) String() string {
+	switch t {
+	case TrendRising:
+		return "rising"
+	case TrendFalling:
+		return "falling"
+	default:
+		return "flat"
+	}
+}
+
+// trendTolerance is the change over the whole window, relative to the mean
+// of the metric, under which it is considered flat.
+const trendTolerance = 0.05
+
+// amplificationSampler keeps the latest samples in a ring buffer.
+type amplificationSampler struct {
+	mu      sync.Mutex
+	samples []AmplificationSample
+	// next is the position of the next sample, and full is set once the
+	// buffer has wrapped around.
+	next int
+	full bool
+}
+
+func newAmplificationSampler(size int) *amplificationSampler {
+	return &amplificationSampler{samples: make([]AmplificationSample, size)}
+}
+
+func (s *amplificationSampler) record(sample AmplificationSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[s.next] = sample
+	s.next++
+	if s.next == len(s.samples) {
+		s.next, s.full = 0, true
+	}
+}
+
+// series returns the samples, oldest first.
+func (s *amplificationSampler) series() []AmplificationSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		return append([]AmplificationSample(nil), s.samples[:s.next]...)
+	}
+	series := make([]AmplificationSample, 0, len(s.samples))
+	series = append(series, s.samples[s.next:]...)
+	return append(series, s.samples[:s.next]...)
+}
+
+// trend returns the direction of the values, from the slope of their least
+// squares fit.
+func trend(values []float64) Trend {
+	n := float64(len(values))
+	if n < 2 {
+		return TrendFlat
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, y := range values {
+		x := float64(i)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	change, mean := slope*(n-1), sumY/n
+	if mean < 0 {
+		mean = -mean
+	}
+	switch {
+	case change > 0 && change > trendTolerance*mean:
+		return TrendRising
+	case change < 0 && -change > trendTolerance*mean:
+		return TrendFalling
+	default:
+		return TrendFlat
+	}
+}
+
+// AmplificationSeries returns the amplification samples taken by the sampler
+// of WithAmplificationSampling, oldest first. It returns nil if sampling is
+// disabled.
+func (d *Datastore) AmplificationSeries() []AmplificationSample {
+	if d.amplification == nil {
+		return nil
+	}
+	return d.amplification.series()
+}
+
+// AmplificationTrend returns the direction the read and write amplification
+// are heading to over the samples of AmplificationSeries. Both are TrendFlat
+// if sampling is disabled or there are fewer than two samples yet.
+func (d *Datastore) AmplificationTrend() (readAmp, writeAmp Trend) {
+	series := d.AmplificationSeries()
+	reads := make([]float64, len(series))
+	writes := make([]float64, len(series))
+	for i, s := range series {
+		reads[i], writes[i] = float64(s.ReadAmp), s.WriteAmp
+	}
+	return trend(reads), trend(writes)
+}
+
+// amplificationLoop samples the amplification metrics every interval until
+// the datastore is closed.
+func (d *Datastore) amplificationLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m := d.db.Metrics()
+			total := m.Total()
+			d.amplification.record(AmplificationSample{
+				Time:     now,
+				ReadAmp:  m.ReadAmp(),
+				WriteAmp: total.WriteAmp(),
+			})
+		case <-d.closing:
+			return
+		}
+	}
+}
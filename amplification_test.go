@@ -0,0 +1,69 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestAmplificationSampler(t *testing.T) {
+	s := newAmplificationSampler(4)
+	for i := 1; i <= 6; i++ {
+		s.record(AmplificationSample{ReadAmp: i, WriteAmp: float64(10 - i)})
+	}
+	series := s.series()
+	if len(series) != 4 {
+		t.Fatalf("expected 4 samples, got %d", len(series))
+	}
+	for i, sample := range series {
+		if sample.ReadAmp != i+3 {
+			t.Fatalf("sample %d: got read amp %d, expected %d", i, sample.ReadAmp, i+3)
+		}
+	}
+
+	d := &Datastore{amplification: s}
+	readAmp, writeAmp := d.AmplificationTrend()
+	if readAmp != TrendRising || writeAmp != TrendFalling {
+		t.Fatalf("got trends %s/%s, expected rising/falling", readAmp, writeAmp)
+	}
+
+	for i := 0; i < 4; i++ {
+		s.record(AmplificationSample{ReadAmp: 3, WriteAmp: 2})
+	}
+	if readAmp, writeAmp := d.AmplificationTrend(); readAmp != TrendFlat || writeAmp != TrendFlat {
+		t.Fatalf("got trends %s/%s, expected flat", readAmp, writeAmp)
+	}
+}
+
+func TestAmplificationSampling(t *testing.T) {
+	d, cleanup := newDatastore(t, WithAmplificationSampling(5*time.Millisecond, 8))
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/key/%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.AmplificationSeries()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no samples taken")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the sampler stops on Close.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	series := d.AmplificationSeries()
+	time.Sleep(20 * time.Millisecond)
+	after := d.AmplificationSeries()
+	if last := after[len(after)-1].Time; !last.Equal(series[len(series)-1].Time) {
+		t.Fatal("sampled after close")
+	}
+}
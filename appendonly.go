@@ -0,0 +1,68 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrNonMonotonicKey is returned by writes of keys that are not greater than
+// every key written before, in append-only mode (see WithAppendOnly).
+var ErrNonMonotonicKey = errors.New("pebble datastore key is not greater than the last key written")
+
+// appendOnlyGuard tracks the greatest key written in append-only mode.
+type appendOnlyGuard struct {
+	// mu is held across the checks and the writes they guard, so that
+	// concurrent writes land in key order.
+	mu sync.Mutex
+	// max is the greatest key written, or nil if none was.
+	max []byte
+}
+
+// check fails with ErrNonMonotonicKey if key is not greater than the
+// greatest key written. The caller must hold g.mu.
+func (g *appendOnlyGuard) check(key []byte) error {
+	if g.max != nil && bytes.Compare(key, g.max) <= 0 {
+		return fmt.Errorf("%w: %q is not after %q", ErrNonMonotonicKey, key, g.max)
+	}
+	return nil
+}
+
+// advance records that key has been written. The caller must hold g.mu.
+func (g *appendOnlyGuard) advance(key []byte) {
+	g.max = append(g.max[:0], key...)
+}
+
+// recoverAppendOnly derives the greatest key written from the last key of the
+// store, on open.
+func (d *Datastore) recoverAppendOnly() error {
+	d.appendOnly = &appendOnlyGuard{}
+	key, _, err := d.LastKey(context.Background(), "")
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to recover the last key written: %w", err)
+	}
+	d.appendOnly.advance(key.Bytes())
+	return nil
+}
+
+// checkBatch fails with ErrNonMonotonicKey unless the keys put by a batch are
+// in increasing order and greater than the greatest key written. The caller
+// must hold g.mu.
+func (g *appendOnlyGuard) checkBatch(puts []ds.Key) error {
+	last := g.max
+	for _, key := range puts {
+		k := key.Bytes()
+		if last != nil && bytes.Compare(k, last) <= 0 {
+			return fmt.Errorf("%w: %q is not after %q", ErrNonMonotonicKey, k, last)
+		}
+		last = k
+	}
+	return nil
+}
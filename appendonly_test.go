@@ -0,0 +1,108 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestAppendOnly(t *testing.T) {
+	path := t.TempDir()
+	d, err := NewDatastoreWithOptions(path, nil, WithAppendOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, k := range []string{"/log/001", "/log/002", "/log/010"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"/log/010", "/log/005", "/a"} {
+		if err := d.Put(ctx, datastore.NewKey(k), nil); !errors.Is(err, ErrNonMonotonicKey) {
+			t.Fatalf("%s: expected ErrNonMonotonicKey, got %v", k, err)
+		}
+	}
+
+	// batches must put keys in order, after the last key written.
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = b.Put(ctx, datastore.NewKey("/log/012"), nil)
+	_ = b.Put(ctx, datastore.NewKey("/log/011"), nil)
+	if err := b.Commit(ctx); !errors.Is(err, ErrNonMonotonicKey) {
+		t.Fatalf("expected ErrNonMonotonicKey, got %v", err)
+	}
+	b, err = d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = b.Put(ctx, datastore.NewKey("/log/011"), nil)
+	_ = b.Put(ctx, datastore.NewKey("/log/012"), nil)
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent writers land in order, or fail.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/log/%03d%d", 100+j, i)), nil)
+				if err != nil && !errors.Is(err, ErrNonMonotonicKey) {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	last, _, err := d.LastKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDatastoreWithOptions(path, nil, WithAppendOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Put(ctx, last, nil); !errors.Is(err, ErrNonMonotonicKey) {
+		t.Fatalf("expected the last key to be recovered, got %v", err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/log/999"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendOnlyLRU(t *testing.T) {
+	d, cleanup := newDatastore(t, WithAppendOnly(true))
+	defer cleanup()
+	l, err := NewLRUDatastore(d, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx := context.Background()
+	if err := l.Put(ctx, datastore.NewKey("/z"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(ctx, datastore.NewKey("/a"), nil); !errors.Is(err, ErrNonMonotonicKey) {
+		t.Fatalf("expected ErrNonMonotonicKey, got %v", err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/y"), nil); !errors.Is(err, ErrNonMonotonicKey) {
+		t.Fatalf("expected writes through the LRU to advance the last key, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package pebbleds
+
+import (
+	"context"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// WithBlockPropertyCollectors registers block-property collectors
+// (pebble.Options.BlockPropertyCollectors), which compute properties of every
+// sstable block as it is written. QueryWithBlockFilters can then skip whole
+// blocks whose properties cannot match a predicate, before reading their
+// entries. NewIntervalCollector builds collectors for the common case of
+// numeric ranges, such as timestamps.
+//
+// Properties are only computed for sstables written after the collectors are
+// registered, and collectors must keep their names for filters to find their
+// properties. Block properties require the on-disk format to be at least
+// pebble.FormatBlockPropertyCollector, so the store is upgraded to it if
+// needed, after which older versions of Pebble cannot open it anymore.
+func WithBlockPropertyCollectors(collectors ...func() pebble.BlockPropertyCollector) Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.BlockPropertyCollectors = append(o.BlockPropertyCollectors, collectors...)
+			if o.FormatMajorVersion < pebble.FormatBlockPropertyCollector {
+				o.FormatMajorVersion = pebble.FormatBlockPropertyCollector
+			}
+		})
+	}
+}
+
+// NewIntervalCollector returns a block-property collector recording, for
+// every block, the [lower, upper) interval of the numbers extract returns for
+// its entries. Entries for which extract returns false are not accounted for.
+//
+// extract is passed the key and value as stored, so values carry their
+// checksum if WithValueChecksums is enabled. Use NewIntervalFilter with the
+// same name to filter on the interval.
+func NewIntervalCollector(name string, extract func(key, value []byte) (uint64, bool)) func() pebble.BlockPropertyCollector {
+	return func() pebble.BlockPropertyCollector {
+		return sstable.NewBlockIntervalCollector(name, &intervalCollector{extract: extract}, nil)
+	}
+}
+
+// NewIntervalFilter returns a block-property filter skipping the blocks whose
+// interval, recorded by the collector of the given name, does not intersect
+// [lower, upper).
+func NewIntervalFilter(name string, lower, upper uint64) pebble.BlockPropertyFilter {
+	return sstable.NewBlockIntervalFilter(name, lower, upper)
+}
+
+type intervalCollector struct {
+	extract      func(key, value []byte) (uint64, bool)
+	lower, upper uint64
+}
+
+var _ sstable.DataBlockIntervalCollector = (*intervalCollector)(nil)
+
+func (c *intervalCollector) Add(key pebble.InternalKey, value []byte) error {
+	v, ok := c.extract(key.UserKey, value)
+	if !ok {
+		return nil
+	}
+	if c.lower == c.upper {
+		c.lower, c.upper = v, v+1
+		return nil
+	}
+	if v < c.lower {
+		c.lower = v
+	}
+	if v >= c.upper {
+		c.upper = v + 1
+	}
+	return nil
+}
+
+func (c *intervalCollector) FinishDataBlock() (lower, upper uint64, err error) {
+	lower, upper = c.lower, c.upper
+	c.lower, c.upper = 0, 0
+	return lower, upper, nil
+}
+
+// QueryWithBlockFilters is like Query, but lets Pebble skip the sstable blocks
+// that the given filters rule out, which can save most of the IO of selective
+// queries over data laid out accordingly.
+//
+// Filters work at the granularity of blocks, and data still in memtables is
+// not filtered at all: results include every entry of the blocks that are not
+// skipped, and must still be filtered exactly, e.g. with q.Filters.
+func (d *Datastore) QueryWithBlockFilters(ctx context.Context, q query.Query, filters ...pebble.BlockPropertyFilter) (query.Results, error) {
+	opts, ok := d.queryIterOptions(q)
+	if !ok {
+		return query.ResultsWithEntries(q, []query.Entry{}), nil
+	}
+	// Pebble asks for one spare slot to avoid allocating.
+	pointFilters := make([]pebble.BlockPropertyFilter, len(filters), len(filters)+1)
+	copy(pointFilters, filters)
+	opts.PointKeyFilters = pointFilters
+	return d.query(ctx, d.queryReader(), q, opts)
+}
@@ -0,0 +1,84 @@
+package pebbleds
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// timestampFilter matches the entries whose value starts with a timestamp in
+// [lower, upper).
+type timestampFilter struct {
+	lower, upper uint64
+}
+
+func (f timestampFilter) Filter(e query.Entry) bool {
+	ts := binary.BigEndian.Uint64(e.Value)
+	return ts >= f.lower && ts < f.upper
+}
+
+func TestQueryWithBlockFilters(t *testing.T) {
+	opts := &pebble.Options{}
+	opts.EnsureDefaults()
+	for i := range opts.Levels {
+		opts.Levels[i].BlockSize = 1 << 10
+	}
+	collector := NewIntervalCollector("ts", func(_, value []byte) (uint64, bool) {
+		if len(value) < 8 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint64(value), true
+	})
+	d, err := NewDatastoreWithOptions(t.TempDir(), opts, WithBlockPropertyCollectors(collector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 2000; i++ {
+		val := make([]byte, 256)
+		binary.BigEndian.PutUint64(val, uint64(i))
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/events/%05d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	blockReads := func() int64 {
+		m := d.db.Metrics()
+		return m.BlockCache.Hits + m.BlockCache.Misses
+	}
+	count := func(res query.Results, err error) (int, int64) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := blockReads()
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries), blockReads() - before
+	}
+
+	q := query.Query{Prefix: "/events", Filters: []query.Filter{timestampFilter{1000, 1100}}}
+	n, unfiltered := count(d.Query(ctx, q))
+	if n != 100 {
+		t.Fatalf("expected 100 entries, got %d", n)
+	}
+	n, filtered := count(d.QueryWithBlockFilters(ctx, q, NewIntervalFilter("ts", 1000, 1100)))
+	if n != 100 {
+		t.Fatalf("expected 100 entries with block filters, got %d", n)
+	}
+	if filtered*4 > unfiltered {
+		t.Fatalf("expected block filters to skip most blocks, read %d blocks vs %d", filtered, unfiltered)
+	}
+}
@@ -0,0 +1,50 @@
+package pebbleds
+
+import "sync"
+
+// boundsCache caches the iterator bounds of query prefixes. The cached bounds
+// are shared by every query on the prefix and must not be modified.
+type boundsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]prefixBounds
+}
+
+type prefixBounds struct {
+	lower, upper []byte
+}
+
+func newBoundsCache(size int) *boundsCache {
+	return &boundsCache{size: size, entries: make(map[string]prefixBounds, size)}
+}
+
+// prefixBounds returns the iterator bounds of the keys under the query prefix,
+// interpreted according to the configured PrefixMode, from the cache if
+// enabled.
+func (d *Datastore) prefixBounds(prefix string) (lower, upper []byte) {
+	c := d.bounds
+	if c == nil {
+		lower = []byte(d.queryPrefix(prefix))
+		return lower, prefixUpperBound(lower)
+	}
+
+	c.mu.Lock()
+	b, ok := c.entries[prefix]
+	c.mu.Unlock()
+	if ok {
+		return b.lower, b.upper
+	}
+
+	lower = []byte(d.queryPrefix(prefix))
+	b = prefixBounds{lower: lower, upper: prefixUpperBound(lower)}
+	c.mu.Lock()
+	if len(c.entries) >= c.size {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[prefix] = b
+	c.mu.Unlock()
+	return b.lower, b.upper
+}
@@ -0,0 +1,67 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestQueryBoundsCache(t *testing.T) {
+	prefixes := []string{"", "/", "/a", "/a/b/", "a//b", "\x01", "\x00\x00\xff", "\x00\x00\xff\x01", "\xff", "\xff\xff\xff"}
+	for _, mode := range []PrefixMode{NamespacedPrefix, RawPrefix} {
+		fresh, cleanup := newDatastore(t, WithPrefixMode(mode))
+		defer cleanup()
+		// a cache smaller than the prefixes, to go through evictions.
+		cached, cleanup := newDatastore(t, WithPrefixMode(mode), WithQueryBoundsCache(3))
+		defer cleanup()
+
+		for round := 0; round < 2; round++ {
+			for _, p := range prefixes {
+				wantLower, wantUpper := fresh.prefixBounds(p)
+				lower, upper := cached.prefixBounds(p)
+				if !bytes.Equal(lower, wantLower) || !bytes.Equal(upper, wantUpper) || (upper == nil) != (wantUpper == nil) {
+					t.Errorf("mode %d, prefix %q: expected bounds [%x, %x), got [%x, %x)", mode, p, wantLower, wantUpper, lower, upper)
+				}
+			}
+		}
+		if n := len(cached.bounds.entries); n > 3 {
+			t.Errorf("expected at most 3 cached prefixes, got %d", n)
+		}
+	}
+}
+
+func BenchmarkRepeatedPrefixQuery(b *testing.B) {
+	for name, options := range map[string][]Option{
+		"uncached": nil,
+		"cached":   {WithQueryBoundsCache(16)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			ds, cleanup := newDatastore(b, options...)
+			defer cleanup()
+
+			ctx := context.Background()
+			for i := 0; i < 10; i++ {
+				if err := ds.Put(ctx, datastore.NewKey(fmt.Sprintf("/hot/prefix/%d", i)), []byte("val")); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			q := query.Query{Prefix: "/hot/prefix"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := ds.Query(ctx, q)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := res.Rest(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
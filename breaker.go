@@ -0,0 +1,107 @@
+package pebbleds
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-log/v2"
+)
+
+// ErrCircuitOpen is returned by reads while the read circuit breaker is open.
+// See WithReadCircuitBreaker.
+var ErrCircuitOpen = errors.New("pebble datastore read circuit breaker open")
+
+// circuitBreaker fast-fails operations after repeated failures, to stop
+// hammering a failing device.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+	log       log.StandardLogger
+
+	mu           sync.Mutex
+	failures     int
+	firstFailure time.Time
+	open         bool
+	openedAt     time.Time
+	probing      bool
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration, log log.StandardLogger) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+		log:       log,
+	}
+}
+
+// allow returns ErrCircuitOpen if the operation must not be attempted. Once
+// the cooldown is over, a single operation is let through to probe whether
+// things are back to normal, in which case probe is set. Every allowed
+// operation must be followed by a call to record, or to abandon if it did not
+// get to touch the disk.
+func (b *circuitBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return false, nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false, ErrCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// abandon releases an allowed operation that gave up before touching the
+// disk, letting another probe through if it was the probe.
+func (b *circuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// record registers the outcome of an allowed operation, probe telling whether
+// it was let through as the probe. ds.ErrNotFound is not a failure. Only the
+// probe closes an open breaker: operations allowed before it opened may still
+// complete successfully while the disk is failing, e.g. from the cache.
+func (b *circuitBreaker) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || errors.Is(err, ds.ErrNotFound) {
+		if probe || !b.open {
+			b.failures, b.open, b.probing = 0, false, false
+		}
+		return
+	}
+
+	now := b.now()
+	if probe {
+		// the probe failed; cool down again.
+		b.probing = false
+		b.openedAt = now
+		return
+	}
+	if b.open {
+		// failure of an operation allowed before the breaker opened.
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.failures, b.open, b.openedAt = 0, true, now
+		b.log.Warnf("pebble read circuit breaker open after %d consecutive errors, last: %s", b.threshold, err)
+	}
+}
@@ -0,0 +1,143 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(3, time.Second, time.Minute, logger)
+	b.now = func() time.Time { return now }
+
+	errRead := errors.New("read failed")
+	allow := func() bool {
+		t.Helper()
+		probe, err := b.allow()
+		if err != nil {
+			t.Fatalf("expected the read to be allowed, got %v", err)
+		}
+		return probe
+	}
+	fail := func() {
+		t.Helper()
+		b.record(allow(), errRead)
+	}
+	expectOpen := func(msg string) {
+		t.Helper()
+		if _, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected ErrCircuitOpen %s, got %v", msg, err)
+		}
+	}
+
+	// failures spread over more than the window do not open the breaker.
+	fail()
+	fail()
+	now = now.Add(2 * time.Second)
+	fail()
+	b.record(allow(), datastore.ErrNotFound)
+
+	// a slow read allowed before the breaker opens does not close it by
+	// succeeding afterwards.
+	slow := allow()
+	fail()
+	fail()
+	fail()
+	expectOpen("")
+	b.record(slow, nil)
+	expectOpen("after a success allowed before opening")
+
+	// a failed probe keeps it open for another cooldown.
+	now = now.Add(time.Minute)
+	if !allow() {
+		t.Fatal("expected a probe")
+	}
+	b.record(true, errRead)
+	expectOpen("after a failed probe")
+
+	// an abandoned probe lets another one through.
+	now = now.Add(time.Minute)
+	b.abandon(allow())
+	probe := allow()
+	if !probe {
+		t.Fatal("expected a probe")
+	}
+	expectOpen("while probing")
+	// a successful probe closes it.
+	b.record(probe, nil)
+	if allow() {
+		t.Fatal("expected the breaker to be closed")
+	}
+}
+
+func TestReadCircuitBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	d, cleanup := newDatastore(t, WithValueChecksums(true), WithReadCircuitBreaker(3, time.Second, cooldown))
+	defer cleanup()
+
+	ctx := context.Background()
+	good, bad := datastore.NewKey("/good"), datastore.NewKey("/bad")
+	for _, k := range []datastore.Key{good, bad} {
+		if err := d.Put(ctx, k, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// enough entries for a query to hold its iterator until consumed.
+	for i := 0; i < 10; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/probe/%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// corrupt a value so that reading it fails.
+	stored, closer, err := d.db.Get(bad.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Clone(stored)
+	_ = closer.Close()
+	corrupted[0] ^= 0xff
+	if err := d.db.Set(bad.Bytes(), corrupted, pebble.NoSync); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.Get(ctx, bad); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+		}
+	}
+	if _, err := d.Get(ctx, good); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if _, err := d.Has(ctx, good); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	// queries are fast-failed too, and may probe.
+	if _, err := d.Query(ctx, query.Query{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	time.Sleep(cooldown)
+	res, err := d.Query(ctx, query.Query{Prefix: "/probe"})
+	if err != nil {
+		t.Fatalf("expected a query to probe after the cooldown, got %v", err)
+	}
+	// the probe is settled once the iterator is open, before the results
+	// are consumed.
+	if _, err := d.Get(ctx, good); err != nil {
+		t.Fatalf("expected reads to recover after a successful probe, got %v", err)
+	}
+	if _, err := res.Rest(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, datastore.NewKey("/missing")); !errors.Is(err, datastore.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Checkpoint writes a consistent copy of the store to destDir, which must not
+// exist, hard-linking sstables whenever possible. The checkpoint is a regular
+// Pebble database: it can be opened with NewDatastore, once checked with
+// VerifyCheckpoint if need be.
+func (d *Datastore) Checkpoint(ctx context.Context, destDir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := d.db.Checkpoint(destDir, pebble.WithFlushedWAL()); err != nil {
+		return fmt.Errorf("pebble error during checkpoint: %w", err)
+	}
+	return nil
+}
+
+// VerifyCheckpoint checks that the checkpoint or backup at path can be
+// restored, without restoring it: it opens it read-only, runs the consistency
+// checks of pebble.DB.CheckLevels over it, which read every block, verifying
+// their checksums, and closes it. The opts are the Pebble options to open it
+// with, if any; they are not modified, and the checkpoint neither.
+func VerifyCheckpoint(path string, opts *pebble.Options) error {
+	if opts == nil {
+		opts = &pebble.Options{}
+	} else {
+		opts = opts.Clone()
+	}
+	opts.EnsureDefaults()
+	opts.ReadOnly = true
+	opts.ErrorIfNotExists = true
+	opts.Logger = logger
+
+	// Pebble creates the directory before finding out there is no database
+	// in it.
+	if _, err := opts.FS.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to open checkpoint: %w: dirname=%q", pebble.ErrDBDoesNotExist, path)
+	}
+
+	db, err := pebble.Open(path, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	if err := db.CheckLevels(nil); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("checkpoint consistency check failed: %w", err)
+	}
+	return db.Close()
+}
@@ -0,0 +1,84 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestVerifyCheckpoint(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		value := make([]byte, 256)
+		_, _ = rng.Read(value)
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/cp/%04d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := d.Checkpoint(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCheckpoint(dir, nil); err != nil {
+		t.Fatalf("expected the checkpoint to verify, got %v", err)
+	}
+
+	// the checkpoint is restorable.
+	restored, err := NewDatastore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, err := restored.Has(ctx, datastore.NewKey("/cp/0999")); err != nil || !has {
+		t.Fatalf("expected the restored store to hold the keys, got %t %v", has, err)
+	}
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyCheckpoint(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Fatal("expected a missing checkpoint to fail verification")
+	}
+
+	// corrupt the middle of the sstables of the checkpoint. They are hard
+	// links to the ones of the store, so copy them first.
+	ssts, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil || len(ssts) == 0 {
+		t.Fatalf("expected sstables in the checkpoint, got %v %v", ssts, err)
+	}
+	for _, sst := range ssts {
+		data, err := os.ReadFile(sst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := len(data) / 4; i < len(data)/2; i++ {
+			data[i] ^= 0xff
+		}
+		if err := os.Remove(sst); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(sst, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := VerifyCheckpoint(dir, nil); err == nil {
+		t.Fatal("expected the corrupted checkpoint to fail verification")
+	}
+
+	// the store itself is untouched.
+	if _, err := d.Get(ctx, datastore.NewKey("/cp/0500")); err != nil {
+		t.Fatal(err)
+	}
+}
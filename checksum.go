@@ -0,0 +1,52 @@
+package pebbleds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrChecksumMismatch is returned when reading a value whose stored checksum
+// does not match its contents. See WithValueChecksums.
+var ErrChecksumMismatch = errors.New("pebble datastore value checksum mismatch")
+
+const checksumLen = crc32.Size
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeValue returns the value as it must be stored, with its checksum
+// appended if value checksums are enabled.
+func (d *Datastore) encodeValue(value []byte) []byte {
+	if !d.conf.valueChecksums {
+		return value
+	}
+	stored := make([]byte, len(value), len(value)+checksumLen)
+	copy(stored, value)
+	return binary.BigEndian.AppendUint32(stored, crc32.Checksum(value, castagnoli))
+}
+
+// decodeValue verifies and strips the checksum of a stored value, if value
+// checksums are enabled. The returned value aliases stored.
+func (d *Datastore) decodeValue(key, stored []byte) ([]byte, error) {
+	if !d.conf.valueChecksums {
+		return stored, nil
+	}
+	if len(stored) < checksumLen {
+		return nil, fmt.Errorf("%w: value of key %s is too short", ErrChecksumMismatch, key)
+	}
+	value, sum := stored[:len(stored)-checksumLen], stored[len(stored)-checksumLen:]
+	if crc32.Checksum(value, castagnoli) != binary.BigEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%w: key %s", ErrChecksumMismatch, key)
+	}
+	return value, nil
+}
+
+// valueLen returns the length of the value for a stored value of the given
+// length, without verifying it.
+func (d *Datastore) valueLen(storedLen int) int {
+	if !d.conf.valueChecksums || storedLen < checksumLen {
+		return storedLen
+	}
+	return storedLen - checksumLen
+}
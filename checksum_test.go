@@ -0,0 +1,115 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestValueChecksumsSuite(t *testing.T) {
+	ds, cleanup := newDatastore(t, WithValueChecksums(true))
+	defer cleanup()
+
+	dstest.SubtestAll(t, ds)
+}
+
+func TestValueChecksums(t *testing.T) {
+	ds, cleanup := newDatastore(t, WithValueChecksums(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	good, bad := datastore.NewKey("/good"), datastore.NewKey("/bad")
+	for _, k := range []datastore.Key{good, bad} {
+		if err := ds.Put(ctx, k, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// flip a byte of the stored value behind the datastore's back.
+	stored, closer, err := ds.db.Get(bad.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Clone(stored)
+	_ = closer.Close()
+	corrupted[0] ^= 0xff
+	if err := ds.db.Set(bad.Bytes(), corrupted, pebble.NoSync); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := ds.Get(ctx, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "value" {
+		t.Fatalf("expected the value without the checksum, got %q", val)
+	}
+	size, err := ds.GetSize(ctx, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("value") {
+		t.Fatalf("expected size %d, got %d", len("value"), size)
+	}
+
+	if _, err := ds.Get(ctx, bad); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from Get, got %v", err)
+	}
+
+	res, err := ds.Query(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Rest(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from Query, got %v", err)
+	}
+
+	err = ds.ScanPrefix(ctx, "/", func(e *LazyEntry) error {
+		_, err := e.Value()
+		return err
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from ScanPrefix, got %v", err)
+	}
+}
+
+func TestValueChecksumsQueryFilters(t *testing.T) {
+	ds, cleanup := newDatastore(t, WithValueChecksums(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	for k, v := range map[string]string{"/a": "bbb", "/b": "a", "/c": "cc"} {
+		if err := ds.Put(ctx, datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// filters and orders see the values without their checksum.
+	res, err := ds.Query(ctx, query.Query{
+		Filters:      []query.Filter{query.FilterValueCompare{Op: query.GreaterThanOrEqual, Value: []byte("b")}},
+		Orders:       []query.Order{query.OrderByValue{}},
+		ReturnsSizes: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	for i, expect := range []string{"bbb", "cc"} {
+		e := entries[i]
+		if string(e.Value) != expect || e.Size != len(expect) {
+			t.Fatalf("expected %q with size %d, got %q with size %d", expect, len(expect), e.Value, e.Size)
+		}
+	}
+}
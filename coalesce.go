@@ -0,0 +1,116 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// CoalesceDeletes makes the batch turn runs of at least minRun deletes of
+// contiguous keys into single range deletions on Commit. Keys are contiguous
+// when no other key exists between them at commit time. One range tombstone
+// is much cheaper to write and to compact away than many point tombstones,
+// which matters for bulk deletions. Other deletes stay point deletes. It must
+// be called before any Delete on the batch.
+//
+// A range deletion removes every key within its range when committed. Keys
+// written concurrently by other writers between the contiguity check on
+// Commit and the commit itself are thus deleted too, while point deletes would
+// have left them alone. Keys written within the batch itself are preserved.
+func (b *Batch) CoalesceDeletes(minRun int) {
+	b.coalesce = &deleteCoalescer{
+		minRun:  minRun,
+		pending: make(map[string]struct{}),
+		puts:    make(map[string]struct{}),
+	}
+}
+
+// deleteCoalescer defers the deletes of a batch to turn contiguous runs into
+// range deletions. Deferred deletes are applied before the rest of the batch,
+// so keys put within the batch after being deleted survive, while keys put
+// before being deleted are deleted right away instead of being deferred.
+type deleteCoalescer struct {
+	minRun  int
+	pending map[string]struct{}
+	puts    map[string]struct{}
+}
+
+func (c *deleteCoalescer) put(key []byte) {
+	delete(c.pending, string(key))
+	c.puts[string(key)] = struct{}{}
+}
+
+// delete defers the delete of the key, returning false if it must be applied
+// right away instead.
+func (c *deleteCoalescer) delete(key []byte) bool {
+	if _, ok := c.puts[string(key)]; ok {
+		return false
+	}
+	c.pending[string(key)] = struct{}{}
+	return true
+}
+
+// apply returns a batch with the deferred deletes, coalesced, followed by the
+// operations of b.
+func (c *deleteCoalescer) apply(ctx context.Context, d *Datastore, b *pebble.Batch) (*pebble.Batch, error) {
+	keys := make([][]byte, 0, len(c.pending))
+	for k := range c.pending {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	last := keys[len(keys)-1]
+	iter, err := d.db.NewIterWithContext(ctx, &pebble.IterOptions{
+		LowerBound: keys[0],
+		UpperBound: append(last[:len(last):len(last)], 0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	merged := d.db.NewBatch()
+	flush := func(run [][]byte) error {
+		if len(run) >= c.minRun && len(run) > 1 {
+			end := run[len(run)-1]
+			return merged.DeleteRange(run[0], append(end[:len(end):len(end)], 0), nil)
+		}
+		for _, k := range run {
+			if err := merged.Delete(k, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start := 0
+	for i := 1; i <= len(keys); i++ {
+		if i < len(keys) {
+			// the run goes on unless a key exists in between.
+			prev := keys[i-1]
+			if !iter.SeekGE(append(prev[:len(prev):len(prev)], 0)) || bytes.Compare(iter.Key(), keys[i]) >= 0 {
+				if err := iter.Error(); err != nil {
+					merged.Close()
+					return nil, fmt.Errorf("pebble error coalescing deletes: %w", err)
+				}
+				continue
+			}
+		}
+		if err := flush(keys[start:i]); err != nil {
+			merged.Close()
+			return nil, fmt.Errorf("pebble error coalescing deletes: %w", err)
+		}
+		start = i
+	}
+
+	if err := merged.Apply(b, nil); err != nil {
+		merged.Close()
+		return nil, fmt.Errorf("pebble error coalescing deletes: %w", err)
+	}
+	return merged, nil
+}
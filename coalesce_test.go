@@ -0,0 +1,106 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestCoalesceDeletes(t *testing.T) {
+	ctx := context.Background()
+	key := func(i int) datastore.Key {
+		return datastore.NewKey(fmt.Sprintf("/del/%03d", i))
+	}
+
+	run := func(t *testing.T, minRun int) (keys []string, points, ranges int) {
+		d, cleanup := newDatastore(t)
+		defer cleanup()
+
+		for i := 0; i < 100; i++ {
+			if err := d.Put(ctx, key(i), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		b, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := b.(*Batch)
+		if minRun > 0 {
+			batch.CoalesceDeletes(minRun)
+		}
+		// a put before the delete of the same key, and keys put within the
+		// range deleted.
+		if err := batch.Put(ctx, datastore.NewKey("/del/new"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			if err := batch.Delete(ctx, key(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, i := range []int{60, 70} {
+			if err := batch.Delete(ctx, key(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Delete(ctx, datastore.NewKey("/del/new")); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Put(ctx, datastore.NewKey("/del/010/child"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Put(ctx, key(20), []byte("again")); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := d.Query(ctx, query.Query{Prefix: "/del", KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+
+		internal, err := d.DebugScan(ctx, "/del")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range internal {
+			switch e.Kind {
+			case pebble.InternalKeyKindDelete:
+				points++
+			case pebble.InternalKeyKindRangeDelete:
+				ranges++
+			}
+		}
+		return keys, points, ranges
+	}
+
+	expect, points, ranges := run(t, 0)
+	if points != 52 || ranges != 0 {
+		t.Fatalf("expected 52 point tombstones without coalescing, got %d and %d ranges", points, ranges)
+	}
+	got, points, ranges := run(t, 4)
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected the same keys as with point deletes:\n%v\ngot:\n%v", expect, got)
+	}
+	// /del/020 splits the run in two, /del/060 and /del/070 are isolated, and
+	// /del/new was put earlier in the batch.
+	if ranges != 2 || points != 3 {
+		t.Fatalf("expected 2 range tombstones and 3 point tombstones, got %d and %d", ranges, points)
+	}
+}
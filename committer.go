@@ -0,0 +1,99 @@
+package pebbleds
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// committer coalesces the commits of many small batches issued within a
+// window into a single pebble commit. See WithCommitWindow.
+type committer struct {
+	db     *pebble.DB
+	window time.Duration
+	wo     *pebble.WriteOptions
+
+	mu      sync.Mutex
+	pending []pendingCommit
+	timer   *time.Timer
+	closed  bool
+
+	// flushMu serializes flushes, so that close can wait for an in-flight
+	// one before the database goes away.
+	flushMu sync.Mutex
+}
+
+type pendingCommit struct {
+	batch *pebble.Batch
+	done  chan error
+}
+
+func newCommitter(db *pebble.DB, window time.Duration, wo *pebble.WriteOptions) *committer {
+	return &committer{db: db, window: window, wo: wo}
+}
+
+// commit enqueues the batch and blocks until the group it ends up in has been
+// committed.
+func (c *committer) commit(b *pebble.Batch) error {
+	done := make(chan error, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.pending = append(c.pending, pendingCommit{batch: b, done: done})
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+	c.mu.Unlock()
+
+	return <-done
+}
+
+// flush commits every pending batch at once.
+func (c *committer) flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending, c.timer = nil, nil
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	err := c.apply(pending)
+	for _, p := range pending {
+		p.done <- err
+	}
+}
+
+func (c *committer) apply(pending []pendingCommit) error {
+	if len(pending) == 1 {
+		return pending[0].batch.Commit(c.wo)
+	}
+	merged := c.db.NewBatch()
+	defer merged.Close()
+	for _, p := range pending {
+		if err := merged.Apply(p.batch, nil); err != nil {
+			return fmt.Errorf("pebble error during commit coalescing: %w", err)
+		}
+	}
+	return merged.Commit(c.wo)
+}
+
+// close commits whatever is pending and makes any further commit fail with
+// ErrClosed.
+func (c *committer) close() {
+	c.mu.Lock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+	c.flush()
+}
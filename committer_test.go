@@ -0,0 +1,101 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestCommitWindow(t *testing.T) {
+	d, cleanup := newDatastore(t, WithCommitWindow(10*time.Millisecond))
+	defer cleanup()
+
+	ctx := context.Background()
+	var (
+		wg    sync.WaitGroup
+		hooks atomic.Int64
+	)
+	for i := 0; i < 32; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := d.Batch(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b.(*Batch).OnCommit(func(_, _ []datastore.Key) { hooks.Add(1) })
+			for j := 0; j < 4; j++ {
+				if err := b.Put(ctx, datastore.NewKey(fmt.Sprintf("/%d/%d", i, j)), []byte("val")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if err := b.Commit(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+			// writes are visible once Commit returns.
+			if _, err := d.Get(ctx, datastore.NewKey(fmt.Sprintf("/%d/3", i))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if hooks.Load() != 32 {
+		t.Fatalf("expected 32 hook calls, got %d", hooks.Load())
+	}
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, datastore.NewKey("/late"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func BenchmarkSmallBatches(b *testing.B) {
+	for _, window := range []time.Duration{0, 100 * time.Microsecond} {
+		b.Run(fmt.Sprintf("window=%s", window), func(b *testing.B) {
+			d, cleanup := newDatastore(b, WithCommitWindow(window))
+			defer cleanup()
+
+			ctx := context.Background()
+			var n atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					batch, err := d.Batch(ctx)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if err := batch.Put(ctx, datastore.NewKey(fmt.Sprintf("/%d", n.Add(1))), []byte("val")); err != nil {
+						b.Error(err)
+						return
+					}
+					if err := batch.Commit(ctx); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// CompactL0 compacts every file currently in L0 into the lower levels. L0 is
+// usually the biggest contributor to read amplification, as its files may
+// overlap each other and every one of them has to be consulted on lookups.
+//
+// Pebble does not allow to target a single level from outside, so this runs a
+// manual compaction over the key span covered by L0. Files in deeper levels
+// overlapping that span are rewritten as well, but data outside of it is left
+// untouched. CompactL0 is a no-op when L0 is empty.
+func (d *Datastore) CompactL0(ctx context.Context) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tables, err := d.db.SSTables()
+	if err != nil {
+		return fmt.Errorf("pebble error listing sstables: %w", err)
+	}
+	if len(tables) == 0 || len(tables[0]) == 0 {
+		return nil
+	}
+
+	var start, end []byte
+	for _, t := range tables[0] {
+		if start == nil || bytes.Compare(t.Smallest.UserKey, start) < 0 {
+			start = t.Smallest.UserKey
+		}
+		if end == nil || bytes.Compare(t.Largest.UserKey, end) > 0 {
+			end = t.Largest.UserKey
+		}
+	}
+	// Compact treats the end key inclusively, but requires it to be strictly
+	// greater than the start key.
+	if bytes.Equal(start, end) {
+		end = append(end[:len(end):len(end)], 0)
+	}
+
+	if err := d.db.Compact(start, end, true); err != nil {
+		return fmt.Errorf("pebble error during L0 compaction: %w", err)
+	}
+	return nil
+}
+
+// Compact compacts the keys in [start, end], such as a range that just took a
+// burst of overwrites, to flatten the read amplification of that range only.
+// Files overlapping the range are rewritten down to the lowest level holding
+// data in it; data outside of it is left untouched, unless in the same files.
+// A zero start key means the beginning of the keyspace, and a zero end key
+// its end. It blocks until done, and the context is only checked before it
+// starts.
+func (d *Datastore) Compact(ctx context.Context, start, end ds.Key) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	lower, upper := start.Bytes(), end.Bytes()
+	if end.String() == "" {
+		_, last, err := d.keyspaceBounds(ctx)
+		if err != nil || last == nil {
+			return err
+		}
+		if bytes.Compare(lower, last) > 0 {
+			// there is nothing from start on.
+			return nil
+		}
+		upper = last
+	}
+	switch c := bytes.Compare(lower, upper); {
+	case c > 0:
+		return fmt.Errorf("invalid compaction range: start %q is after end %q", lower, upper)
+	case c == 0:
+		// Compact treats the end key inclusively, but requires it to be
+		// strictly greater than the start key.
+		upper = append(upper[:len(upper):len(upper)], 0)
+	}
+
+	if err := d.db.Compact(lower, upper, true); err != nil {
+		return fmt.Errorf("pebble error during compaction: %w", err)
+	}
+	return nil
+}
+
+// CompactAll compacts the whole keyspace, leaving a single sorted run of
+// files in the bottommost level. This is expensive, as it rewrites every file
+// in the store, but it results in the least read amplification possible. It
+// is mostly useful to finalize bulk loads done with WithManualCompaction.
+func (d *Datastore) CompactAll(ctx context.Context) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	start, end, err := d.keyspaceBounds(ctx)
+	if err != nil || start == nil {
+		return err
+	}
+	if err := d.db.Compact(start, end, true); err != nil {
+		return fmt.Errorf("pebble error during compaction: %w", err)
+	}
+	return nil
+}
+
+// RebuildFilters rewrites every sstable of the store, so that they all carry
+// the filters currently configured, such as after reopening the store with
+// different WithBloomFilters: sstables otherwise keep the filters they were
+// written with until compactions happen to rewrite them.
+//
+// Compacting alone does not rewrite the sstables of the bottommost level that
+// nothing above overlaps, which is most of the data of a settled store, so
+// RebuildFilters first deletes two keys that cannot exist, bracketing the
+// whole keyspace, for the compaction to overlap every sstable on its way
+// down. This rewrites the whole store, once per level holding data, which
+// takes as much IO as the size of the store times the number of levels:
+// run it off-peak. It blocks until done, and the context is only checked
+// before it starts.
+func (d *Datastore) RebuildFilters(ctx context.Context) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, end, err := d.keyspaceBounds(ctx)
+	if err != nil || end == nil {
+		return err
+	}
+	// no ds.Key nor reserved key is empty, or made of 0xff bytes only.
+	start, end := []byte{}, bytes.Repeat([]byte{0xff}, len(end))
+
+	b := d.db.NewBatch()
+	defer b.Close()
+	if err := b.Delete(start, nil); err != nil {
+		return fmt.Errorf("pebble error during delete within batch: %w", err)
+	}
+	if err := b.Delete(end, nil); err != nil {
+		return fmt.Errorf("pebble error during delete within batch: %w", err)
+	}
+	if err := b.Commit(pebble.NoSync); err != nil {
+		return fmt.Errorf("pebble error during filter rebuild: %w", err)
+	}
+	// a single compaction per level, rather than parallel ones over parts of
+	// the keyspace, overlaps every sstable of the next level.
+	if err := d.db.Compact(start, end, false); err != nil {
+		return fmt.Errorf("pebble error during filter rebuild: %w", err)
+	}
+	return nil
+}
+
+// CollectGarbage reclaims the space held by deleted and overwritten entries,
+// and by the tombstones of the deletes, by compacting the whole keyspace like
+// CompactAll. It implements ds.GCDatastore.
+//
+// Pebble compactions cannot be interrupted once started, so the context is
+// only checked before it runs.
+func (d *Datastore) CollectGarbage(ctx context.Context) error {
+	return d.CompactAll(ctx)
+}
+
+// keyspaceBounds returns the [start, end) bounds covering every key in the
+// datastore, or nil bounds if it's empty.
+func (d *Datastore) keyspaceBounds(ctx context.Context) (start, end []byte, err error) {
+	iter, err := d.db.NewIterWithContext(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	if !iter.First() {
+		return nil, nil, iter.Error()
+	}
+	start = append([]byte(nil), iter.Key()...)
+	if !iter.Last() {
+		return nil, nil, iter.Error()
+	}
+	end = append(append([]byte(nil), iter.Key()...), 0)
+	return start, end, nil
+}
+
+// CompactionDebt returns Pebble's estimate of the number of bytes that
+// compactions have yet to rewrite to bring the LSM back into shape
+// (pebble.Metrics.Compact.EstimatedDebt). A debt that keeps growing under
+// sustained writes means compactions are not keeping up, and write stalls
+// will eventually follow.
+func (d *Datastore) CompactionDebt() (uint64, error) {
+	if err := d.acquire(); err != nil {
+		return 0, err
+	}
+	defer d.wg.Done()
+
+	return d.db.Metrics().Compact.EstimatedDebt, nil
+}
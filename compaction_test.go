@@ -0,0 +1,422 @@
+package pebbleds
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestCompactL0(t *testing.T) {
+	opts := &pebble.Options{
+		DisableAutomaticCompactions: true,
+	}
+	opts.EnsureDefaults()
+
+	d, err := NewDatastore(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	// a deeper level holding data outside of what goes to L0 later on.
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/deep/%03d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Compact([]byte("/deep/"), []byte("/deep0"), false); err != nil {
+		t.Fatal(err)
+	}
+	deep := d.db.Metrics().Levels[6].NumFiles
+	if deep == 0 {
+		t.Fatal("expected files in the bottom level")
+	}
+
+	// each flush creates a new L0 file.
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/l0/%03d", i*10+j)), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.db.Metrics().Levels[0].NumFiles; n < 10 {
+		t.Fatalf("expected at least 10 files in L0, got %d", n)
+	}
+
+	if err := d.CompactL0(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	m := d.db.Metrics()
+	if n := m.Levels[0].NumFiles; n != 0 {
+		t.Fatalf("expected L0 to be empty, got %d files", n)
+	}
+	if n := m.Levels[6].NumFiles; n < deep {
+		t.Fatalf("expected the bottom level files to be left alone, got %d (was %d)", n, deep)
+	}
+
+	// compacting an empty L0 is a no-op.
+	if err := d.CompactL0(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	opts := &pebble.Options{
+		DisableAutomaticCompactions: true,
+	}
+	opts.EnsureDefaults()
+
+	d, err := NewDatastore(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	// overlapping versions of the same keys, one L0 file per flush, for both
+	// the range to compact and one to leave alone.
+	for _, prefix := range []string{"/hot", "/other"} {
+		for i := 0; i < 5; i++ {
+			for j := 0; j < 10; j++ {
+				if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("%s/%03d", prefix, j)), []byte(fmt.Sprintf("version %d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	l0Files := func(prefix string) int {
+		levels, err := d.SSTableBounds(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(levels[0])
+	}
+	if n := l0Files("/hot"); n != 5 {
+		t.Fatalf("expected 5 overlapping L0 files in the range, got %d", n)
+	}
+
+	if err := d.Compact(ctx, datastore.NewKey("/hot"), datastore.NewKey("/hot/999")); err != nil {
+		t.Fatal(err)
+	}
+	if n := l0Files("/hot"); n != 0 {
+		t.Fatalf("expected the range to be compacted out of L0, got %d files", n)
+	}
+	if n := l0Files("/other"); n != 5 {
+		t.Fatalf("expected the rest of L0 to be left alone, got %d files", n)
+	}
+	if val, err := d.Get(ctx, datastore.NewKey("/hot/000")); err != nil || string(val) != "version 4" {
+		t.Fatalf("expected the latest version, got %q, %v", val, err)
+	}
+
+	// zero keys stand for the ends of the keyspace.
+	if err := d.Compact(ctx, datastore.NewKey("/other"), datastore.Key{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.db.Metrics().Levels[0].NumFiles; n != 0 {
+		t.Fatalf("expected L0 to be empty, got %d files", n)
+	}
+	if err := d.Compact(ctx, datastore.Key{}, datastore.Key{}); err != nil {
+		t.Fatal(err)
+	}
+	// an open range starting past the last key is empty, not reversed.
+	if err := d.Compact(ctx, datastore.NewKey("/zzz"), datastore.Key{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(ctx, datastore.NewKey("/b"), datastore.NewKey("/a")); err == nil {
+		t.Fatal("expected an error for a reversed range")
+	}
+	// a single key is a valid range.
+	if err := d.Compact(ctx, datastore.NewKey("/hot/000"), datastore.NewKey("/hot/000")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(ctx, datastore.Key{}, datastore.Key{}); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCompactL0Closed(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	cleanup()
+
+	if err := d.CompactL0(context.Background()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestManualCompaction(t *testing.T) {
+	load := func(t *testing.T, options ...Option) *Datastore {
+		opts := &pebble.Options{
+			MemTableSize:          1 << 16,
+			L0CompactionThreshold: 2,
+			L0StopWritesThreshold: 1000,
+		}
+		opts.EnsureDefaults()
+		d, err := NewDatastoreWithOptions(t.TempDir(), opts, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = d.Close() })
+
+		ctx := context.Background()
+		val := make([]byte, 512)
+		for i := 0; i < 2000; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/load/%05d", i)), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	auto := load(t)
+	manual := load(t, WithManualCompaction(true))
+
+	if !manual.opts.DisableAutomaticCompactions {
+		t.Fatal("expected automatic compactions to be disabled")
+	}
+	autoCount := auto.db.Metrics().Compact.Count
+	m := manual.db.Metrics()
+	if m.Compact.Count >= autoCount {
+		t.Fatalf("expected fewer compactions while loading, got %d vs %d", m.Compact.Count, autoCount)
+	}
+	if m.Levels[0].NumFiles < 2 {
+		t.Fatalf("expected files to pile up in L0, got %d", m.Levels[0].NumFiles)
+	}
+
+	ctx := context.Background()
+	if err := manual.CompactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m = manual.db.Metrics()
+	if m.Levels[0].NumFiles != 0 {
+		t.Fatalf("expected L0 to be empty after compacting, got %d files", m.Levels[0].NumFiles)
+	}
+	if ra := m.ReadAmp(); ra > 1 {
+		t.Fatalf("expected a single sorted run after compacting, got read amplification %d", ra)
+	}
+	if _, err := manual.Get(ctx, datastore.NewKey("/load/01000")); err != nil {
+		t.Fatal(err)
+	}
+
+	// compacting an empty store is a no-op.
+	empty, cleanup := newDatastore(t)
+	defer cleanup()
+	if err := empty.CompactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionDebt(t *testing.T) {
+	opts := &pebble.Options{
+		MemTableSize:          1 << 16,
+		L0CompactionThreshold: 2,
+		L0StopWritesThreshold: 1000,
+	}
+	opts.EnsureDefaults()
+	d, err := NewDatastoreWithOptions(t.TempDir(), opts, WithManualCompaction(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	load := func() {
+		val := make([]byte, 512)
+		for i := 0; i < 2000; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/load/%05d", i)), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// compacting L0 only costs anything once there is data below it to merge
+	// with.
+	load()
+	if err := d.CompactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	load()
+
+	debt, err := d.CompactionDebt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if debt == 0 {
+		t.Fatal("expected compaction debt to build up")
+	}
+
+	if err := d.CompactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	after, err := d.CompactionDebt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= debt {
+		t.Fatalf("expected compaction debt to drop after compacting, got %d, was %d", after, debt)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CompactionDebt(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	opts := &pebble.Options{
+		DisableAutomaticCompactions: true,
+	}
+	opts.EnsureDefaults()
+
+	d, err := NewDatastore(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	value := make([]byte, 1024)
+	for i := 0; i < 5000; i++ {
+		// incompressible values, for the space held to show.
+		_, _ = rand.Read(value)
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/gc/%05d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		if err := d.Delete(ctx, datastore.NewKey(fmt.Sprintf("/gc/%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gc datastore.GCDatastore = d
+	if err := gc.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReclaimObsoleteFiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+	after, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after > before/2 {
+		t.Fatalf("expected disk usage to drop meaningfully, got %d, was %d", after, before)
+	}
+	if n, err := d.GetSize(ctx, datastore.NewKey("/gc/00010")); err != nil || n != len(value) {
+		t.Fatalf("expected kept keys to survive, got %d, %v", n, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := d.CollectGarbage(canceled); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CollectGarbage(ctx); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRebuildFilters(t *testing.T) {
+	path := t.TempDir()
+	d, err := NewDatastoreWithOptions(path, nil, WithBloomFilters(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/filter/%04d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// settle the data in the bottommost level, which compactions alone do not
+	// rewrite.
+	if err := d.CompactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDatastoreWithOptions(path, nil, WithBloomFilters(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// filterHits counts the lookups of missing keys that filters answered.
+	// Gets do not consult the filters of the bottommost level, where the
+	// data is, so this looks up the keys with prefix seeks that do.
+	filterHits := func() int64 {
+		t.Helper()
+		before := d.db.Metrics().Filter.Hits
+		iter, err := d.db.NewIter(&pebble.IterOptions{UseL6Filters: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		for i := 0; i < 1000; i++ {
+			if iter.SeekPrefixGE([]byte(fmt.Sprintf("/filter/%04d/missing", i))) {
+				t.Fatalf("found missing key %s", iter.Key())
+			}
+		}
+		return d.db.Metrics().Filter.Hits - before
+	}
+	if hits := filterHits(); hits != 0 {
+		t.Fatalf("expected no filters before the rebuild, got %d hits", hits)
+	}
+	if err := d.RebuildFilters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if hits := filterHits(); hits < 900 {
+		t.Fatalf("expected filters to answer most lookups after the rebuild, got %d hits", hits)
+	}
+	if n := len(queryEntries(t, d, query.Query{})); n != 1000 {
+		t.Fatalf("expected the rebuild to keep every entry, got %d", n)
+	}
+}
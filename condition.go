@@ -0,0 +1,128 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrConditionFailed is returned when committing a ConditionalBatch whose
+// guard key does not hold the expected value.
+var ErrConditionFailed = errors.New("pebble datastore batch condition failed")
+
+// ConditionalBatch is a Batch that only commits if a guard key holds an
+// expected value at commit time, which allows optimistic read-modify-write
+// cycles spanning many keys: read the guard, prepare the writes, and commit
+// them on the condition that the guard did not change meanwhile, typically
+// bumping it within the batch.
+type ConditionalBatch struct {
+	*Batch
+
+	guard    ds.Key
+	expected []byte
+}
+
+// BatchWithCondition returns a batch that commits only if the guard key holds
+// the expected value, or is missing if expected is nil. Otherwise, Commit
+// fails with ErrConditionFailed and nothing is written.
+//
+// Conditional commits are serialized with each other and with Put, Delete,
+// SingleDelete, PutWithMeta and the commits of plain batches, so the check
+// and the write are atomic with respect to them: these wait while a
+// conditional batch commits. Other writes, such as DeleteRange,
+// ReplacePrefix or those of LRUDatastore, are not serialized: the guard key
+// must not be written through them for the condition to be reliable.
+func (d *Datastore) BatchWithCondition(ctx context.Context, guard ds.Key, expected []byte) (*ConditionalBatch, error) {
+	b, err := d.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ConditionalBatch{
+		Batch:    b.(*Batch),
+		guard:    guard,
+		expected: expected,
+	}, nil
+}
+
+func (b *ConditionalBatch) Commit(ctx context.Context) error {
+	b.ds.condMu.Lock()
+	err := b.commit(ctx)
+	b.ds.condMu.Unlock()
+	if err != nil {
+		return err
+	}
+	b.runHooks()
+	return nil
+}
+
+// commit checks the guard, then writes the batch. The caller must hold
+// b.ds.condMu for writing.
+func (b *ConditionalBatch) commit(ctx context.Context) error {
+	current, err := b.ds.get(b.guard.Bytes())
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		if b.expected != nil {
+			return fmt.Errorf("%w: %s is missing", ErrConditionFailed, b.guard)
+		}
+	case err != nil:
+		return fmt.Errorf("pebble error reading batch guard: %w", err)
+	case b.expected == nil || !bytes.Equal(current, b.expected):
+		return fmt.Errorf("%w: %s changed", ErrConditionFailed, b.guard)
+	}
+	return b.Batch.commit(ctx)
+}
+
+// ErrSkipUpdate can be returned by the callback of Update to leave the key
+// untouched.
+var ErrSkipUpdate = errors.New("pebble datastore update skipped")
+
+// Update atomically replaces the value of key by the one computed from it by
+// fn, which is called with the current value, or nil if the key is missing.
+// If the key changes between reading it and writing the new value, fn is
+// called again with the fresh value, until the update goes through or ctx is
+// done; fn must therefore be free of side effects. If fn returns
+// ErrSkipUpdate, the key is left untouched and Update returns nil; any other
+// error is returned as is.
+//
+// Updates rely on conditional batches (see BatchWithCondition), so concurrent
+// updates of a key never lose each other's writes, as long as the key is
+// only written through writes serialized with them.
+func (d *Datastore) Update(ctx context.Context, key ds.Key, fn func(old []byte) ([]byte, error)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		old, err := d.get(key.Bytes())
+		switch {
+		case errors.Is(err, ds.ErrNotFound):
+			old = nil
+		case err != nil:
+			return err
+		}
+
+		value, err := fn(old)
+		if errors.Is(err, ErrSkipUpdate) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		b, err := d.BatchWithCondition(ctx, key, old)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(ctx, key, value); err != nil {
+			return err
+		}
+		err = b.Commit(ctx)
+		if !errors.Is(err, ErrConditionFailed) {
+			return err
+		}
+		// lost the race with another update; try again.
+	}
+}
@@ -0,0 +1,254 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestBatchWithCondition(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	guard := datastore.NewKey("/guard")
+
+	b, err := d.BatchWithCondition(ctx, guard, []byte("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, datastore.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("expected ErrConditionFailed for a missing guard, got %v", err)
+	}
+	if has, _ := d.Has(ctx, datastore.NewKey("/a")); has {
+		t.Fatal("failed batch must not be applied")
+	}
+
+	b, err = d.BatchWithCondition(ctx, guard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, guard, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchWithConditionContention(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	guard := datastore.NewKey("/guard")
+	if err := d.Put(ctx, guard, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		committed atomic.Int64
+	)
+	for w := 0; w < 8; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				cur, err := d.Get(ctx, guard)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				version, _ := strconv.Atoi(string(cur))
+
+				b, err := d.BatchWithCondition(ctx, guard, cur)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				next := []byte(strconv.Itoa(version + 1))
+				if err := b.Put(ctx, guard, next); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := b.Put(ctx, datastore.NewKey(fmt.Sprintf("/versions/%s", next)), []byte(strconv.Itoa(w))); err != nil {
+					t.Error(err)
+					return
+				}
+				switch err := b.Commit(ctx); {
+				case err == nil:
+					committed.Add(1)
+				case !errors.Is(err, ErrConditionFailed):
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cur, err := d.Get(ctx, guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every version was committed by exactly one writer.
+	if version, _ := strconv.Atoi(string(cur)); int64(version) != committed.Load() {
+		t.Fatalf("expected version %d, got %d", committed.Load(), version)
+	}
+	for v := 1; v <= int(committed.Load()); v++ {
+		if has, _ := d.Has(ctx, datastore.NewKey(fmt.Sprintf("/versions/%d", v))); !has {
+			t.Fatalf("missing version %d", v)
+		}
+	}
+}
+
+func TestBatchWithConditionPlainWrites(t *testing.T) {
+	d, cleanup := newDatastore(t, WithMetadata(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	guard := datastore.NewKey("/guard")
+	if err := d.Put(ctx, guard, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// plain writes wait while a conditional batch commits.
+	writes := map[string]func() error{
+		"put":           func() error { return d.Put(ctx, guard, []byte("put")) },
+		"delete":        func() error { return d.Delete(ctx, guard) },
+		"single delete": func() error { return d.SingleDelete(ctx, datastore.NewKey("/once")) },
+		"put with meta": func() error { return d.PutWithMeta(ctx, guard, []byte("meta"), []byte("m")) },
+		"batch": func() error {
+			b, err := d.Batch(ctx)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(ctx, guard, []byte("batch")); err != nil {
+				return err
+			}
+			return b.Commit(ctx)
+		},
+	}
+	done := make(chan string, len(writes))
+	d.condMu.Lock()
+	for name, write := range writes {
+		name, write := name, write
+		go func() {
+			if err := write(); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			done <- name
+		}()
+	}
+	select {
+	case name := <-done:
+		d.condMu.Unlock()
+		t.Fatalf("%s went through during a conditional commit", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.condMu.Unlock()
+	for range writes {
+		<-done
+	}
+
+	// commit hooks run once the commit is over, and may write.
+	b, err := d.BatchWithCondition(ctx, datastore.NewKey("/other"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, datastore.NewKey("/other"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	b.OnCommit(func(puts, deletes []datastore.Key) {
+		if err := d.Put(ctx, guard, []byte("hook")); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(ctx, guard); err != nil || string(val) != "hook" {
+		t.Fatalf("expected the hook to write the guard, got %q, %v", val, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	counter := datastore.NewKey("/counter")
+	increment := func(old []byte) ([]byte, error) {
+		n := 0
+		if old != nil {
+			var err error
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+
+	const workers, updates = 16, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				if err := d.Update(ctx, counter, increment); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cur, err := d.Get(ctx, counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cur) != strconv.Itoa(workers*updates) {
+		t.Fatalf("expected %d updates, got %s", workers*updates, cur)
+	}
+
+	// skipped updates leave the key untouched.
+	err = d.Update(ctx, counter, func(old []byte) ([]byte, error) {
+		return nil, ErrSkipUpdate
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := d.Get(ctx, counter); string(again) != string(cur) {
+		t.Fatalf("expected a skipped update to leave %s, got %s", cur, again)
+	}
+
+	// errors of the callback are returned, and nothing is written.
+	errBoom := errors.New("boom")
+	missing := datastore.NewKey("/missing")
+	err = d.Update(ctx, missing, func(old []byte) ([]byte, error) {
+		if old != nil {
+			t.Errorf("expected a missing key to be passed as nil, got %q", old)
+		}
+		return nil, errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+	if has, _ := d.Has(ctx, missing); has {
+		t.Fatal("expected a failed update not to write the key")
+	}
+}
@@ -0,0 +1,67 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// ReadConsistency selects which writes a read sees, for GetWithConsistency and
+// QueryWithConsistency.
+type ReadConsistency int
+
+const (
+	// ReadLatest sees every write acknowledged so far, like Get and Query.
+	ReadLatest ReadConsistency = iota
+	// ReadDurable only sees writes that survive a crash.
+	//
+	// Pebble cannot tell the writes that were synced to the WAL apart from
+	// the others still in the memtables, so it is served like ReadFlushed: it
+	// never sees a write that a crash could lose, but misses synced writes
+	// until their memtable is flushed.
+	ReadDurable
+	// ReadFlushed only sees writes that have been flushed to sstables, like
+	// GetPersisted and QueryPersisted.
+	ReadFlushed
+)
+
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadLatest:
+		return "latest"
+	case ReadDurable:
+		return "durable"
+	case ReadFlushed:
+		return "flushed"
+	default:
+		return fmt.Sprintf("ReadConsistency(%d)", int(c))
+	}
+}
+
+// GetWithConsistency is like Get, but only sees the writes selected by the
+// given consistency level.
+func (d *Datastore) GetWithConsistency(ctx context.Context, key ds.Key, consistency ReadConsistency) ([]byte, error) {
+	switch consistency {
+	case ReadLatest:
+		return d.Get(ctx, key)
+	case ReadDurable, ReadFlushed:
+		return d.GetPersisted(ctx, key)
+	default:
+		return nil, fmt.Errorf("unknown read consistency: %s", consistency)
+	}
+}
+
+// QueryWithConsistency is like Query, but only sees the writes selected by
+// the given consistency level.
+func (d *Datastore) QueryWithConsistency(ctx context.Context, q query.Query, consistency ReadConsistency) (query.Results, error) {
+	switch consistency {
+	case ReadLatest:
+		return d.Query(ctx, q)
+	case ReadDurable, ReadFlushed:
+		return d.QueryPersisted(ctx, q)
+	default:
+		return nil, fmt.Errorf("unknown read consistency: %s", consistency)
+	}
+}
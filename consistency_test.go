@@ -0,0 +1,72 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestReadConsistency(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := datastore.NewKey("/consistency/a")
+
+	visible := func(consistency ReadConsistency) bool {
+		t.Helper()
+		res, err := d.QueryWithConsistency(ctx, query.Query{Prefix: "/consistency"}, consistency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.GetWithConsistency(ctx, key, consistency)
+		switch {
+		case err == nil && len(entries) == 1:
+			return true
+		case errors.Is(err, datastore.ErrNotFound) && len(entries) == 0:
+			return false
+		default:
+			t.Fatalf("inconsistent reads at %s: %d entries and %v", consistency, len(entries), err)
+			return false
+		}
+	}
+	expect := func(state string, latest, durable, flushed bool) {
+		t.Helper()
+		for consistency, want := range map[ReadConsistency]bool{
+			ReadLatest:  latest,
+			ReadDurable: durable,
+			ReadFlushed: flushed,
+		} {
+			if got := visible(consistency); got != want {
+				t.Fatalf("%s: expected visibility %t at %s, got %t", state, want, consistency, got)
+			}
+		}
+	}
+
+	if err := d.Put(ctx, key, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	expect("unsynced", true, false, false)
+
+	if err := d.Sync(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	// synced writes are not told apart from unsynced ones.
+	expect("synced", true, false, false)
+
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expect("flushed", true, true, true)
+
+	if _, err := d.GetWithConsistency(ctx, key, ReadConsistency(42)); err == nil {
+		t.Fatal("expected an unknown consistency level to fail")
+	}
+}
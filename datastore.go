@@ -1,13 +1,17 @@
 package pebbleds
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	"github.com/ipfs/go-log/v2"
@@ -16,21 +20,85 @@ import (
 
 var logger = log.Logger("pebble")
 
+// ErrClosed is returned by operations on a Datastore that has been closed.
+var ErrClosed = errors.New("pebble datastore closed")
+
+// ErrCloseTimeout is returned by Close when a stage of the shutdown takes
+// longer than the timeout set with WithCloseStageTimeout.
+var ErrCloseTimeout = errors.New("pebble datastore close timed out")
+
 // Datastore is a pebble-backed github.com/ipfs/go-datastore.Datastore.
 //
 // It supports batching. It does not support TTL or transactions, because pebble
 // doesn't have those features.
 type Datastore struct {
-	db      *pebble.DB
-	status  int32
-	closing chan struct{}
-	wg      sync.WaitGroup
+	db     *pebble.DB
+	status int32
+	// statusMu orders acquire against Close: acquire holds it for reading
+	// while it checks status and registers with wg, and Close holds it for
+	// writing while it flips status, so that no wg.Add can race with the
+	// wg.Wait of the shutdown.
+	statusMu sync.RWMutex
+	closing  chan struct{}
+	// closed is closed once the shutdown is complete.
+	closed chan struct{}
+	wg     sync.WaitGroup
 
 	opts *pebble.Options
+	conf config
+	log  log.StandardLogger
+
+	// committer coalesces batch commits, if enabled.
+	committer *committer
+	// breaker fast-fails reads after repeated errors, if enabled.
+	breaker *circuitBreaker
+	// bounds caches the bounds of query prefixes, if enabled.
+	bounds *boundsCache
+
+	// hotspots samples reads to find the hot keys, if enabled.
+	hotspots *hotspotSampler
+	// amplification samples the amplification metrics, if enabled.
+	amplification *amplificationSampler
+	// appendOnly rejects writes out of key order, if enabled.
+	appendOnly *appendOnlyGuard
+	// named holds the named snapshots.
+	named namedSnapshots
+
+	// slowOps logs slow operations, if enabled.
+	slowOps *slowOpLogger
+	// snapshots serves reads off a periodically refreshed snapshot, if
+	// enabled.
+	snapshots *snapshotCache
+	// condMu serializes the commits of conditional batches, which hold it
+	// for writing, with plain writes, which hold it for reading.
+	condMu sync.RWMutex
+
+	// generation is bumped by every successful mutation.
+	generation uint64
+
+	// indexes are the secondary indexes registered, and indexed is set
+	// once there is one. indexMu serializes indexed writes.
+	indexMu sync.Mutex
+	indexes map[string]IndexFunc
+	indexed int32
+
+	// queries tracks the queries in flight.
+	queries queryRegistry
+
+	// openIters counts the iterators open for queries, and iterSlots bounds
+	// it if a limit is set.
+	openIters int64
+	iterSlots chan struct{}
+
+	// openCheckStats holds the results of the consistency check run on open,
+	// if enabled.
+	openCheckStats pebble.CheckLevelsStats
 }
 
 var _ ds.Datastore = (*Datastore)(nil)
 var _ ds.Batching = (*Datastore)(nil)
+var _ ds.CheckedDatastore = (*Datastore)(nil)
+var _ ds.GCDatastore = (*Datastore)(nil)
 
 var defaultSplit = func(a []byte) int {
 	return len(a)
@@ -46,11 +114,26 @@ var defaultSplit = func(a []byte) int {
 // quickly to Has() and Get() lookups, particularly when keys are not in the
 // datastore.
 func NewDatastore(path string, opts *pebble.Options) (*Datastore, error) {
+	return NewDatastoreWithOptions(path, opts)
+}
+
+// NewDatastoreWithOptions creates a pebble-backed datastore, like
+// NewDatastore, additionally applying the given go-ds-pebble specific
+// options.
+func NewDatastoreWithOptions(path string, opts *pebble.Options, options ...Option) (*Datastore, error) {
+	conf := defaultConfig()
+	for _, o := range options {
+		o(&conf)
+	}
+
 	if opts == nil {
 		opts = &pebble.Options{}
 		opts.EnsureDefaults()
 	}
-	opts.Logger = logger
+	for _, o := range conf.pebbleOpts {
+		o(opts)
+	}
+	opts.Logger = conf.logger
 	// We force a default Split function that enables using bloom filters
 	// on lookups. Normally, our datastore keys are not versioned and
 	// correspond to unique items (cids) rather than MVCC keys.  On the
@@ -58,10 +141,34 @@ func NewDatastore(path string, opts *pebble.Options) (*Datastore, error) {
 	// negative results, and those are currently very expensive and
 	// trigger a fair amount of reads. See
 	// https://github.com/cockroachdb/pebble/issues/2369#issuecomment-1450997680
-	if opts.Comparer.Split != nil {
-		logger.Warn("Comparer Split's function is not nil. To ensure that go-ds-pebble behaves correctly, it will be overwritten. See https://github.com/ipfs/go-ds-pebble/pull/26")
+	//
+	// WithSplit opts out of this, in which case the given function is used
+	// instead. The comparer is copied either way, as it is usually the
+	// shared pebble.DefaultComparer.
+	split := conf.split
+	if split == nil {
+		if opts.Comparer.Split != nil {
+			conf.logger.Warn("Comparer Split's function is not nil. To ensure that go-ds-pebble behaves correctly, it will be overwritten. See https://github.com/ipfs/go-ds-pebble/pull/26")
+		}
+		split = defaultSplit
+	}
+	comparer := *opts.Comparer
+	comparer.Split = split
+	opts.Comparer = &comparer
+
+	if conf.errorIfNotExists {
+		// Pebble creates the directory before finding out there is no
+		// database in it.
+		if _, err := opts.FS.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to open pebble database: %w: dirname=%q", pebble.ErrDBDoesNotExist, path)
+		}
+	}
+
+	if conf.dirMode != 0 && !opts.ReadOnly {
+		if err := opts.FS.MkdirAll(path, conf.dirMode); err != nil {
+			return nil, fmt.Errorf("failed to create pebble directory: %w", err)
+		}
 	}
-	opts.Comparer.Split = defaultSplit
 
 	db, err := pebble.Open(path, opts)
 	if err != nil {
@@ -71,16 +178,151 @@ func NewDatastore(path string, opts *pebble.Options) (*Datastore, error) {
 	store := &Datastore{
 		db:      db,
 		opts:    opts,
+		conf:    conf,
+		log:     conf.logger,
+		named:   namedSnapshots{log: conf.logger},
 		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	if err := store.setup(); err != nil {
+		// release the directory lock and file handles.
+		_ = db.Close()
+		return nil, err
+	}
+
+	if conf.breakerThreshold > 0 {
+		store.breaker = newCircuitBreaker(conf.breakerThreshold, conf.breakerWindow, conf.breakerCooldown, conf.logger)
+	}
+
+	if conf.commitWindow > 0 {
+		store.committer = newCommitter(db, conf.commitWindow, store.writeOptions())
+	}
+
+	if conf.maxIterators > 0 {
+		store.iterSlots = make(chan struct{}, conf.maxIterators)
+	}
+
+	if conf.boundsCacheSize > 0 {
+		store.bounds = newBoundsCache(conf.boundsCacheSize)
+	}
+
+	if conf.hotspotRate > 0 && conf.hotspotKeys > 0 {
+		store.hotspots = newHotspotSampler(conf.hotspotRate, conf.hotspotKeys)
+	}
+
+	if conf.slowOpThreshold > 0 {
+		store.slowOps = newSlowOpLogger(conf.slowOpThreshold, conf.logger)
+	}
+
+	if conf.snapshotInterval > 0 {
+		store.snapshots = newSnapshotCache(db, conf.logger)
+		store.wg.Add(1)
+		go store.snapshotLoop(conf.snapshotInterval)
+	}
+
+	if conf.scrubInterval > 0 && conf.scrubReport != nil {
+		store.wg.Add(1)
+		go store.scrubLoop(conf.scrubInterval)
+	}
+
+	if conf.syncInterval > 0 && !opts.DisableWAL && !opts.ReadOnly {
+		store.wg.Add(1)
+		go store.syncLoop(conf.syncInterval)
+	}
+
+	if conf.ampInterval > 0 && conf.ampSamples > 0 {
+		store.amplification = newAmplificationSampler(conf.ampSamples)
+		store.wg.Add(1)
+		go store.amplificationLoop(conf.ampInterval)
 	}
 
 	return store, nil
 }
 
+// memoryPath is the path NewMemoryDatastore opens the database at, within
+// its in-memory filesystem.
+const memoryPath = "/pebble"
+
+// NewMemoryDatastore creates a datastore held entirely in memory, through
+// Pebble's in-memory filesystem (vfs.NewMem), which is lost once closed. It
+// behaves like the datastores of NewDatastoreWithOptions otherwise, which
+// makes it handy for tests. The opts are handled as in NewDatastore, except
+// for their FS, which is replaced.
+func NewMemoryDatastore(opts *pebble.Options, options ...Option) (*Datastore, error) {
+	if opts == nil {
+		opts = &pebble.Options{}
+		opts.EnsureDefaults()
+	}
+	opts.FS = vfs.NewMem()
+	return NewDatastoreWithOptions(memoryPath, opts, options...)
+}
+
+// setup runs the steps that must succeed after opening the database for the
+// datastore to be usable. The caller must close the database if it fails.
+func (d *Datastore) setup() error {
+	if d.conf.consistencyCheckOnOpen {
+		if err := d.db.CheckLevels(&d.openCheckStats); err != nil {
+			return fmt.Errorf("pebble consistency check failed on open: %w", err)
+		}
+		d.log.Infof("pebble consistency check passed: %d points, %d tombstones",
+			d.openCheckStats.NumPoints, d.openCheckStats.NumTombstones)
+	}
+	if d.conf.appendOnly {
+		if err := d.recoverAppendOnly(); err != nil {
+			return err
+		}
+	}
+	for _, step := range d.conf.setupSteps {
+		if err := step(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOptions returns the options of the writes issued by the datastore,
+// which wait for the WAL to be synced if WithSync is enabled.
+func (d *Datastore) writeOptions() *pebble.WriteOptions {
+	if d.conf.sync {
+		return pebble.Sync
+	}
+	return pebble.NoSync
+}
+
 // get performs a get on the database, If the key doesn't exist,
 // ds.ErrNotFound will be returned.
 func (d *Datastore) get(key []byte) ([]byte, error) {
-	val, closer, err := d.db.Get(key)
+	return d.getFrom(d.db, key)
+}
+
+// lookup is like get, but reads from the snapshot cache if enabled. It serves
+// Get, Has and GetSize, while reads that must see the latest writes, such as
+// those of read-modify-write operations, use get.
+func (d *Datastore) lookup(key []byte) ([]byte, error) {
+	if d.snapshots == nil {
+		return d.get(key)
+	}
+	d.snapshots.mu.RLock()
+	defer d.snapshots.mu.RUnlock()
+	return d.getFrom(d.snapshots.snap, key)
+}
+
+func (d *Datastore) getFrom(r pebble.Reader, key []byte) ([]byte, error) {
+	if d.breaker == nil {
+		return d.read(r, key)
+	}
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	val, err := d.read(r, key)
+	d.breaker.record(probe, err)
+	return val, err
+}
+
+func (d *Datastore) read(r pebble.Reader, key []byte) ([]byte, error) {
+	val, closer, err := r.Get(key)
 	if err != nil {
 		if errors.Is(err, pebble.ErrNotFound) {
 			return nil, ds.ErrNotFound
@@ -89,12 +331,26 @@ func (d *Datastore) get(key []byte) ([]byte, error) {
 	}
 	cp := make([]byte, len(val)) // TODO(@Wondertan): reuse buffers
 	copy(cp, val)
-	return cp, closer.Close()
+	if err := closer.Close(); err != nil {
+		return nil, err
+	}
+	return d.decodeValue(key, cp)
 }
 
-// Get reads a key from the datastore.
-func (d *Datastore) Get(_ context.Context, key ds.Key) (value []byte, err error) {
-	return d.get(key.Bytes())
+// Get reads a key from the datastore. A key stored with an empty (or nil)
+// value is returned as a non-nil empty slice, which tells it apart from a
+// missing key, that fails with ds.ErrNotFound.
+func (d *Datastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.slowOps != nil {
+		defer d.slowOps.observe("get", key.String(), time.Now())
+	}
+	if d.hotspots != nil {
+		d.hotspots.observe(key.String())
+	}
+	return d.lookup(key.Bytes())
 }
 
 // Has can be used to check whether a key is stored in the datastore. Has()
@@ -102,8 +358,17 @@ func (d *Datastore) Get(_ context.Context, key ds.Key) (value []byte, err error)
 // keys will also read the values. Avoid using Has() if you later expect to
 // read the key anyways. Has() calls for non-existing keys should take
 // advantage of bloom filters and avoid reads.
-func (d *Datastore) Has(_ context.Context, key ds.Key) (exists bool, _ error) {
-	_, err := d.get(key.Bytes())
+func (d *Datastore) Has(ctx context.Context, key ds.Key) (exists bool, _ error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if d.slowOps != nil {
+		defer d.slowOps.observe("has", key.String(), time.Now())
+	}
+	if d.hotspots != nil {
+		d.hotspots.observe(key.String())
+	}
+	_, err := d.lookup(key.Bytes())
 	switch {
 	case errors.Is(err, ds.ErrNotFound):
 		return false, nil
@@ -114,8 +379,14 @@ func (d *Datastore) Has(_ context.Context, key ds.Key) (exists bool, _ error) {
 	}
 }
 
-func (d *Datastore) GetSize(_ context.Context, key ds.Key) (int, error) {
-	val, err := d.get(key.Bytes())
+func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	if d.slowOps != nil {
+		defer d.slowOps.observe("get size", key.String(), time.Now())
+	}
+	val, err := d.lookup(key.Bytes())
 	if err != nil {
 		return -1, err
 	}
@@ -123,8 +394,40 @@ func (d *Datastore) GetSize(_ context.Context, key ds.Key) (int, error) {
 }
 
 func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	if d.slowOps != nil {
+		defer d.slowOps.observe("query", "prefix "+q.Prefix, time.Now())
+	}
+	opts, ok := d.queryIterOptions(q)
+	if !ok {
+		// no key can possibly match.
+		return query.ResultsWithEntries(q, []query.Entry{}), nil
+	}
+	res, err := d.query(ctx, d.queryReader(), q, opts)
+	if err != nil || d.conf.prefetch <= 0 {
+		return res, err
+	}
+	return prefetchResults(q, res, d.conf.prefetch), nil
+}
+
+// iterReader creates the iterators backing queries. It is satisfied by both
+// the database and the snapshot cache.
+type iterReader interface {
+	NewIterWithContext(ctx context.Context, o *pebble.IterOptions) (*pebble.Iterator, error)
+}
+
+// queryReader returns the iterReader that queries read from: the snapshot
+// cache if enabled, and the database otherwise.
+func (d *Datastore) queryReader() iterReader {
+	if d.snapshots != nil {
+		return d.snapshots
+	}
+	return d.db
+}
+
+// query runs q over the keys visible to an iterator of r with the given
+// options, ignoring q.Prefix.
+func (d *Datastore) query(ctx context.Context, r iterReader, q query.Query, opts pebble.IterOptions) (query.Results, error) {
 	var (
-		prefix      = ds.NewKey(q.Prefix).String()
 		limit       = q.Limit
 		offset      = q.Offset
 		orders      = q.Orders
@@ -134,39 +437,13 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 		returnSizes = q.ReturnsSizes
 	)
 
-	if prefix != "/" {
-		prefix = prefix + "/"
-	}
-
-	opts := &pebble.IterOptions{
-		LowerBound: []byte(prefix),
-		UpperBound: func() []byte {
-			// if the prefix is 0x01..., we want 0x02 as an upper bound.
-			// if the prefix is 0x0000ff..., we want 0x0001 as an upper bound.
-			// if the prefix is 0x0000ff01..., we want 0x0000ff02 as an upper bound.
-			// if the prefix is 0xffffff..., we don't want an upper bound.
-			// if the prefix is 0xff..., we don't want an upper bound.
-			// if the prefix is empty, we don't want an upper bound.
-			// basically, we want to find the last byte that can be lexicographically incremented.
-			var upper []byte
-			for i := len(prefix) - 1; i >= 0; i-- {
-				b := prefix[i]
-				if b == 0xff {
-					continue
-				}
-				upper = make([]byte, i+1)
-				copy(upper, prefix)
-				upper[i] = b + 1
-				break
-			}
-			return upper
-		}(),
-	}
-
-	iter, err := d.db.NewIterWithContext(ctx, opts)
+	iter, probe, err := d.newQueryIter(ctx, r, &opts)
 	if err != nil {
 		return nil, err
 	}
+	closeIter := func() {
+		d.releaseQueryIter(probe, iter.Close())
+	}
 
 	var move func() bool
 	switch l := len(orders); l {
@@ -182,10 +459,12 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 			iter.Last()
 			move = iter.Prev
 		default:
-			defer iter.Close()
-			return d.inefficientOrderQuery(ctx, q, nil)
+			// release the iterator first, as the base query opens its own.
+			closeIter()
+			return d.inefficientOrderQuery(ctx, r, q, nil, opts)
 		}
 	default:
+		closeIter()
 		var baseOrder query.Order
 		for _, o := range orders {
 			if baseOrder != nil {
@@ -196,12 +475,18 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 				baseOrder = o
 			}
 		}
-		defer iter.Close()
-		return d.inefficientOrderQuery(ctx, q, baseOrder)
+		return d.inefficientOrderQuery(ctx, r, q, baseOrder, opts)
+	}
+
+	if probe {
+		// settle the probe as soon as the iterator is positioned, so that a
+		// slow consumer of the results does not keep the breaker open.
+		d.breaker.record(true, iter.Error())
+		probe = false
 	}
 
 	if !iter.Valid() {
-		_ = iter.Close()
+		closeIter()
 		// there are no valid results.
 		return query.ResultsWithEntries(q, []query.Entry{}), nil
 	}
@@ -219,37 +504,53 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 	if len(filters) > 0 {
 		doFilter = true
 	}
+	failOnEntryErrors := d.conf.entryErrorMode == FailOnEntryErrors
 
 	createEntry := func() (query.Entry, error) {
 		// iter.Key and iter.Value may change on the next call to iter.Next.
 		// string conversion takes a copy
 		entry := query.Entry{Key: string(iter.Key())}
-		if !keysOnly {
-			// take a copy.
-			val, err := iter.ValueAndErr()
-			if err != nil {
-				return query.Entry{}, err
+		if keysOnly {
+			// the value is neither fetched, copied nor decoded: its length
+			// is known without it.
+			if returnSizes {
+				lv := iter.LazyValue()
+				entry.Size = d.valueLen(lv.Len())
 			}
+			return entry, nil
+		}
 
-			cpy := make([]byte, len(val))
-			copy(cpy, val)
-			entry.Value = cpy
+		val, err := iter.ValueAndErr()
+		if err != nil {
+			return query.Entry{}, err
 		}
 		if returnSizes {
-			val, err := iter.ValueAndErr()
-			if err != nil {
-				return query.Entry{}, err
-			}
+			entry.Size = d.valueLen(len(val))
+		}
 
-			entry.Size = len(val)
+		val, err = d.decodeValue(iter.Key(), val)
+		if err != nil {
+			return query.Entry{}, err
 		}
+
+		// take a copy.
+		cpy := make([]byte, len(val))
+		copy(cpy, val)
+		entry.Value = cpy
 		return entry, nil
 	}
 
-	d.wg.Add(1)
+	if err := d.acquire(); err != nil {
+		closeIter()
+		return nil, err
+	}
+	ctx, cancel := d.operationContext(ctx)
+	ctx, id := d.queries.register(ctx, q)
 	results := query.ResultsWithProcess(q, func(proc goprocess.Process, outCh chan<- query.Result) {
 		defer d.wg.Done()
-		defer iter.Close()
+		defer closeIter()
+		defer cancel()
+		defer d.queries.deregister(id)
 
 		const interrupted = "interrupted"
 
@@ -269,6 +570,14 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 			case <-d.closing:
 			case <-proc.Closed():
 			case <-proc.Closing(): // client told us to close early
+			case <-ctx.Done():
+				// the client must learn that the results are cut short.
+				select {
+				case outCh <- query.Result{Error: ctx.Err()}:
+				case <-d.closing:
+				case <-proc.Closing():
+				}
+				panic(interrupted)
 			}
 
 			// we are closing; try to send a closure error to the client.
@@ -281,13 +590,19 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 		}
 
 		// skip over 'offset' entries; if a filter is provided, only entries
-		// that match the filter will be counted as a skipped entry.
+		// that match the filter will be counted as a skipped entry. Entries
+		// that fail to be read are not counted either.
 		for skipped := 0; skipped < offset && iter.Valid(); move() {
-			if err := iter.Error(); err != nil {
+			if err := ctx.Err(); err != nil {
 				sendOrInterrupt(query.Result{Error: err})
+				return
 			}
 			e, err := createEntry()
 			if err != nil {
+				sendOrInterrupt(query.Result{Error: err})
+				if failOnEntryErrors {
+					return
+				}
 				continue
 			}
 			if doFilter && !filterFn(e) {
@@ -297,14 +612,25 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 			}
 			skipped++
 		}
+		// a failed iterator is no longer valid, which ends the loops; it must
+		// not be read from any further.
+		if err := iter.Error(); err != nil {
+			sendOrInterrupt(query.Result{Error: fmt.Errorf("pebble error during query: %w", err)})
+			return
+		}
 
 		// start sending results, capped at limit (if > 0)
 		for sent := 0; (limit <= 0 || sent < limit) && iter.Valid(); move() {
-			if err := iter.Error(); err != nil {
+			if err := ctx.Err(); err != nil {
 				sendOrInterrupt(query.Result{Error: err})
+				return
 			}
 			entry, err := createEntry()
 			if err != nil {
+				sendOrInterrupt(query.Result{Error: err})
+				if failOnEntryErrors {
+					return
+				}
 				continue
 			}
 			if doFilter && !filterFn(entry) {
@@ -314,16 +640,102 @@ func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, er
 			}
 			sendOrInterrupt(query.Result{Entry: entry})
 			sent++
+			if sent == limit {
+				// we are done; release the iterator right away instead of
+				// advancing it once more.
+				return
+			}
+		}
+		if err := iter.Error(); err != nil {
+			sendOrInterrupt(query.Result{Error: fmt.Errorf("pebble error during query: %w", err)})
 		}
 	})
 	return results, nil
 }
 
+// queryPrefix returns the byte prefix that keys must match for the given
+// query prefix, according to the configured PrefixMode.
+func (d *Datastore) queryPrefix(prefix string) string {
+	if d.conf.prefixMode == RawPrefix {
+		return prefix
+	}
+	prefix = ds.NewKey(prefix).String()
+	if prefix != "/" {
+		prefix = prefix + "/"
+	}
+	return prefix
+}
+
+// queryBounds returns the iterator bounds for the given query: the bounds of
+// its prefix, narrowed down by the literal prefixes of any KeyRegexFilter. It
+// returns false if no key can match the query.
+func (d *Datastore) queryBounds(q query.Query) (lower, upper []byte, ok bool) {
+	lower, upper = d.prefixBounds(q.Prefix)
+	for _, f := range q.Filters {
+		rf, isRegex := f.(*KeyRegexFilter)
+		if !isRegex || rf.prefix == "" {
+			continue
+		}
+		p := []byte(rf.prefix)
+		if bytes.Compare(p, lower) > 0 {
+			lower = p
+		}
+		if pu := prefixUpperBound(p); pu != nil && (upper == nil || bytes.Compare(pu, upper) < 0) {
+			upper = pu
+		}
+	}
+	if upper != nil && bytes.Compare(lower, upper) >= 0 {
+		return nil, nil, false
+	}
+	return lower, upper, true
+}
+
+// queryIterOptions returns the options of the iterator backing the given
+// query: its bounds, leaving out the reserved prefix. It returns false if no
+// key can match the query.
+func (d *Datastore) queryIterOptions(q query.Query) (pebble.IterOptions, bool) {
+	lower, upper, ok := d.queryBounds(q)
+	if !ok {
+		return pebble.IterOptions{}, false
+	}
+	return d.userIterOptions(lower, upper)
+}
+
 func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
-	err := d.db.Set(key.Bytes(), value, pebble.NoSync)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.slowOps != nil {
+		defer d.slowOps.observe("put", key.String(), time.Now())
+	}
+	if err := d.checkKeySize(key.Bytes()); err != nil {
+		return err
+	}
+	if err := d.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	d.condMu.RLock()
+	defer d.condMu.RUnlock()
+	if d.appendOnly != nil {
+		d.appendOnly.mu.Lock()
+		defer d.appendOnly.mu.Unlock()
+		if err := d.appendOnly.check(key.Bytes()); err != nil {
+			return err
+		}
+	}
+	var err error
+	if d.batchedWrites() {
+		err = d.writeBatched(key, indexOp{key: key, value: value}, false)
+	} else {
+		err = d.db.Set(key.Bytes(), d.encodeValue(value), d.writeOptions())
+	}
 	if err != nil {
 		return fmt.Errorf("pebble error during set: %w", err)
 	}
+	if d.appendOnly != nil {
+		d.appendOnly.advance(key.Bytes())
+	}
+	d.bumpGeneration()
 	return nil
 }
 
@@ -332,15 +744,68 @@ func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
 func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
 	m := d.db.Metrics()
 	// since we requested metrics, print them up on debug
-	logger.Debugf("\n\n%s\n\n", m)
+	d.log.Debugf("\n\n%s\n\n", m)
 	return m.DiskSpaceUsage(), nil
 }
 
 func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
-	err := d.db.Delete(key.Bytes(), pebble.NoSync)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.slowOps != nil {
+		defer d.slowOps.observe("delete", key.String(), time.Now())
+	}
+	if err := d.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	d.condMu.RLock()
+	defer d.condMu.RUnlock()
+	var err error
+	if d.batchedWrites() {
+		err = d.writeBatched(key, indexOp{key: key, delete: true}, false)
+	} else {
+		err = d.db.Delete(key.Bytes(), d.writeOptions())
+	}
 	if err != nil {
 		return fmt.Errorf("pebble error during delete: %w", err)
 	}
+	d.bumpGeneration()
+	return nil
+}
+
+// SingleDelete deletes a key that was put exactly once since it was last
+// deleted, or since it was created. Unlike the tombstone of a Delete, which
+// lingers until compacted down to the last level, a single delete and the put
+// it deletes are both dropped as soon as a compaction meets them, reducing
+// tombstone accumulation for workloads with immutable keys, such as
+// content-addressed stores.
+//
+// WARNING: the behaviour is undefined if the key was put more than once, or
+// overwritten, since it was last deleted: older values may reappear, or be
+// deleted only partially. Pebble does not detect the misuse. Use Delete unless
+// keys are known to be written exactly once.
+func (d *Datastore) SingleDelete(ctx context.Context, key ds.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.slowOps != nil {
+		defer d.slowOps.observe("single delete", key.String(), time.Now())
+	}
+	if err := d.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	d.condMu.RLock()
+	defer d.condMu.RUnlock()
+	var err error
+	if d.batchedWrites() {
+		err = d.writeBatched(key, indexOp{key: key, delete: true}, true)
+	} else {
+		err = d.db.SingleDelete(key.Bytes(), d.writeOptions())
+	}
+	if err != nil {
+		return fmt.Errorf("pebble error during single delete: %w", err)
+	}
+	d.bumpGeneration()
 	return nil
 }
 
@@ -351,7 +816,7 @@ func (d *Datastore) Sync(ctx context.Context, _ ds.Key) error {
 	// crash. In pebble this is done by fsyncing the WAL, which can be requested when
 	// performing write operations. But there is no separate operation to fsync
 	// only. The closest is LogData, which actually writes a log entry on the WAL.
-	if d.opts.DisableWAL { // otherwise this errors
+	if d.opts.DisableWAL || d.opts.ReadOnly { // otherwise this errors
 		return nil
 	}
 	err := d.db.LogData(nil, pebble.Sync)
@@ -361,23 +826,150 @@ func (d *Datastore) Sync(ctx context.Context, _ ds.Key) error {
 	return nil
 }
 
+// RotateWAL closes the current WAL and switches writes over to a new one.
+// Pebble only rotates the WAL along with the memtable, so this flushes the
+// memtable to an sstable as well, and returns once the flush is complete. The
+// previous WAL is no longer needed for recovery afterwards, and Pebble may
+// delete it or recycle it for a later WAL; tools that need to copy it must
+// hold on to it on their own, e.g. through pebble.Options.EventListener.
+//
+// It is a no-op when the WAL is disabled.
+func (d *Datastore) RotateWAL() error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if d.opts.DisableWAL {
+		return nil
+	}
+	if err := d.db.Flush(); err != nil {
+		return fmt.Errorf("pebble error during WAL rotation: %w", err)
+	}
+	return nil
+}
+
+// syncLoop syncs the WAL every interval until the datastore is closed.
+func (d *Datastore) syncLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.db.LogData(nil, pebble.Sync); err != nil {
+				d.log.Errorf("pebble error during periodic sync: %s", err)
+			}
+		case <-d.closing:
+			return
+		}
+	}
+}
+
 func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
-	return &Batch{d.db.NewBatch()}, nil
+	return &Batch{ds: d, batch: d.db.NewBatch()}, nil
+}
+
+// acquire registers the start of an operation that must not run concurrently
+// with Close. It returns ErrClosed if the datastore is closed or closing.
+// Otherwise, the caller must call d.wg.Done once the operation is over.
+func (d *Datastore) acquire() error {
+	d.statusMu.RLock()
+	defer d.statusMu.RUnlock()
+	if atomic.LoadInt32(&d.status) != 0 {
+		return ErrClosed
+	}
+	d.wg.Add(1)
+	return nil
+}
+
+// operationContext derives the context of an operation from ctx, applying the
+// timeout set with WithDefaultOperationTimeout if ctx has no deadline. The
+// returned cancel function must be called once the operation is over.
+func (d *Datastore) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.conf.operationTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d.conf.operationTimeout)
 }
 
+// Close shuts the datastore down in stages: it stops accepting new work and
+// signals background tasks to stop, drains pending batch commits, waits for
+// in-flight operations and background tasks to be over, flushes the
+// memtables and finally closes the database.
+//
+// If a stage takes longer than the timeout set with WithCloseStageTimeout,
+// Close returns an ErrCloseTimeout error naming the stage, while the shutdown
+// goes on in the background. Later calls to Close wait for it to complete.
 func (d *Datastore) Close() error {
-	if !atomic.CompareAndSwapInt32(&d.status, 0, 1) {
+	d.statusMu.Lock()
+	swapped := atomic.CompareAndSwapInt32(&d.status, 0, 1)
+	d.statusMu.Unlock()
+	if !swapped {
 		// already closed, or closing.
-		d.wg.Wait()
+		<-d.closed
 		return nil
 	}
+
+	// buffered so that the shutdown never blocks on announcing a stage, even
+	// once Close has given up on it.
+	stages := make(chan string, 5)
+	done := make(chan error, 1)
+	go func() {
+		defer close(d.closed)
+		done <- d.shutdown(stages)
+	}()
+
+	timeout := d.conf.closeStageTimeout
+	var (
+		stage string
+		timer <-chan time.Time
+	)
+	for {
+		select {
+		case stage = <-stages:
+			d.log.Debugf("closing pebble datastore: %s", stage)
+			if timeout > 0 {
+				timer = time.After(timeout)
+			}
+		case err := <-done:
+			return err
+		case <-timer:
+			d.log.Errorf("closing pebble datastore: %s is taking longer than %s, continuing in the background", stage, timeout)
+			return fmt.Errorf("%w: %s did not complete within %s", ErrCloseTimeout, stage, timeout)
+		}
+	}
+}
+
+// shutdown runs the stages of Close, announcing each of them on stages.
+func (d *Datastore) shutdown(stages chan<- string) error {
+	stages <- "stopping background tasks"
 	close(d.closing)
+
+	if d.committer != nil {
+		stages <- "draining batch commits"
+		d.committer.close()
+	}
+
+	stages <- "waiting for in-flight operations and background tasks"
 	d.wg.Wait()
+
+	stages <- "flushing memtables"
 	_ = d.db.Flush()
+
+	stages <- "closing the database"
+	if d.snapshots != nil {
+		d.snapshots.close()
+	}
+	d.named.releaseAll()
 	return d.db.Close()
 }
 
-func (d *Datastore) inefficientOrderQuery(ctx context.Context, q query.Query, baseOrder query.Order) (query.Results, error) {
+func (d *Datastore) inefficientOrderQuery(ctx context.Context, r iterReader, q query.Query, baseOrder query.Order, opts pebble.IterOptions) (query.Results, error) {
 	// Ok, we have a weird order we can't handle. Let's
 	// perform the _base_ query (prefix, filter, etc.), then
 	// handle sort/offset/limit later.
@@ -392,7 +984,7 @@ func (d *Datastore) inefficientOrderQuery(ctx context.Context, q query.Query, ba
 	}
 
 	// perform the base query.
-	res, err := d.Query(ctx, baseQuery)
+	res, err := d.query(ctx, r, baseQuery, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -404,33 +996,157 @@ func (d *Datastore) inefficientOrderQuery(ctx context.Context, q query.Query, ba
 	naiveQuery := q
 	naiveQuery.Prefix = ""
 	naiveQuery.Filters = nil
+	if d.conf.sortMemoryBudget > 0 {
+		res = externalSort(res, q.Orders, d.conf.sortMemoryBudget, d.conf.sortTempDir)
+		naiveQuery.Orders = nil
+	} else if max := d.conf.maxNaiveQueryEntries; max > 0 && q.Limit == 0 {
+		res = boundedSort(res, q.Orders, max)
+		naiveQuery.Orders = nil
+	}
 
 	// Apply the rest of the query
 	return query.NaiveQueryApply(naiveQuery, res), nil
 }
 
+// CommitHook is invoked after a Batch commits successfully, with the keys
+// that were put and deleted within the batch, in the order they were added.
+type CommitHook func(puts []ds.Key, deletes []ds.Key)
+
 type Batch struct {
+	ds    *Datastore
 	batch *pebble.Batch
+
+	puts    []ds.Key
+	deletes []ds.Key
+	hooks   []CommitHook
+
+	// indexOps records the writes to maintain the indexes for, if any.
+	indexOps []indexOp
+
+	// coalesce holds the deletes deferred until Commit, if CoalesceDeletes
+	// was called.
+	coalesce *deleteCoalescer
 }
 
 var _ ds.Batch = (*Batch)(nil)
 
 func (b *Batch) Put(ctx context.Context, key ds.Key, value []byte) error {
-	err := b.batch.Set(key.Bytes(), value, pebble.NoSync)
+	if err := b.ds.checkKeySize(key.Bytes()); err != nil {
+		return err
+	}
+	if err := b.ds.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	err := b.batch.Set(key.Bytes(), b.ds.encodeValue(value), nil)
 	if err != nil {
 		return fmt.Errorf("pebble error during set within batch: %w", err)
 	}
+	b.puts = append(b.puts, key)
+	if atomic.LoadInt32(&b.ds.indexed) != 0 {
+		b.indexOps = append(b.indexOps, indexOp{key: key, value: value})
+	}
+	if b.ds.conf.metadata {
+		if err := b.ds.metaWrite(b.batch, key, indexOp{key: key, value: value}); err != nil {
+			return fmt.Errorf("pebble error during set within batch: %w", err)
+		}
+	}
+	if b.coalesce != nil {
+		b.coalesce.put(key.Bytes())
+	}
 	return nil
 }
 
 func (b *Batch) Delete(ctx context.Context, key ds.Key) error {
-	err := b.batch.Delete(key.Bytes(), pebble.NoSync)
+	if err := b.ds.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.ds.indexed) != 0 {
+		b.indexOps = append(b.indexOps, indexOp{key: key, delete: true})
+	}
+	if b.ds.conf.metadata {
+		if err := b.ds.metaWrite(b.batch, key, indexOp{key: key, delete: true}); err != nil {
+			return fmt.Errorf("pebble error during delete within batch: %w", err)
+		}
+	}
+	if b.coalesce != nil && b.coalesce.delete(key.Bytes()) {
+		b.deletes = append(b.deletes, key)
+		return nil
+	}
+	err := b.batch.Delete(key.Bytes(), nil)
 	if err != nil {
 		return fmt.Errorf("pebble error during delete within batch: %w", err)
 	}
+	b.deletes = append(b.deletes, key)
 	return nil
 }
 
+// OnCommit registers a hook to be called synchronously after the batch has
+// been committed successfully. Hooks are called in registration order and are
+// not called at all if Commit fails. This is useful to keep caches or
+// secondary indexes in line with the committed state.
+func (b *Batch) OnCommit(hook CommitHook) {
+	b.hooks = append(b.hooks, hook)
+}
+
 func (b *Batch) Commit(ctx context.Context) error {
-	return b.batch.Commit(pebble.NoSync)
+	b.ds.condMu.RLock()
+	err := b.commit(ctx)
+	b.ds.condMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	b.runHooks()
+	return nil
+}
+
+// runHooks calls the hooks registered with OnCommit, once the batch has been
+// committed.
+func (b *Batch) runHooks() {
+	for _, hook := range b.hooks {
+		hook(b.puts, b.deletes)
+	}
+}
+
+// commit writes the batch, without running its hooks. The caller must hold
+// b.ds.condMu.
+func (b *Batch) commit(ctx context.Context) error {
+	batch := b.batch
+	if b.coalesce != nil && len(b.coalesce.pending) > 0 {
+		var err error
+		if batch, err = b.coalesce.apply(ctx, b.ds, b.batch); err != nil {
+			return err
+		}
+		defer batch.Close()
+	}
+
+	if g := b.ds.appendOnly; g != nil && len(b.puts) > 0 {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if err := g.checkBatch(b.puts); err != nil {
+			return err
+		}
+	}
+
+	if len(b.indexOps) > 0 {
+		b.ds.indexMu.Lock()
+		defer b.ds.indexMu.Unlock()
+		if err := b.ds.applyIndexOps(batch, b.indexOps); err != nil {
+			return fmt.Errorf("pebble error updating indexes within batch: %w", err)
+		}
+	}
+
+	var err error
+	if c := b.ds.committer; c != nil {
+		err = c.commit(batch)
+	} else {
+		err = batch.Commit(b.ds.writeOptions())
+	}
+	if err != nil {
+		return err
+	}
+	if g := b.ds.appendOnly; g != nil && len(b.puts) > 0 {
+		g.advance(b.puts[len(b.puts)-1].Bytes())
+	}
+	b.ds.bumpGeneration()
+	return nil
 }
@@ -3,10 +3,17 @@ package pebbleds
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/pebble"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	dstest "github.com/ipfs/go-datastore/test"
 )
 
@@ -17,7 +24,7 @@ func TestPebbleDatastore(t *testing.T) {
 	dstest.SubtestAll(t, ds)
 }
 
-func newDatastore(t *testing.T) (*Datastore, func()) {
+func newDatastore(t testing.TB, options ...Option) (*Datastore, func()) {
 	t.Helper()
 
 	path, err := os.MkdirTemp(os.TempDir(), "testing_pebble_")
@@ -25,7 +32,7 @@ func newDatastore(t *testing.T) (*Datastore, func()) {
 		t.Fatal(err)
 	}
 
-	d, err := NewDatastore(path, nil)
+	d, err := NewDatastoreWithOptions(path, nil, options...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,6 +43,51 @@ func newDatastore(t *testing.T) (*Datastore, func()) {
 	}
 }
 
+func TestMemoryDatastore(t *testing.T) {
+	d, err := NewMemoryDatastore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	dstest.SubtestAll(t, d)
+
+	ctx := context.Background()
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := b.Put(ctx, datastore.NewKey(fmt.Sprintf("/mem/%03d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(ctx, datastore.NewKey("/mem/042")); err != nil || string(val) != "val" {
+		t.Fatalf("expected val, got %q, %v", val, err)
+	}
+	if entries := queryEntries(t, d, query.Query{Prefix: "/mem"}); len(entries) != 100 {
+		t.Fatalf("expected 100 entries, got %d", len(entries))
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := d.DiskUsage(ctx); err != nil || usage == 0 {
+		t.Fatalf("expected the in-memory files to be accounted for, got %d, %v", usage, err)
+	}
+
+	// every memory datastore is a store of its own.
+	other, err := NewMemoryDatastore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if has, err := other.Has(ctx, datastore.NewKey("/mem/042")); err != nil || has {
+		t.Fatalf("expected an empty store, got %v, %v", has, err)
+	}
+}
+
 func TestGet(t *testing.T) {
 	ds, cleanup := newDatastore(t)
 	defer cleanup()
@@ -74,3 +126,675 @@ func TestGet(t *testing.T) {
 		t.Error("not equal", string(val))
 	}
 }
+
+func TestQueryPrefixMode(t *testing.T) {
+	keys := []string{"/a", "/a/b", "/ab", "/b"}
+
+	tcs := []struct {
+		name   string
+		mode   PrefixMode
+		prefix string
+		expect []string
+	}{
+		{"namespaced", NamespacedPrefix, "/a", []string{"/a/b"}},
+		{"namespaced trailing slash", NamespacedPrefix, "/a/", []string{"/a/b"}},
+		{"namespaced root", NamespacedPrefix, "/", keys},
+		{"raw", RawPrefix, "/a", []string{"/a", "/a/b", "/ab"}},
+		{"raw trailing slash", RawPrefix, "/a/", []string{"/a/b"}},
+		{"raw empty", RawPrefix, "", keys},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ds, cleanup := newDatastore(t, WithPrefixMode(tc.mode))
+			defer cleanup()
+
+			ctx := context.Background()
+			for _, k := range keys {
+				if err := ds.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res, err := ds.Query(ctx, query.Query{Prefix: tc.prefix, KeysOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Key)
+			}
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestBatchOnCommit(t *testing.T) {
+	ds, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	b, err := ds.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := b.(*Batch)
+
+	var calls int
+	var gotPuts, gotDeletes []datastore.Key
+	batch.OnCommit(func(puts, deletes []datastore.Key) {
+		calls++
+		gotPuts, gotDeletes = puts, deletes
+	})
+
+	puts := []datastore.Key{datastore.NewKey("a"), datastore.NewKey("b")}
+	deletes := []datastore.Key{datastore.NewKey("c")}
+	for _, k := range puts {
+		if err := batch.Put(ctx, k, []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range deletes {
+		if err := batch.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 0 {
+		t.Fatal("hook called before commit")
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected hook to be called once, got %d", calls)
+	}
+	if !reflect.DeepEqual(gotPuts, puts) {
+		t.Fatalf("expected puts %v, got %v", puts, gotPuts)
+	}
+	if !reflect.DeepEqual(gotDeletes, deletes) {
+		t.Fatalf("expected deletes %v, got %v", deletes, gotDeletes)
+	}
+}
+
+func TestBatchOnCommitFailed(t *testing.T) {
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read-only stores fail every commit.
+	d, err = NewDatastore(path, &pebble.Options{ReadOnly: true, Comparer: pebble.DefaultComparer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := b.(*Batch)
+	batch.OnCommit(func(_, _ []datastore.Key) {
+		t.Fatal("hook called on failed commit")
+	})
+	if err := batch.Put(ctx, datastore.NewKey("a"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(ctx); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+}
+
+func TestConsistencyCheckOnOpen(t *testing.T) {
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDatastoreWithOptions(path, nil, WithConsistencyCheckOnOpen(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.openCheckStats.NumPoints != 3 {
+		t.Fatalf("expected the check to visit 3 points, got %d", d.openCheckStats.NumPoints)
+	}
+}
+
+func TestQueryLimitReleasesIterator(t *testing.T) {
+	ds, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	b, err := ds.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		if err := b.Put(ctx, datastore.NewKey(fmt.Sprintf("/huge/%05d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ds.Query(ctx, query.Query{Prefix: "/huge", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	// the query goroutine must be gone without the consumer reading anything.
+	done := make(chan struct{})
+	go func() {
+		ds.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("query goroutine did not exit after reaching the limit")
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "/huge/00000" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestEmptyValues(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		checksums := checksums
+		t.Run(fmt.Sprintf("checksums=%t", checksums), func(t *testing.T) {
+			ds, cleanup := newDatastore(t, WithValueChecksums(checksums))
+			defer cleanup()
+
+			ctx := context.Background()
+			empty := datastore.NewKey("/empty")
+			missing := datastore.NewKey("/missing")
+			if err := ds.Put(ctx, empty, []byte{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := ds.Put(ctx, datastore.NewKey("/nil"), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, k := range []datastore.Key{empty, datastore.NewKey("/nil")} {
+				val, err := ds.Get(ctx, k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if val == nil || len(val) != 0 {
+					t.Fatalf("expected a non-nil empty value for %s, got %#v", k, val)
+				}
+				has, err := ds.Has(ctx, k)
+				if err != nil || !has {
+					t.Fatalf("expected %s to be present, got %v, %v", k, has, err)
+				}
+				size, err := ds.GetSize(ctx, k)
+				if err != nil || size != 0 {
+					t.Fatalf("expected a size of 0 for %s, got %d, %v", k, size, err)
+				}
+			}
+
+			if val, err := ds.Get(ctx, missing); err != datastore.ErrNotFound || val != nil {
+				t.Fatalf("expected ErrNotFound, got %#v, %v", val, err)
+			}
+			if has, err := ds.Has(ctx, missing); err != nil || has {
+				t.Fatalf("expected the key to be missing, got %v, %v", has, err)
+			}
+			if size, err := ds.GetSize(ctx, missing); err != datastore.ErrNotFound || size != -1 {
+				t.Fatalf("expected ErrNotFound, got %d, %v", size, err)
+			}
+
+			res, err := ds.Query(ctx, query.Query{Prefix: "/", ReturnsSizes: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("expected 2 entries, got %v", entries)
+			}
+			for _, e := range entries {
+				if e.Value == nil || len(e.Value) != 0 || e.Size != 0 {
+					t.Fatalf("expected a non-nil empty value for %s, got %#v (size %d)", e.Key, e.Value, e.Size)
+				}
+			}
+		})
+	}
+}
+
+func TestKeysOnlySizes(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		checksums := checksums
+		t.Run(fmt.Sprintf("checksums %t", checksums), func(t *testing.T) {
+			d, cleanup := newDatastore(t, WithValueChecksums(checksums))
+			defer cleanup()
+
+			ctx := context.Background()
+			for i := 0; i < 10; i++ {
+				if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/size/%d", i)), bytes.Repeat([]byte("v"), i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entries := queryEntries(t, d, query.Query{Prefix: "/size", KeysOnly: true, ReturnsSizes: true})
+			if len(entries) != 10 {
+				t.Fatalf("expected 10 entries, got %d", len(entries))
+			}
+			for i, e := range entries {
+				if e.Key != fmt.Sprintf("/size/%d", i) || e.Value != nil || e.Size != i {
+					t.Fatalf("expected /size/%d with no value and size %d, got %s, %q, %d", i, i, e.Key, e.Value, e.Size)
+				}
+			}
+		})
+	}
+}
+
+func TestEntryErrorMode(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		mode   EntryErrorMode
+		offset int
+		expect []string
+	}{
+		{"report", ReportEntryErrors, 0, []string{"/e/0", "/e/1", "error", "/e/3", "/e/4", "/e/5", "error", "/e/7"}},
+		{"report with offset", ReportEntryErrors, 3, []string{"error", "/e/4", "/e/5", "error", "/e/7"}},
+		{"fail", FailOnEntryErrors, 0, []string{"/e/0", "/e/1", "error"}},
+		{"fail with offset", FailOnEntryErrors, 3, []string{"error"}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, WithValueChecksums(true), WithEntryErrorMode(tc.mode))
+			defer cleanup()
+
+			for i := 0; i < 8; i++ {
+				if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/e/%d", i)), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// make reading the entries of /e/2 and /e/6 fail.
+			for _, k := range []string{"/e/2", "/e/6"} {
+				if err := d.db.Set([]byte(k), []byte("corrupted"), pebble.NoSync); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res, err := d.Query(ctx, query.Query{Prefix: "/e", Offset: tc.offset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Close()
+			var got []string
+			for r := range res.Next() {
+				if r.Error != nil {
+					if !errors.Is(r.Error, ErrChecksumMismatch) {
+						t.Fatalf("unexpected error: %v", r.Error)
+					}
+					got = append(got, "error")
+					continue
+				}
+				got = append(got, r.Key)
+			}
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestSetupFailureReleasesLock(t *testing.T) {
+	path := t.TempDir()
+
+	errSetup := errors.New("setup failed")
+	failing := func(c *config) {
+		c.setupSteps = append(c.setupSteps, func(*Datastore) error { return errSetup })
+	}
+	if _, err := NewDatastoreWithOptions(path, nil, failing); !errors.Is(err, errSetup) {
+		t.Fatalf("expected the setup error, got %v", err)
+	}
+
+	// the directory must be unlocked for the next open to succeed.
+	d, err := NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateWAL(t *testing.T) {
+	path := t.TempDir()
+
+	var wals []uint64
+	opts := &pebble.Options{
+		EventListener: &pebble.EventListener{
+			WALCreated: func(info pebble.WALCreateInfo) {
+				wals = append(wals, uint64(info.FileNum))
+			},
+		},
+	}
+	opts.EnsureDefaults()
+	d, err := NewDatastore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := d.Put(ctx, datastore.NewKey("/before"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	created := len(wals)
+	if err := d.RotateWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if len(wals) != created+1 || wals[len(wals)-1] <= wals[len(wals)-2] {
+		t.Fatalf("expected a new WAL to be created, got %v", wals)
+	}
+
+	if err := d.Put(ctx, datastore.NewKey("/after"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RotateWAL(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	d, err = NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, k := range []string{"/before", "/after"} {
+		if _, err := d.Get(ctx, datastore.NewKey(k)); err != nil {
+			t.Fatalf("expected %s to survive: %s", k, err)
+		}
+	}
+}
+
+func TestCloseStageTimeout(t *testing.T) {
+	d, cleanup := newDatastore(t, WithCloseStageTimeout(50*time.Millisecond))
+	defer cleanup()
+
+	// simulate a stuck operation.
+	d.wg.Add(1)
+	err := d.Close()
+	if !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("expected ErrCloseTimeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "in-flight operations") {
+		t.Fatalf("expected the error to name the stuck stage, got %q", err)
+	}
+	if err := d.CompactAll(context.Background()); err != ErrClosed {
+		t.Fatalf("expected no new work to be accepted, got %v", err)
+	}
+
+	// the shutdown completes once unstuck.
+	d.wg.Done()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.closed:
+	default:
+		t.Fatal("expected the shutdown to be complete")
+	}
+}
+
+func TestDefaultOperationTimeout(t *testing.T) {
+	ds, cleanup := newDatastore(t, WithDefaultOperationTimeout(50*time.Millisecond))
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		if err := ds.Put(ctx, datastore.NewKey(fmt.Sprintf("/timeout/%02d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a slow consumer takes about 300ms to read every entry.
+	consume := func(ctx context.Context) (int, error) {
+		res, err := ds.Query(ctx, query.Query{Prefix: "/timeout"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Close()
+		n := 0
+		for r := range res.Next() {
+			if r.Error != nil {
+				return n, r.Error
+			}
+			n++
+			time.Sleep(10 * time.Millisecond)
+		}
+		return n, nil
+	}
+
+	n, err := consume(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the default timeout to cut the query short, got %d entries and %v", n, err)
+	}
+	if n == 0 || n >= 30 {
+		t.Fatalf("expected some entries before the timeout, got %d", n)
+	}
+
+	err = ds.ScanPrefix(ctx, "/timeout", func(*LazyEntry) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the default timeout to cut the scan short, got %v", err)
+	}
+
+	// an explicit deadline wins, even if later.
+	later, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if n, err := consume(later); err != nil || n != 30 {
+		t.Fatalf("expected the explicit deadline to win, got %d entries and %v", n, err)
+	}
+	sooner, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := consume(sooner); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the explicit deadline to cut the query short, got %v", err)
+	}
+}
+
+func TestSingleDelete(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := func(i int) datastore.Key {
+		return datastore.NewKey(fmt.Sprintf("/single/%03d", i))
+	}
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, key(i), []byte("immutable")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// single deletes meet their put in the memtable for some keys and in
+	// sstables for others.
+	for i := 0; i < 25; i++ {
+		if err := d.SingleDelete(ctx, key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 25; i < 50; i++ {
+		if err := d.SingleDelete(ctx, key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			has, err := d.Has(ctx, key(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has != (i >= 50) {
+				t.Fatalf("expected presence of %s to be %t", key(i), i >= 50)
+			}
+		}
+	}
+	check()
+	if err := d.db.Compact([]byte("/"), []byte("0"), true); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// a key deleted and put again can be single deleted again.
+	if err := d.Put(ctx, key(0), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SingleDelete(ctx, key(0)); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestCanceledContext(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	kept, gone := datastore.NewKey("/kept"), datastore.NewKey("/gone")
+	if err := d.Put(ctx, kept, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Put(canceled, gone, []byte("val")); err != context.Canceled {
+		t.Fatalf("put: expected context.Canceled, got %v", err)
+	}
+	if err := d.Delete(canceled, kept); err != context.Canceled {
+		t.Fatalf("delete: expected context.Canceled, got %v", err)
+	}
+	if err := d.SingleDelete(canceled, kept); err != context.Canceled {
+		t.Fatalf("single delete: expected context.Canceled, got %v", err)
+	}
+	if _, err := d.Get(canceled, kept); err != context.Canceled {
+		t.Fatalf("get: expected context.Canceled, got %v", err)
+	}
+	if _, err := d.Has(canceled, kept); err != context.Canceled {
+		t.Fatalf("has: expected context.Canceled, got %v", err)
+	}
+	if _, err := d.GetSize(canceled, kept); err != context.Canceled {
+		t.Fatalf("get size: expected context.Canceled, got %v", err)
+	}
+
+	// none of the writes happened.
+	if has, err := d.Has(ctx, gone); err != nil || has {
+		t.Fatalf("expected the canceled put not to be written, got %v, %v", has, err)
+	}
+	if v, err := d.Get(ctx, kept); err != nil || string(v) != "val" {
+		t.Fatalf("expected the canceled deletes not to be written, got %q, %v", v, err)
+	}
+}
+
+func BenchmarkTinyPrefixQueries(b *testing.B) {
+	ds, cleanup := newDatastore(b)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		if err := ds.Put(ctx, datastore.NewKey(fmt.Sprintf("/tiny/%03d/a", i)), []byte("val")); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := ds.Query(ctx, query.Query{Prefix: fmt.Sprintf("/tiny/%03d", i%1000)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := res.Rest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeysOnlyQuery(b *testing.B) {
+	ds, cleanup := newDatastore(b, WithValueChecksums(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("v"), 4<<10)
+	for i := 0; i < 10000; i++ {
+		if err := ds.Put(ctx, datastore.NewKey(fmt.Sprintf("/blocks/%05d", i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := ds.db.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		q    query.Query
+	}{
+		{"full", query.Query{Prefix: "/blocks"}},
+		{"keys only", query.Query{Prefix: "/blocks", KeysOnly: true}},
+		{"keys only with sizes", query.Query{Prefix: "/blocks", KeysOnly: true, ReturnsSizes: true}},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				res, err := ds.Query(ctx, bc.q)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for r := range res.Next() {
+					if r.Error != nil {
+						b.Fatal(r.Error)
+					}
+				}
+			}
+		})
+	}
+}
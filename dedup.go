@@ -0,0 +1,39 @@
+package pebbleds
+
+import (
+	"github.com/ipfs/go-datastore/query"
+)
+
+// DeduplicateKeys wraps query results so that every key is returned once:
+// entries whose key was already returned are dropped. This is meant for
+// results merged from several stores or prefixes where the same logical key
+// can show up more than once; a single Datastore never returns duplicates.
+//
+// Seen keys are tracked in memory, costing roughly the size of every distinct
+// key returned. At most maxTracked keys are tracked (unbounded when
+// maxTracked <= 0); past that, keys seen for the first time are no longer
+// tracked and their duplicates get through.
+//
+// Limits and offsets applied to the wrapped results count duplicates; apply
+// them on the deduplicated results instead, e.g. with query.NaiveLimit.
+func DeduplicateKeys(res query.Results, maxTracked int) query.Results {
+	seen := make(map[string]struct{})
+	return query.ResultsFromIterator(res.Query(), query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				r, ok := res.NextSync()
+				if !ok || r.Error != nil {
+					return r, ok
+				}
+				if _, dup := seen[r.Key]; dup {
+					continue
+				}
+				if maxTracked <= 0 || len(seen) < maxTracked {
+					seen[r.Key] = struct{}{}
+				}
+				return r, true
+			}
+		},
+		Close: res.Close,
+	})
+}
@@ -0,0 +1,56 @@
+package pebbleds
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestDeduplicateKeys(t *testing.T) {
+	entries := []query.Entry{
+		{Key: "/a", Value: []byte("1")},
+		{Key: "/b"},
+		{Key: "/a", Value: []byte("2")},
+		{Key: "/c"},
+		{Key: "/b"},
+		{Key: "/c"},
+	}
+
+	keys := func(res query.Results) []string {
+		t.Helper()
+		rest, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range rest {
+			got = append(got, e.Key)
+		}
+		return got
+	}
+
+	res := DeduplicateKeys(query.ResultsWithEntries(query.Query{}, entries), 0)
+	if got, expect := keys(res), []string{"/a", "/b", "/c"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v, got %v", expect, got)
+	}
+
+	// the first occurrence wins.
+	res = DeduplicateKeys(query.ResultsWithEntries(query.Query{}, entries), 0)
+	first, ok := res.NextSync()
+	if !ok || string(first.Value) != "1" {
+		t.Fatalf("expected the first /a, got %v", first)
+	}
+	_ = res.Close()
+
+	// past the cap, new keys are not tracked anymore.
+	res = DeduplicateKeys(query.ResultsWithEntries(query.Query{}, entries), 2)
+	if got, expect := keys(res), []string{"/a", "/b", "/c", "/c"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v, got %v", expect, got)
+	}
+
+	res = query.NaiveLimit(DeduplicateKeys(query.ResultsWithEntries(query.Query{}, entries), 0), 2)
+	if got, expect := keys(res), []string{"/a", "/b"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,385 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/rangekey"
+	"github.com/cockroachdb/pebble/sstable"
+)
+
+// TableBounds describes the key range covered by an sstable.
+type TableBounds struct {
+	FileNum uint64
+	// Size is the size of the file, in bytes.
+	Size uint64
+	// Smallest and Largest are the smallest and largest keys in the file,
+	// both inclusive.
+	Smallest, Largest string
+}
+
+// SSTableBounds returns the key boundaries of the sstables overlapping the
+// given prefix, which is interpreted as in Query. The result is indexed by
+// LSM level, levels being ordered by key within each level except for L0,
+// whose files may overlap.
+//
+// This is a read-only diagnostic to tell whether a prefix is fragmented
+// across many files, which causes read amplification on queries. It does not
+// account for data still in memtables.
+func (d *Datastore) SSTableBounds(ctx context.Context, prefix string) ([][]TableBounds, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.wg.Done()
+
+	tables, err := d.db.SSTables()
+	if err != nil {
+		return nil, fmt.Errorf("pebble error listing sstables: %w", err)
+	}
+
+	lower := []byte(d.queryPrefix(prefix))
+	upper := prefixUpperBound(lower)
+
+	levels := make([][]TableBounds, len(tables))
+	for level, infos := range tables {
+		for _, t := range infos {
+			if bytes.Compare(t.Largest.UserKey, lower) < 0 {
+				continue
+			}
+			if upper != nil && bytes.Compare(t.Smallest.UserKey, upper) >= 0 {
+				continue
+			}
+			levels[level] = append(levels[level], TableBounds{
+				FileNum:  uint64(t.FileNum),
+				Size:     t.Size,
+				Smallest: string(t.Smallest.UserKey),
+				Largest:  string(t.Largest.UserKey),
+			})
+		}
+	}
+	return levels, nil
+}
+
+// ObsoleteFiles describes the files that are no longer part of the current
+// state of the store but still take space on disk.
+type ObsoleteFiles struct {
+	// Tables and TableBytes count obsolete sstables, which Pebble deletes in
+	// the background.
+	Tables     int64
+	TableBytes uint64
+	// Zombies and ZombieBytes count sstables that are obsolete but still read
+	// by open iterators, e.g. those of unfinished queries. They are deleted
+	// once the iterators are closed.
+	Zombies     int64
+	ZombieBytes uint64
+	// WALs and WALBytes count obsolete WAL files, which Pebble keeps around
+	// to recycle them for new WALs.
+	WALs     int64
+	WALBytes uint64
+}
+
+// ObsoleteFiles reports the obsolete files in the store. This complements
+// DiskUsage when debugging a directory larger than the data it holds.
+func (d *Datastore) ObsoleteFiles() (ObsoleteFiles, error) {
+	if err := d.acquire(); err != nil {
+		return ObsoleteFiles{}, err
+	}
+	defer d.wg.Done()
+
+	return d.obsoleteFiles(), nil
+}
+
+func (d *Datastore) obsoleteFiles() ObsoleteFiles {
+	m := d.db.Metrics()
+	return ObsoleteFiles{
+		Tables:      m.Table.ObsoleteCount,
+		TableBytes:  m.Table.ObsoleteSize,
+		Zombies:     m.Table.ZombieCount,
+		ZombieBytes: m.Table.ZombieSize,
+		WALs:        m.WAL.ObsoleteFiles,
+		WALBytes:    m.WAL.ObsoletePhysicalSize,
+	}
+}
+
+// ReclaimObsoleteFiles waits for Pebble to delete the obsolete sstables that
+// are pending deletion, and returns how many bytes were reclaimed meanwhile.
+// Pebble offers no way to delete them on demand, but deletes them in the
+// background as soon as nothing references them, subject to
+// pebble.Options.TargetByteDeletionRate.
+//
+// Zombie sstables are only reclaimed once the iterators reading them are
+// closed, so they are not waited for; neither are obsolete WALs, which are
+// kept for recycling.
+func (d *Datastore) ReclaimObsoleteFiles(ctx context.Context) (uint64, error) {
+	if err := d.acquire(); err != nil {
+		return 0, err
+	}
+	defer d.wg.Done()
+
+	before := d.obsoleteFiles()
+	pending := before.TableBytes + before.ZombieBytes
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		now := d.obsoleteFiles()
+		if now.TableBytes == 0 {
+			if left := now.TableBytes + now.ZombieBytes; left < pending {
+				return pending - left, nil
+			}
+			return 0, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-d.closing:
+			return 0, ErrClosed
+		}
+	}
+}
+
+// InternalEntry is an entry as Pebble stores it internally, returned by
+// DebugScan.
+type InternalEntry struct {
+	Key string
+	// End is the exclusive end of the range, for range deletions.
+	End    string
+	SeqNum uint64
+	Kind   pebble.InternalKeyKind
+	// Value holds a copy of the stored value, if any. It is not decoded, so
+	// it carries its checksum if WithValueChecksums is enabled.
+	Value []byte
+}
+
+// DebugScan returns the internal entries under the given prefix, which is
+// interpreted as in Query, in key order: the newest version of every key, be
+// it a value or a tombstone, along with its sequence number and kind, and the
+// range deletions covering the prefix. Keys deleted by a range deletion are
+// not returned, only the range deletion is. Tombstones show up until
+// compactions drop them.
+//
+// This is a debugging aid for understanding tombstones and versions: the
+// output relies on Pebble internals and may change with any Pebble upgrade.
+func (d *Datastore) DebugScan(ctx context.Context, prefix string) ([]InternalEntry, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.wg.Done()
+
+	lower := []byte(d.queryPrefix(prefix))
+	upper := prefixUpperBound(lower)
+	if upper == nil {
+		// ScanInternal needs an upper bound; no key sorts after 0xff...
+		upper = bytes.Repeat([]byte{0xff}, len(lower)+1)
+	}
+
+	var entries []InternalEntry
+	err := d.db.ScanInternal(ctx, sstable.CategoryAndQoS{}, lower, upper,
+		func(key *pebble.InternalKey, lv pebble.LazyValue, _ pebble.IteratorLevel) error {
+			e := InternalEntry{
+				Key:    string(key.UserKey),
+				SeqNum: key.SeqNum(),
+				Kind:   key.Kind(),
+			}
+			if lv.Len() > 0 {
+				val, _, err := lv.Value(nil)
+				if err != nil {
+					return err
+				}
+				e.Value = bytes.Clone(val)
+			}
+			entries = append(entries, e)
+			return nil
+		},
+		func(start, end []byte, seqNum uint64) error {
+			entries = append(entries, InternalEntry{
+				Key:    string(start),
+				End:    string(end),
+				SeqNum: seqNum,
+				Kind:   pebble.InternalKeyKindRangeDelete,
+			})
+			return nil
+		},
+		func(_, _ []byte, _ []rangekey.Key) error { return nil },
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("pebble error during debug scan: %w", err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+// MemoryUsage summarizes the memory held by the store, in bytes.
+type MemoryUsage struct {
+	// MemTables is the memory allocated to the memtables, including large
+	// batches queued for flushing, and to the zombie memtables that were
+	// flushed but are still read by open iterators.
+	MemTables uint64
+	// BlockCache is the memory used by the block cache, which is bounded by
+	// the cache size set with pebble.Options.Cache.
+	BlockCache int64
+	// TableCache is the memory used by the cache of open sstables.
+	TableCache int64
+}
+
+// Total returns the sum of all the memory usage.
+func (m MemoryUsage) Total() uint64 {
+	return m.MemTables + uint64(m.BlockCache) + uint64(m.TableCache)
+}
+
+// MemoryUsage reports the approximate memory held by the store, to track it
+// against a memory budget. Memtables are allocated whole, so their usage
+// grows in steps of pebble.Options.MemTableSize rather than with every write.
+func (d *Datastore) MemoryUsage() (MemoryUsage, error) {
+	if err := d.acquire(); err != nil {
+		return MemoryUsage{}, err
+	}
+	defer d.wg.Done()
+
+	m := d.db.Metrics()
+	return MemoryUsage{
+		MemTables:  m.MemTable.Size + m.MemTable.ZombieSize,
+		BlockCache: m.BlockCache.Size,
+		TableCache: m.TableCache.Size,
+	}, nil
+}
+
+// Metrics returns a snapshot of Pebble's metrics (see pebble.Metrics), such as
+// the read amplification, compaction counts, memtable sizes and cache hit
+// rates, for monitoring. It is safe to call while other operations, queries
+// included, are running. It fails with ErrClosed once the store is closed.
+func (d *Datastore) Metrics() (*pebble.Metrics, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.wg.Done()
+
+	return d.db.Metrics(), nil
+}
+
+// MetricsString returns the metrics of Metrics formatted as the tables Pebble
+// prints, for human display.
+func (d *Datastore) MetricsString() (string, error) {
+	m, err := d.Metrics()
+	if err != nil {
+		return "", err
+	}
+	return m.String(), nil
+}
+
+// Check runs Pebble's consistency checks over the whole LSM (see
+// pebble.DB.CheckLevels), which read every block and verify that keys are
+// ordered and sequence numbers consistent across levels, returning nil if the
+// store is healthy. It implements ds.CheckedDatastore.
+//
+// The checks cannot be interrupted once started, so the context is only
+// checked before they run.
+func (d *Datastore) Check(ctx context.Context) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := d.db.CheckLevels(nil); err != nil {
+		return fmt.Errorf("pebble consistency check failed: %w", err)
+	}
+	return nil
+}
+
+// MetricsDelta holds the change in Pebble's cumulative metrics over a window
+// of time, as measured by Datastore.MetricsDelta.
+type MetricsDelta struct {
+	// Window is the time elapsed between the two captures.
+	Window time.Duration
+	// Start and End are the metrics captured at either end of the window.
+	Start, End *pebble.Metrics
+
+	// WALBytesIn is the logical size of the writes, and WALBytesWritten the
+	// bytes written to the WAL for them.
+	WALBytesIn, WALBytesWritten uint64
+	// Flushes, Compactions and Ingestions count the operations completed.
+	Flushes, Compactions int64
+	Ingestions           uint64
+	// BytesFlushed, BytesCompacted and BytesIngested are the bytes written to
+	// sstables by each operation, and BytesRead the bytes read by
+	// compactions, across all levels.
+	BytesFlushed, BytesCompacted, BytesIngested, BytesRead uint64
+	// BlockCacheHits and BlockCacheMisses count the block lookups of reads,
+	// and FilterHits and FilterMisses the lookups bloom filters answered or
+	// could not rule out.
+	BlockCacheHits, BlockCacheMisses int64
+	FilterHits, FilterMisses         int64
+}
+
+// PerSecond returns the rate of n over the window, per second.
+func (m MetricsDelta) PerSecond(n float64) float64 {
+	if m.Window <= 0 {
+		return 0
+	}
+	return n / m.Window.Seconds()
+}
+
+// WriteRate returns the bytes written per second over the window.
+func (m MetricsDelta) WriteRate() float64 {
+	return m.PerSecond(float64(m.WALBytesIn))
+}
+
+// CompactionRate returns the bytes compacted per second over the window.
+func (m MetricsDelta) CompactionRate() float64 {
+	return m.PerSecond(float64(m.BytesCompacted))
+}
+
+// MetricsDelta captures the metrics of Metrics, waits for window to elapse,
+// captures them again and returns the difference, so that rates can be
+// computed from the cumulative counters. It fails early with the context
+// error if ctx is done during the wait, and with ErrClosed if the store is
+// closed meanwhile.
+func (d *Datastore) MetricsDelta(ctx context.Context, window time.Duration) (MetricsDelta, error) {
+	if err := d.acquire(); err != nil {
+		return MetricsDelta{}, err
+	}
+	defer d.wg.Done()
+
+	start, began := d.db.Metrics(), time.Now()
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return MetricsDelta{}, ctx.Err()
+	case <-d.closing:
+		return MetricsDelta{}, ErrClosed
+	}
+	end := d.db.Metrics()
+
+	startTotal, endTotal := start.Total(), end.Total()
+	return MetricsDelta{
+		Window:           time.Since(began),
+		Start:            start,
+		End:              end,
+		WALBytesIn:       end.WAL.BytesIn - start.WAL.BytesIn,
+		WALBytesWritten:  end.WAL.BytesWritten - start.WAL.BytesWritten,
+		Flushes:          end.Flush.Count - start.Flush.Count,
+		Compactions:      end.Compact.Count - start.Compact.Count,
+		Ingestions:       end.Ingest.Count - start.Ingest.Count,
+		BytesFlushed:     endTotal.BytesFlushed - startTotal.BytesFlushed,
+		BytesCompacted:   endTotal.BytesCompacted - startTotal.BytesCompacted,
+		BytesIngested:    endTotal.BytesIngested - startTotal.BytesIngested,
+		BytesRead:        endTotal.BytesRead - startTotal.BytesRead,
+		BlockCacheHits:   end.BlockCache.Hits - start.BlockCache.Hits,
+		BlockCacheMisses: end.BlockCache.Misses - start.BlockCache.Misses,
+		FilterHits:       end.Filter.Hits - start.Filter.Hits,
+		FilterMisses:     end.Filter.Misses - start.Filter.Misses,
+	}, nil
+}
@@ -0,0 +1,416 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestSSTableBounds(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	put := func(prefix string, from, to int) {
+		for i := from; i < to; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("%s/%03d", prefix, i)), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("/other", 0, 10)
+	// /p gets fragmented across two files.
+	put("/p", 0, 50)
+	put("/p", 50, 100)
+
+	levels, err := d.SSTableBounds(ctx, "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files int
+	smallest, largest := "", ""
+	for _, tables := range levels {
+		for _, b := range tables {
+			files++
+			if b.Size == 0 {
+				t.Fatalf("expected a non-zero file size for %d", b.FileNum)
+			}
+			if smallest == "" || b.Smallest < smallest {
+				smallest = b.Smallest
+			}
+			if b.Largest > largest {
+				largest = b.Largest
+			}
+		}
+	}
+	if files != 2 {
+		t.Fatalf("expected 2 files overlapping /p, got %d", files)
+	}
+	if smallest != "/p/000" || largest != "/p/099" {
+		t.Fatalf("expected the bounds to cover /p/000 to /p/099, got %s to %s", smallest, largest)
+	}
+
+	// compacting everything merges the fragments.
+	if err := d.db.Compact([]byte("/"), []byte("0"), false); err != nil {
+		t.Fatal(err)
+	}
+	levels, err = d.SSTableBounds(ctx, "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = 0
+	for _, tables := range levels {
+		for _, b := range tables {
+			files++
+			if b.Smallest > "/p/000" || b.Largest < "/p/099" {
+				t.Fatalf("expected the compacted file to cover all of /p, got %s to %s", b.Smallest, b.Largest)
+			}
+		}
+	}
+	if files != 1 {
+		t.Fatalf("expected 1 file overlapping /p after compaction, got %d", files)
+	}
+
+	levels, err = d.SSTableBounds(ctx, "/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tables := range levels {
+		if len(tables) != 0 {
+			t.Fatalf("expected no files overlapping /none, got %v", levels)
+		}
+	}
+}
+
+func TestReclaimObsoleteFiles(t *testing.T) {
+	// background compactions would make the files obsolete too early.
+	d, cleanup := newDatastore(t, WithManualCompaction(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 1000; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/obsolete/%04d", i)), make([]byte, 256)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an unfinished query pins the current files, which turn into zombies
+	// once compacted away.
+	res, err := d.Query(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CompactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	obsolete, err := d.ObsoleteFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obsolete.Zombies == 0 || obsolete.ZombieBytes == 0 {
+		t.Fatalf("expected zombie tables, got %+v", obsolete)
+	}
+	before, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d.wg.Wait() // let the query release its iterator.
+
+	// deletions may be over before this is called, in which case nothing is
+	// left to reclaim.
+	reclaimed, err := d.ReclaimObsoleteFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed > obsolete.ZombieBytes+obsolete.TableBytes {
+		t.Fatalf("reclaimed more than obsolete: %d > %+v", reclaimed, obsolete)
+	}
+	after, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("expected disk usage to drop, got %d, was %d", after, before)
+	}
+	if obsolete, _ := d.ObsoleteFiles(); obsolete.Tables != 0 || obsolete.Zombies != 0 {
+		t.Fatalf("expected no obsolete tables left, got %+v", obsolete)
+	}
+}
+
+func TestDebugScan(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"/debug/a", "/debug/b"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete(ctx, datastore.NewKey("/debug/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.DebugScan(ctx, "/debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	a, b := entries[0], entries[1]
+	if a.Key != "/debug/a" || a.Kind != pebble.InternalKeyKindDelete || a.Value != nil {
+		t.Fatalf("expected a tombstone for /debug/a, got %+v", a)
+	}
+	if b.Key != "/debug/b" || b.Kind != pebble.InternalKeyKindSet || string(b.Value) != "val" {
+		t.Fatalf("expected a value for /debug/b, got %+v", b)
+	}
+	if a.SeqNum <= b.SeqNum {
+		t.Fatalf("expected the deletion to be newer than the last put, got %d <= %d", a.SeqNum, b.SeqNum)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	opts := &pebble.Options{MemTableSize: 256 << 10}
+	opts.EnsureDefaults()
+	d, err := NewDatastore(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	before, err := d.MemoryUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an open iterator keeps the memtable it reads alive once flushed.
+	iter, err := d.db.NewIter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	val := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/mem/%04d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown, err := d.MemoryUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grown.MemTables <= before.MemTables {
+		t.Fatalf("expected memtable usage to grow, got %d, was %d", grown.MemTables, before.MemTables)
+	}
+
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := d.MemoryUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed.MemTables >= grown.MemTables {
+		t.Fatalf("expected memtable usage to drop after a flush, got %d, was %d", flushed.MemTables, grown.MemTables)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := d.Get(ctx, datastore.NewKey(fmt.Sprintf("/mem/%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read, err := d.MemoryUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.BlockCache <= flushed.BlockCache {
+		t.Fatalf("expected block cache usage to grow after reads, got %d, was %d", read.BlockCache, flushed.BlockCache)
+	}
+	if read.Total() < read.MemTables {
+		t.Fatal("expected the total to include the memtables")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.MemoryUsage(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/check/%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var checked datastore.CheckedDatastore = d
+	if err := checked.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := d.Check(canceled); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Check(ctx); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/metrics/%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// metrics are available while a query is running.
+	res, err := d.Query(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.NextSync(); !ok {
+		t.Fatal("expected results")
+	}
+	m, err := d.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Flush.Count == 0 || m.Levels[0].NumFiles == 0 {
+		t.Fatalf("expected the flush to show in the metrics: %s", m)
+	}
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.MetricsString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "level") {
+		t.Fatalf("unexpected metrics string: %s", s)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Metrics(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := d.MetricsString(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestMetricsDelta(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	type result struct {
+		delta MetricsDelta
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		delta, err := d.MetricsDelta(ctx, 500*time.Millisecond)
+		done <- result{delta, err}
+	}()
+	// let the window start before writing.
+	time.Sleep(50 * time.Millisecond)
+
+	const n, size = 100, 1 << 10
+	value := make([]byte, size)
+	for i := 0; i < n; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/delta/%03d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	delta := r.delta
+	if delta.Window < 500*time.Millisecond {
+		t.Fatalf("expected a window of at least 500ms, got %s", delta.Window)
+	}
+	// every write carries its key, value and a few bytes of batch header.
+	if delta.WALBytesIn < n*size || delta.WALBytesIn > 2*n*size {
+		t.Fatalf("expected about %d bytes written, got %d", n*size, delta.WALBytesIn)
+	}
+	if rate := delta.WriteRate(); rate <= 0 || rate > float64(delta.WALBytesIn)/0.5 {
+		t.Fatalf("implausible write rate of %f bytes/s for %d bytes over %s", rate, delta.WALBytesIn, delta.Window)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := d.MetricsDelta(canceled, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// callers racing with Close, some of them starting while it waits for
+	// in-flight operations, must all see ErrClosed.
+	const callers = 8
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+			_, err := d.MetricsDelta(ctx, time.Hour)
+			errs <- err
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cleanup()
+	for i := 0; i < callers; i++ {
+		if err := <-errs; !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	}
+}
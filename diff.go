@@ -0,0 +1,175 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// DiffKind tells how a key differs between the two stores passed to Diff.
+type DiffKind int
+
+const (
+	// OnlyInA marks keys only present in the first store.
+	OnlyInA DiffKind = iota
+	// OnlyInB marks keys only present in the second store.
+	OnlyInB
+	// ValueMismatch marks keys present in both stores with different values.
+	ValueMismatch
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case OnlyInA:
+		return "only in a"
+	case OnlyInB:
+		return "only in b"
+	case ValueMismatch:
+		return "value mismatch"
+	default:
+		return fmt.Sprintf("DiffKind(%d)", int(k))
+	}
+}
+
+// Difference is a key that differs between the two stores passed to Diff.
+type Difference struct {
+	Key  string
+	Kind DiffKind
+}
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// Prefix restricts the diff to the keys under it, interpreted as in
+	// Query by each store.
+	Prefix string
+	// KeysOnly only compares which keys are present, not their values, which
+	// saves reading the values.
+	KeysOnly bool
+}
+
+// Diff compares the two stores and calls fn, in key order, for every key that
+// differs between them. Values are compared as returned by Get, so stores with
+// different WithValueChecksums settings compare equal if they hold the same
+// data.
+//
+// Both stores are walked once, in lockstep, so the diff runs in constant
+// memory whatever their size. Each store is read at the state of the start of
+// the walk. The walk stops at the first error returned by fn, which is
+// returned, unless it is ErrStopScan.
+func Diff(ctx context.Context, a, b *Datastore, opts DiffOptions, fn func(Difference) error) error {
+	if err := a.acquire(); err != nil {
+		return err
+	}
+	defer a.wg.Done()
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.wg.Done()
+
+	open := func(d *Datastore) (*pebble.Iterator, error) {
+		// a prefix under the reserved one still opens an iterator, which
+		// yields no key.
+		iterOpts, _ := d.userIterOptions(d.prefixBounds(opts.Prefix))
+		iter, err := d.db.NewIterWithContext(ctx, &iterOpts)
+		if err != nil {
+			return nil, err
+		}
+		iter.First()
+		return iter, nil
+	}
+	ia, err := open(a)
+	if err != nil {
+		return err
+	}
+	defer ia.Close()
+	ib, err := open(b)
+	if err != nil {
+		return err
+	}
+	defer ib.Close()
+
+	// an iterator that failed is no longer valid, and must not be mistaken
+	// for an exhausted one.
+	iterErr := func() error {
+		for _, iter := range []*pebble.Iterator{ia, ib} {
+			if err := iter.Error(); err != nil {
+				return fmt.Errorf("pebble error during diff: %w", err)
+			}
+		}
+		return nil
+	}
+
+	for ia.Valid() || ib.Valid() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := iterErr(); err != nil {
+			return err
+		}
+
+		var c int
+		switch {
+		case !ib.Valid():
+			c = -1
+		case !ia.Valid():
+			c = 1
+		default:
+			c = bytes.Compare(ia.Key(), ib.Key())
+		}
+
+		var diff *Difference
+		switch {
+		case c < 0:
+			diff = &Difference{Key: string(ia.Key()), Kind: OnlyInA}
+			ia.Next()
+		case c > 0:
+			diff = &Difference{Key: string(ib.Key()), Kind: OnlyInB}
+			ib.Next()
+		default:
+			if !opts.KeysOnly {
+				equal, err := sameValue(a, ia, b, ib)
+				if err != nil {
+					return err
+				}
+				if !equal {
+					diff = &Difference{Key: string(ia.Key()), Kind: ValueMismatch}
+				}
+			}
+			ia.Next()
+			ib.Next()
+		}
+
+		if diff != nil {
+			if err := fn(*diff); err != nil {
+				if errors.Is(err, ErrStopScan) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return iterErr()
+}
+
+// sameValue tells whether the iterators, positioned on the same key, hold the
+// same value.
+func sameValue(a *Datastore, ia *pebble.Iterator, b *Datastore, ib *pebble.Iterator) (bool, error) {
+	va, err := ia.ValueAndErr()
+	if err != nil {
+		return false, fmt.Errorf("pebble error during diff: %w", err)
+	}
+	if va, err = a.decodeValue(ia.Key(), va); err != nil {
+		return false, err
+	}
+	vb, err := ib.ValueAndErr()
+	if err != nil {
+		return false, fmt.Errorf("pebble error during diff: %w", err)
+	}
+	if vb, err = b.decodeValue(ib.Key(), vb); err != nil {
+		return false, err
+	}
+	return bytes.Equal(va, vb), nil
+}
@@ -0,0 +1,83 @@
+package pebbleds
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestDiff(t *testing.T) {
+	a, cleanupA := newDatastore(t)
+	defer cleanupA()
+	// values compare as read, whatever the encoding.
+	b, cleanupB := newDatastore(t, WithValueChecksums(true))
+	defer cleanupB()
+
+	ctx := context.Background()
+	put := func(d *Datastore, kvs map[string]string) {
+		for k, v := range kvs {
+			if err := d.Put(ctx, datastore.NewKey(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(a, map[string]string{"/d/a": "1", "/d/b": "2", "/d/c": "3", "/d/e": "5", "/other": "x"})
+	put(b, map[string]string{"/d/b": "2", "/d/c": "changed", "/d/d": "4", "/d/f": "6"})
+
+	diff := func(opts DiffOptions) []Difference {
+		t.Helper()
+		var got []Difference
+		err := Diff(ctx, a, b, opts, func(d Difference) error {
+			got = append(got, d)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	expect := []Difference{
+		{Key: "/d/a", Kind: OnlyInA},
+		{Key: "/d/c", Kind: ValueMismatch},
+		{Key: "/d/d", Kind: OnlyInB},
+		{Key: "/d/e", Kind: OnlyInA},
+		{Key: "/d/f", Kind: OnlyInB},
+	}
+	if got := diff(DiffOptions{Prefix: "/d"}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v, got %v", expect, got)
+	}
+
+	got := diff(DiffOptions{KeysOnly: true})
+	expect = []Difference{
+		{Key: "/d/a", Kind: OnlyInA},
+		{Key: "/d/d", Kind: OnlyInB},
+		{Key: "/d/e", Kind: OnlyInA},
+		{Key: "/d/f", Kind: OnlyInB},
+		{Key: "/other", Kind: OnlyInA},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v, got %v", expect, got)
+	}
+
+	// stopping early.
+	calls := 0
+	err := Diff(ctx, a, b, DiffOptions{}, func(Difference) error {
+		calls++
+		return ErrStopScan
+	})
+	if err != nil || calls != 1 {
+		t.Fatalf("expected the diff to stop after the first difference, got %d calls and %v", calls, err)
+	}
+
+	// identical stores.
+	err = Diff(ctx, a, a, DiffOptions{}, func(d Difference) error {
+		t.Fatalf("expected no differences, got %v", d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
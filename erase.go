@@ -0,0 +1,77 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// SecureErase deletes the key, making a best effort at removing its value
+// from disk rather than only hiding it: the value is first overwritten with
+// zeros of the same length, then deleted, and the memtables are flushed and
+// the key span compacted so that the sstables holding older versions of the
+// value get rewritten without them. It is a no-op if the key is missing. The
+// zero overwrite is not a new write of the key, so it is allowed in
+// append-only mode (see WithAppendOnly) whatever the last key written.
+//
+// An LSM never overwrites data in place, so this is no guarantee:
+//   - WAL segments still hold the value until they are recycled or deleted,
+//     which only happens after the memtables they back are flushed;
+//   - open snapshots and iterators, including those of WithSnapshotReads,
+//     keep the versions they see from being compacted away until released;
+//   - checkpoints, backups and exported sstables keep their own copies;
+//   - the filesystem or the device may keep the freed blocks around.
+//
+// The compaction rewrites every file overlapping the key, which makes
+// SecureErase much more expensive than Delete.
+func (d *Datastore) SecureErase(ctx context.Context, key ds.Key) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	if err := d.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	// read the latest value rather than the snapshot of WithSnapshotReads,
+	// which misses the recent writes.
+	val, err := d.get(key.Bytes())
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// overwrite like Put, but without the append-only check.
+	zeros := make([]byte, len(val))
+	if d.batchedWrites() {
+		err = d.writeBatched(key, indexOp{key: key, value: zeros}, false)
+	} else {
+		err = d.db.Set(key.Bytes(), d.encodeValue(zeros), d.writeOptions())
+	}
+	if err != nil {
+		return fmt.Errorf("pebble error during set: %w", err)
+	}
+	if err := d.Delete(ctx, key); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := d.db.Flush(); err != nil {
+		return fmt.Errorf("pebble error during flush: %w", err)
+	}
+	k := key.Bytes()
+	// Compact treats the end key inclusively, but requires it to be strictly
+	// greater than the start key.
+	if err := d.db.Compact(k, append(k[:len(k):len(k)], 0), false); err != nil {
+		return fmt.Errorf("pebble error during compaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestSecureErase(t *testing.T) {
+	path := t.TempDir()
+	d, err := NewDatastoreWithOptions(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	secret := []byte("secret-value-7f3a91c2e5")
+	if err := d.Put(ctx, datastore.NewKey("/secret"), secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/other"), []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	// push the value into an sstable, which only a compaction rewrites.
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.SecureErase(ctx, datastore.NewKey("/secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SecureErase(ctx, datastore.NewKey("/missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Get(ctx, datastore.NewKey("/secret")); !errors.Is(err, datastore.ErrNotFound) {
+		t.Fatalf("expected the key to be gone, got %v", err)
+	}
+	entries := queryEntries(t, d, query.Query{})
+	if len(entries) != 1 || entries[0].Key != "/other" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	tables, err := filepath.Glob(filepath.Join(path, "*.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, secret) {
+			t.Fatalf("sstable %s still holds the value", table)
+		}
+	}
+}
+
+func TestSecureEraseRecentWrite(t *testing.T) {
+	testcases := []struct {
+		name string
+		opts []Option
+	}{
+		// the snapshot of the reads predates the write.
+		{"snapshot reads", []Option{WithSnapshotReads(time.Hour)}},
+		// the erased key is not the last one written.
+		{"append only", []Option{WithAppendOnly(true)}},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, tc.opts...)
+			defer cleanup()
+
+			ctx := context.Background()
+			key := datastore.NewKey("/secret")
+			if err := d.Put(ctx, key, []byte("password")); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Put(ctx, datastore.NewKey("/z"), []byte("kept")); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.SecureErase(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.get(key.Bytes()); !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("expected the key to be gone, got %v", err)
+			}
+		})
+	}
+}
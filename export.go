@@ -0,0 +1,249 @@
+package pebbleds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// importBatchSize is the amount of entry data Import buffers per batch.
+const importBatchSize = 4 << 20
+
+// ErrImportConflict is returned by Import under ImportFailOnConflict when an
+// imported key already exists in the store.
+var ErrImportConflict = errors.New("pebble datastore import conflict")
+
+// ConflictPolicy controls how Import handles entries whose key already exists
+// in the store.
+type ConflictPolicy int
+
+const (
+	// ImportOverwrite replaces the existing value with the imported one. It
+	// is the cheapest policy, as existence is never checked.
+	ImportOverwrite ConflictPolicy = iota
+	// ImportSkipExisting keeps the existing value and drops the imported
+	// one, e.g. to resume an interrupted restore or merge stores without
+	// clobbering newer data.
+	ImportSkipExisting
+	// ImportFailOnConflict fails the import with ErrImportConflict at the
+	// first imported key that already exists.
+	ImportFailOnConflict
+)
+
+// Encoder serializes the entries written by Export, in the format of its
+// choice: the default binary one of NewBinaryEncoder, or any other, such as
+// CBOR or newline-delimited JSON, for interoperability with external tools.
+type Encoder interface {
+	// Encode writes an entry.
+	Encode(key ds.Key, value []byte) error
+	// Close flushes the entries buffered by the encoder, if any, once they
+	// have all been encoded. It does not close the underlying writer.
+	Close() error
+}
+
+// Decoder reads back the entries of an Encoder for Import.
+type Decoder interface {
+	// Decode reads the next entry, failing with io.EOF once there is none
+	// left.
+	Decode() (key ds.Key, value []byte, err error)
+}
+
+// Export writes every entry of the store, as of the time of the call, to the
+// encoder in key order, then closes it. Unlike ExportSSTables, the output does
+// not depend on the Pebble version nor on the store configuration: values are
+// exported as returned by Get, and the internal metadata under the reserved
+// prefix, such as indexes, is left out, to be rebuilt on Import.
+func (d *Datastore) Export(ctx context.Context, enc Encoder) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	ctx, cancel := d.operationContext(ctx)
+	defer cancel()
+
+	iter, err := d.db.NewIterWithContext(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	reserved := []byte(d.conf.reservedPrefix)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(iter.Key(), reserved) {
+			continue
+		}
+		val, err := iter.ValueAndErr()
+		if err != nil {
+			return fmt.Errorf("pebble error during export: %w", err)
+		}
+		val, err = d.decodeValue(iter.Key(), val)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(ds.NewKey(string(iter.Key())), val); err != nil {
+			return fmt.Errorf("error encoding exported entry: %w", err)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("pebble error during export: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("error encoding exported entry: %w", err)
+	}
+	return nil
+}
+
+// Import writes every entry read from the decoder, such as those of Export,
+// into the store, handling the keys that already exist according to policy.
+// Existence is checked against the store only, not against the entries read
+// earlier from the same decoder. Entries are committed in batches as they are
+// read: a failed import, conflicts included, leaves the entries read up to the
+// failure in place.
+func (d *Datastore) Import(ctx context.Context, dec Decoder, policy ConflictPolicy) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	var (
+		b    ds.Batch
+		size int
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, value, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding imported entry: %w", err)
+		}
+		if policy != ImportOverwrite {
+			exists, err := d.importKeyExists(key)
+			if err != nil {
+				return fmt.Errorf("pebble error during import: %w", err)
+			}
+			switch {
+			case !exists:
+			case policy == ImportSkipExisting:
+				continue
+			default:
+				return fmt.Errorf("%w: %s", ErrImportConflict, key)
+			}
+		}
+		if b == nil {
+			if b, err = d.Batch(ctx); err != nil {
+				return err
+			}
+		}
+		if err := b.Put(ctx, key, value); err != nil {
+			return err
+		}
+		if size += len(key.String()) + len(value); size >= importBatchSize {
+			if err := b.Commit(ctx); err != nil {
+				return fmt.Errorf("pebble error during import: %w", err)
+			}
+			b, size = nil, 0
+		}
+	}
+	if b == nil {
+		return nil
+	}
+	if err := b.Commit(ctx); err != nil {
+		return fmt.Errorf("pebble error during import: %w", err)
+	}
+	return nil
+}
+
+// importKeyExists reports whether the key is in the store, as of the batches
+// Import committed so far.
+func (d *Datastore) importKeyExists(key ds.Key) (bool, error) {
+	_, closer, err := d.db.Get(key.Bytes())
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, closer.Close()
+}
+
+// binaryEncoder writes entries as their key then their value, each prefixed
+// by its length as a uvarint.
+type binaryEncoder struct {
+	w       *bufio.Writer
+	scratch []byte
+}
+
+// NewBinaryEncoder returns an Encoder writing the default, length-prefixed
+// binary format to w, buffered until Close.
+func NewBinaryEncoder(w io.Writer) Encoder {
+	return &binaryEncoder{w: bufio.NewWriter(w)}
+}
+
+func (e *binaryEncoder) Encode(key ds.Key, value []byte) error {
+	k := key.String()
+	e.scratch = binary.AppendUvarint(e.scratch[:0], uint64(len(k)))
+	e.scratch = append(e.scratch, k...)
+	e.scratch = binary.AppendUvarint(e.scratch, uint64(len(value)))
+	e.scratch = append(e.scratch, value...)
+	_, err := e.w.Write(e.scratch)
+	return err
+}
+
+func (e *binaryEncoder) Close() error {
+	return e.w.Flush()
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+// NewBinaryDecoder returns a Decoder reading the format of NewBinaryEncoder
+// from r.
+func NewBinaryDecoder(r io.Reader) Decoder {
+	return &binaryDecoder{r: bufio.NewReader(r)}
+}
+
+func (d *binaryDecoder) Decode() (ds.Key, []byte, error) {
+	keyLen, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		// a clean io.EOF ends the entries.
+		return ds.Key{}, nil, err
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(d.r, key); err != nil {
+		return ds.Key{}, nil, unexpectedEOF(err)
+	}
+	valueLen, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return ds.Key{}, nil, unexpectedEOF(err)
+	}
+	value := make([]byte, valueLen)
+	if _, err := io.ReadFull(d.r, value); err != nil {
+		return ds.Key{}, nil, unexpectedEOF(err)
+	}
+	return ds.NewKey(string(key)), value, nil
+}
+
+// unexpectedEOF reports an io.EOF in the middle of an entry as truncated
+// input, rather than as the end of the entries.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
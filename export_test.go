@@ -0,0 +1,173 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// jsonEncoder writes entries as newline-delimited JSON.
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+type jsonEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func (e jsonEncoder) Encode(key datastore.Key, value []byte) error {
+	return e.enc.Encode(jsonEntry{Key: key.String(), Value: value})
+}
+
+func (e jsonEncoder) Close() error { return nil }
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d jsonDecoder) Decode() (datastore.Key, []byte, error) {
+	var e jsonEntry
+	if err := d.dec.Decode(&e); err != nil {
+		return datastore.Key{}, nil, err
+	}
+	return datastore.NewKey(e.Key), e.Value, nil
+}
+
+func TestExportImport(t *testing.T) {
+	formats := []struct {
+		name string
+		enc  func(io.Writer) Encoder
+		dec  func(io.Reader) Decoder
+	}{
+		{"binary", NewBinaryEncoder, NewBinaryDecoder},
+		{"json", func(w io.Writer) Encoder { return jsonEncoder{json.NewEncoder(w)} },
+			func(r io.Reader) Decoder { return jsonDecoder{json.NewDecoder(r)} }},
+	}
+	for _, f := range formats {
+		f := f
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			src, cleanup := newDatastore(t, WithValueChecksums(true))
+			defer cleanup()
+			for i := 0; i < 100; i++ {
+				if err := src.Put(ctx, datastore.NewKey(fmt.Sprintf("/key/%03d", i)), []byte(fmt.Sprintf("value %d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := src.Put(ctx, datastore.NewKey("/empty"), []byte{}); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := src.Export(ctx, f.enc(&buf)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the destination stores values differently, which the format
+			// does not depend on.
+			dst, cleanup := newDatastore(t)
+			defer cleanup()
+			if err := dst.Import(ctx, f.dec(&buf), ImportOverwrite); err != nil {
+				t.Fatal(err)
+			}
+
+			want := queryEntries(t, src, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+			got := queryEntries(t, dst, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+			if len(got) != len(want) {
+				t.Fatalf("imported %d entries, expected %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].Key != want[i].Key || !bytes.Equal(got[i].Value, want[i].Value) {
+					t.Fatalf("entry %d: got %s=%q, expected %s=%q", i, got[i].Key, got[i].Value, want[i].Key, want[i].Value)
+				}
+			}
+		})
+	}
+}
+
+func TestImportTruncated(t *testing.T) {
+	ctx := context.Background()
+	src, cleanup := newDatastore(t)
+	defer cleanup()
+	if err := src.Put(ctx, datastore.NewKey("/a"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := src.Export(ctx, NewBinaryEncoder(&buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, cleanup := newDatastore(t)
+	defer cleanup()
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	if err := dst.Import(ctx, NewBinaryDecoder(truncated), ImportOverwrite); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestImportConflictPolicy(t *testing.T) {
+	ctx := context.Background()
+	src, cleanup := newDatastore(t)
+	defer cleanup()
+	for _, k := range []string{"/a", "/b", "/c"} {
+		if err := src.Put(ctx, datastore.NewKey(k), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := src.Export(ctx, NewBinaryEncoder(&buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name    string
+		policy  ConflictPolicy
+		wantErr error
+		want    map[string]string
+	}{
+		{"overwrite", ImportOverwrite, nil,
+			map[string]string{"/a": "new", "/b": "new", "/c": "new", "/d": "old"}},
+		{"skip existing", ImportSkipExisting, nil,
+			map[string]string{"/a": "old", "/b": "new", "/c": "new", "/d": "old"}},
+		// the conflict on the first key fails before anything is written.
+		{"fail on conflict", ImportFailOnConflict, ErrImportConflict,
+			map[string]string{"/a": "old", "/d": "old"}},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dst, cleanup := newDatastore(t)
+			defer cleanup()
+			for _, k := range []string{"/a", "/d"} {
+				if err := dst.Put(ctx, datastore.NewKey(k), []byte("old")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := dst.Import(ctx, NewBinaryDecoder(bytes.NewReader(buf.Bytes())), tc.policy)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			got := make(map[string]string)
+			for _, e := range queryEntries(t, dst, query.Query{}) {
+				got[e.Key] = string(e.Value)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, expected %v", got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Fatalf("got %v, expected %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package pebbleds
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+// ErrResultSetTooLarge is returned as the last result of queries sorted in
+// memory that would buffer more entries than allowed (see
+// WithMaxNaiveQueryEntries).
+var ErrResultSetTooLarge = errors.New("pebble datastore result set too large to sort in memory")
+
+// boundedSort sorts the results by the given orders in memory, like
+// query.NaiveOrder, failing with ErrResultSetTooLarge rather than buffering
+// more than max entries. Error results are returned first, as they come.
+func boundedSort(res query.Results, orders []query.Order, max int) query.Results {
+	var (
+		entries []query.Entry
+		sorted  bool
+		failed  bool
+	)
+	return query.ResultsFromIterator(res.Query(), query.Iterator{
+		Next: func() (query.Result, bool) {
+			for !sorted {
+				r, ok := res.NextSync()
+				switch {
+				case !ok:
+					query.Sort(orders, entries)
+					sorted = true
+				case r.Error != nil:
+					return r, true
+				case len(entries) == max:
+					entries, sorted, failed = nil, true, true
+					return query.Result{Error: fmt.Errorf("%w: more than %d entries", ErrResultSetTooLarge, max)}, true
+				default:
+					entries = append(entries, r.Entry)
+				}
+			}
+			if failed || len(entries) == 0 {
+				return query.Result{}, false
+			}
+			e := entries[0]
+			entries = entries[1:]
+			return query.Result{Entry: e}, true
+		},
+		Close: res.Close,
+	})
+}
+
+// externalSort sorts the results by the given orders within a memory budget:
+// once the buffered entries exceed it, they are sorted and spilled to a
+// temporary file as a run, and the runs are merged back while streaming the
+// sorted results. Up to the size of the results, keys and values included, is
+// written to temporary files under dir, which are removed on Close.
+func externalSort(res query.Results, orders []query.Order, budget int64, dir string) query.Results {
+	s := &sorter{res: res, orders: orders, budget: budget, dir: dir}
+	return query.ResultsFromIterator(res.Query(), query.Iterator{
+		Next:  s.next,
+		Close: s.close,
+	})
+}
+
+type sorter struct {
+	res    query.Results
+	orders []query.Order
+	budget int64
+	dir    string
+
+	started bool
+	err     error
+	done    bool
+
+	runs   []*sortRun
+	merged sortHeap
+}
+
+// sortRun is a sorted run of entries, either spilled to a file or, for the
+// last one, kept in memory.
+type sortRun struct {
+	index   int
+	file    *os.File
+	r       *bufio.Reader
+	entries []query.Entry
+	current query.Entry
+}
+
+func (s *sorter) next() (query.Result, bool) {
+	if !s.started {
+		s.started = true
+		s.err = s.sortRuns()
+	}
+	if s.done {
+		return query.Result{}, false
+	}
+	if s.err != nil {
+		s.done = true
+		return query.Result{Error: s.err}, true
+	}
+	if s.merged.Len() == 0 {
+		return query.Result{}, false
+	}
+	run := s.merged.runs[0]
+	e := run.current
+	ok, err := run.next()
+	switch {
+	case err != nil:
+		s.err = err
+	case ok:
+		heap.Fix(&s.merged, 0)
+	default:
+		heap.Pop(&s.merged)
+	}
+	return query.Result{Entry: e}, true
+}
+
+// sortRuns consumes the results, splitting them into sorted runs, and sets up
+// merging them.
+func (s *sorter) sortRuns() error {
+	var (
+		buf  []query.Entry
+		size int64
+	)
+	for r := range s.res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		buf = append(buf, r.Entry)
+		size += int64(len(r.Key) + len(r.Value))
+		if size > s.budget {
+			if err := s.spill(buf); err != nil {
+				return err
+			}
+			buf, size = buf[:0], 0
+		}
+	}
+
+	s.sort(buf)
+	s.runs = append(s.runs, &sortRun{index: len(s.runs), entries: buf})
+	s.merged.orders = s.orders
+	for _, run := range s.runs {
+		if run.file != nil {
+			if _, err := run.file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("error reading sort run: %w", err)
+			}
+			run.r = bufio.NewReader(run.file)
+		}
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.merged.runs = append(s.merged.runs, run)
+		}
+	}
+	heap.Init(&s.merged)
+	return nil
+}
+
+func (s *sorter) sort(entries []query.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return query.Less(s.orders, entries[i], entries[j])
+	})
+}
+
+// spill sorts the entries and writes them to a temporary file as a run.
+func (s *sorter) spill(entries []query.Entry) error {
+	s.sort(entries)
+	f, err := os.CreateTemp(s.dir, "pebbleds-sort-")
+	if err != nil {
+		return fmt.Errorf("error creating sort run: %w", err)
+	}
+	s.runs = append(s.runs, &sortRun{index: len(s.runs), file: f})
+
+	w := bufio.NewWriter(f)
+	var scratch []byte
+	for _, e := range entries {
+		scratch = binary.AppendUvarint(scratch[:0], uint64(len(e.Key)))
+		scratch = append(scratch, e.Key...)
+		scratch = binary.AppendUvarint(scratch, uint64(len(e.Value)))
+		scratch = append(scratch, e.Value...)
+		scratch = binary.AppendVarint(scratch, int64(e.Size))
+		if _, err := w.Write(scratch); err != nil {
+			return fmt.Errorf("error writing sort run: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing sort run: %w", err)
+	}
+	return nil
+}
+
+// next moves the run to its next entry, returning false once exhausted.
+func (run *sortRun) next() (bool, error) {
+	if run.file == nil {
+		if len(run.entries) == 0 {
+			return false, nil
+		}
+		run.current, run.entries = run.entries[0], run.entries[1:]
+		return true, nil
+	}
+
+	keyLen, err := binary.ReadUvarint(run.r)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading sort run: %w", err)
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(run.r, key); err != nil {
+		return false, fmt.Errorf("error reading sort run: %w", err)
+	}
+	valueLen, err := binary.ReadUvarint(run.r)
+	if err != nil {
+		return false, fmt.Errorf("error reading sort run: %w", err)
+	}
+	var value []byte
+	if valueLen > 0 {
+		value = make([]byte, valueLen)
+		if _, err := io.ReadFull(run.r, value); err != nil {
+			return false, fmt.Errorf("error reading sort run: %w", err)
+		}
+	}
+	size, err := binary.ReadVarint(run.r)
+	if err != nil {
+		return false, fmt.Errorf("error reading sort run: %w", err)
+	}
+	run.current = query.Entry{Key: string(key), Value: value, Size: int(size)}
+	return true, nil
+}
+
+func (s *sorter) close() error {
+	err := s.res.Close()
+	for _, run := range s.runs {
+		if run.file == nil {
+			continue
+		}
+		_ = run.file.Close()
+		if rmErr := os.Remove(run.file.Name()); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	// results may be closed more than once.
+	s.runs = nil
+	return err
+}
+
+// sortHeap merges the runs by their current entry, breaking ties by run so
+// that the sort stays stable.
+type sortHeap struct {
+	orders []query.Order
+	runs   []*sortRun
+}
+
+func (h *sortHeap) Len() int { return len(h.runs) }
+
+func (h *sortHeap) Less(i, j int) bool {
+	a, b := h.runs[i], h.runs[j]
+	if query.Less(h.orders, a.current, b.current) {
+		return true
+	}
+	if query.Less(h.orders, b.current, a.current) {
+		return false
+	}
+	return a.index < b.index
+}
+
+func (h *sortHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *sortHeap) Push(x any) { h.runs = append(h.runs, x.(*sortRun)) }
+
+func (h *sortHeap) Pop() any {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
@@ -0,0 +1,141 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestExternalSort(t *testing.T) {
+	tmp := t.TempDir()
+	d, cleanup := newDatastore(t, WithExternalSort(1024, tmp))
+	defer cleanup()
+	naive, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/sort/%04d", i))
+		// few distinct values, so that ties have to be broken stably.
+		value := []byte(fmt.Sprintf("value-%03d", rng.Intn(300)))
+		for _, s := range []*Datastore{d, naive} {
+			if err := s.Put(ctx, key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for name, q := range map[string]query.Query{
+		"by value":      {Prefix: "/sort", Orders: []query.Order{query.OrderByValue{}}},
+		"by value desc": {Orders: []query.Order{query.OrderByValueDescending{}}},
+		"value then key": {
+			Orders: []query.Order{query.OrderByValue{}, query.OrderByKeyDescending{}},
+			Offset: 100,
+			Limit:  500,
+		},
+		"keys only": {Orders: []query.Order{query.OrderByValue{}, query.OrderByKey{}}, KeysOnly: true, ReturnsSizes: true},
+	} {
+		q := q
+		t.Run(name, func(t *testing.T) {
+			res, err := d.Query(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, ok := res.NextSync()
+			if !ok || first.Error != nil {
+				t.Fatalf("expected a first result, got %v", first.Error)
+			}
+			if spilled, err := os.ReadDir(tmp); err != nil || len(spilled) < 2 {
+				t.Fatalf("expected the results to spill to several runs, got %d (%v)", len(spilled), err)
+			}
+			rest, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := append([]query.Entry{first.Entry}, rest...)
+			if err := res.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if left, _ := os.ReadDir(tmp); len(left) != 0 {
+				t.Fatalf("expected the runs to be removed on close, got %d left", len(left))
+			}
+
+			want := queryEntries(t, naive, q)
+			if len(got) != len(want) {
+				t.Fatalf("expected %d entries, got %d", len(want), len(got))
+			}
+			for i := range want {
+				if got[i].Key != want[i].Key || string(got[i].Value) != string(want[i].Value) || got[i].Size != want[i].Size {
+					t.Fatalf("entry %d: expected %v, got %v", i, want[i], got[i])
+				}
+				if i > 0 && query.Less(q.Orders, got[i], got[i-1]) {
+					t.Fatalf("entry %d is out of order", i)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxNaiveQueryEntries(t *testing.T) {
+	d, cleanup := newDatastore(t, WithMaxNaiveQueryEntries(100))
+	defer cleanup()
+
+	ctx := context.Background()
+	put := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("%s/%03d", prefix, i)), []byte(fmt.Sprint(n-i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put("/large", 101)
+	put("/small", 100)
+
+	byValue := []query.Order{query.OrderByValue{}}
+	res, err := d.Query(ctx, query.Query{Prefix: "/large", Orders: byValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Rest(); !errors.Is(err, ErrResultSetTooLarge) {
+		t.Fatalf("expected ErrResultSetTooLarge past the cap, got %v", err)
+	}
+
+	for name, q := range map[string]query.Query{
+		"under the cap":       {Prefix: "/small", Orders: byValue},
+		"with a limit":        {Prefix: "/large", Orders: byValue, Limit: 101},
+		"ordered by key":      {Prefix: "/large", Orders: []query.Order{query.OrderByKeyDescending{}}},
+		"offset without sort": {Prefix: "/large", Offset: 1},
+	} {
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := 1; i < len(entries); i++ {
+			if query.Less(q.Orders, entries[i], entries[i-1]) {
+				t.Fatalf("%s: entry %d is out of order", name, i)
+			}
+		}
+	}
+
+	unbounded, cleanup := newDatastore(t, WithMaxNaiveQueryEntries(0))
+	defer cleanup()
+	for i := 0; i < 101; i++ {
+		if err := unbounded.Put(ctx, datastore.NewKey(fmt.Sprintf("/large/%03d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries := queryEntries(t, unbounded, query.Query{Orders: byValue}); len(entries) != 101 {
+		t.Fatalf("expected 101 entries without a cap, got %d", len(entries))
+	}
+}
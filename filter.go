@@ -0,0 +1,68 @@
+package pebbleds
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+// KeyRegexFilter is a query.Filter matching entry keys against a regular
+// expression. When the expression is anchored at the beginning of the text
+// and starts with a literal (e.g. `^/blocks/[a-f0-9]+$`), Query uses that
+// literal to bound the scan, turning a full scan into a prefix scan; the full
+// expression is then applied to the remaining candidates.
+type KeyRegexFilter struct {
+	re     *regexp.Regexp
+	prefix string
+}
+
+var _ query.Filter = (*KeyRegexFilter)(nil)
+
+// NewKeyRegexFilter compiles the given pattern into a KeyRegexFilter. The
+// pattern uses the syntax of the regexp package.
+func NewKeyRegexFilter(pattern string) (*KeyRegexFilter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRegexFilter{re: re, prefix: anchoredLiteralPrefix(parsed.Simplify())}, nil
+}
+
+// Filter implements query.Filter.
+func (f *KeyRegexFilter) Filter(e query.Entry) bool {
+	return f.re.MatchString(e.Key)
+}
+
+// Prefix returns the literal every matching key starts with, which may be
+// empty.
+func (f *KeyRegexFilter) Prefix() string {
+	return f.prefix
+}
+
+func (f *KeyRegexFilter) String() string {
+	return fmt.Sprintf("KEY MATCHES %s", f.re)
+}
+
+// anchoredLiteralPrefix returns the literal that any text matched by re must
+// start with. Only expressions anchored at the beginning of the text have
+// one, as others can match anywhere.
+func anchoredLiteralPrefix(re *syntax.Regexp) string {
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var prefix strings.Builder
+	for _, sub := range re.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix.WriteString(string(sub.Rune))
+	}
+	return prefix.String()
+}
@@ -0,0 +1,126 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestKeyRegexFilterPrefix(t *testing.T) {
+	tcs := []struct {
+		pattern, prefix string
+	}{
+		{`^/blocks/[a-f0-9]+$`, "/blocks/"},
+		{`\A/foo[0-9]`, "/foo"},
+		{`^/ab*`, "/a"},
+		{`^/x|^/y`, ""},
+		{`/blocks/`, ""},
+		{`(?m)^/a`, ""},
+		{`(?i)^/a`, ""},
+		{`^.*`, ""},
+	}
+	for _, tc := range tcs {
+		f, err := NewKeyRegexFilter(tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Prefix() != tc.prefix {
+			t.Errorf("pattern %s: expected prefix %q, got %q", tc.pattern, tc.prefix, f.Prefix())
+		}
+	}
+
+	if _, err := NewKeyRegexFilter("("); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestKeyRegexFilterQuery(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	var keys []string
+	for _, ns := range []string{"/a", "/b", "/ba", "/c"} {
+		for i := 0; i < 20; i++ {
+			k := fmt.Sprintf("%s/%02d", ns, i)
+			keys = append(keys, k)
+			if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tcs := []struct {
+		prefix, pattern string
+		lower, upper    string
+	}{
+		{"", `^/b/1[0-5]$`, "/b/1", "/b/2"},
+		{"", `^/b`, "/b", "/c"},
+		{"/b", `^/b/0`, "/b/0", "/b/1"},
+		{"/b", `^/`, "/b/", "/b0"},
+		{"", `[05]$`, "/", "0"},
+	}
+	for _, tc := range tcs {
+		f, err := NewKeyRegexFilter(tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := query.Query{Prefix: tc.prefix, Filters: []query.Filter{f}, KeysOnly: true}
+
+		lower, upper, ok := d.queryBounds(q)
+		if !ok || string(lower) != tc.lower || string(upper) != tc.upper {
+			t.Fatalf("pattern %s: expected bounds [%s, %s), got [%s, %s) (%t)", tc.pattern, tc.lower, tc.upper, lower, upper, ok)
+		}
+
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+
+		// compare against a naive full scan.
+		re := regexp.MustCompile(tc.pattern)
+		var expected []string
+		for _, k := range keys {
+			if (tc.prefix == "" || len(k) > len(tc.prefix) && k[:len(tc.prefix)+1] == tc.prefix+"/") && re.MatchString(k) {
+				expected = append(expected, k)
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("pattern %s: expected %v, got %v", tc.pattern, expected, got)
+		}
+	}
+
+	// a pattern disjoint from the query prefix matches nothing.
+	f, err := NewKeyRegexFilter(`^/c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := query.Query{Prefix: "/a", Filters: []query.Filter{f}}
+	if _, _, ok := d.queryBounds(q); ok {
+		t.Fatal("expected disjoint bounds")
+	}
+	res, err := d.Query(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v", entries)
+	}
+}
@@ -0,0 +1,19 @@
+package pebbleds
+
+import "sync/atomic"
+
+// Generation returns a counter that goes up with every successful mutation
+// of the store: Put, Delete, Batch commits, and the mutations of the other
+// methods and wrappers in this package. Reads leave it alone. Comparing it
+// with an earlier value is a cheap way to tell whether anything changed in
+// the meantime, e.g. to invalidate a cache.
+//
+// The counter lives in memory: it starts over from zero whenever the store
+// is opened, and only reflects mutations made through this Datastore.
+func (d *Datastore) Generation() uint64 {
+	return atomic.LoadUint64(&d.generation)
+}
+
+func (d *Datastore) bumpGeneration() {
+	atomic.AddUint64(&d.generation, 1)
+}
@@ -0,0 +1,70 @@
+package pebbleds
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestGeneration(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := datastore.NewKey("/gen")
+	last := d.Generation()
+	expectBump := func(op string) {
+		t.Helper()
+		gen := d.Generation()
+		if gen <= last {
+			t.Fatalf("expected %s to bump the generation past %d, got %d", op, last, gen)
+		}
+		last = gen
+	}
+	expectSame := func(op string) {
+		t.Helper()
+		if gen := d.Generation(); gen != last {
+			t.Fatalf("expected %s to leave the generation at %d, got %d", op, last, gen)
+		}
+	}
+
+	if err := d.Put(ctx, key, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	expectBump("put")
+
+	if _, err := d.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Has(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Query(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Rest(); err != nil {
+		t.Fatal(err)
+	}
+	expectSame("reads")
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, datastore.NewKey("/gen/b"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	expectSame("an uncommitted batch")
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectBump("a batch commit")
+
+	if err := d.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	expectBump("delete")
+}
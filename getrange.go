@@ -0,0 +1,39 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrRangeOutOfBounds is returned by GetRange when the requested range is not
+// within the value.
+var ErrRangeOutOfBounds = errors.New("range out of value bounds")
+
+// checkRange fails with ErrRangeOutOfBounds unless [offset, offset+length) is
+// within a value of the given size.
+func checkRange(size, offset, length int) error {
+	if offset < 0 || length < 0 || offset > size || length > size-offset {
+		return fmt.Errorf("%w: %d bytes at offset %d of a %d byte value", ErrRangeOutOfBounds, length, offset, size)
+	}
+	return nil
+}
+
+// GetRange reads length bytes of the value of key, starting at offset. The
+// range must be within the value, or GetRange fails with ErrRangeOutOfBounds.
+// Pebble reads values whole, so this saves copying the value out, not reading
+// it.
+func (d *Datastore) GetRange(ctx context.Context, key ds.Key, offset, length int) ([]byte, error) {
+	val, err := d.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(len(val), offset, length); err != nil {
+		return nil, err
+	}
+	// do not keep the whole value alive.
+	return bytes.Clone(val[offset : offset+length]), nil
+}
@@ -0,0 +1,58 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestGetRange(t *testing.T) {
+	type ranger interface {
+		datastore.Datastore
+		GetRange(ctx context.Context, key datastore.Key, offset, length int) ([]byte, error)
+	}
+
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+	stores := map[string]ranger{
+		"datastore":     d,
+		"hybrid inline": newHybridDatastore(t, 1024),
+		// values larger than 4 bytes go to blob files.
+		"hybrid blob": newHybridDatastore(t, 4),
+	}
+
+	ctx := context.Background()
+	key := datastore.NewKey("/range")
+	value := []byte("0123456789")
+	for name, s := range stores {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			if err := s.Put(ctx, key, value); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, tc := range []struct{ offset, length int }{{0, 10}, {2, 5}, {9, 1}, {4, 0}, {10, 0}} {
+				got, err := s.GetRange(ctx, key, tc.offset, tc.length)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expect := value[tc.offset : tc.offset+tc.length]; !bytes.Equal(got, expect) || got == nil {
+					t.Fatalf("expected %q at %d+%d, got %q", expect, tc.offset, tc.length, got)
+				}
+			}
+
+			for _, tc := range []struct{ offset, length int }{{0, 11}, {5, 6}, {11, 0}, {-1, 2}, {2, -1}} {
+				if _, err := s.GetRange(ctx, key, tc.offset, tc.length); !errors.Is(err, ErrRangeOutOfBounds) {
+					t.Fatalf("expected ErrRangeOutOfBounds at %d+%d, got %v", tc.offset, tc.length, err)
+				}
+			}
+
+			if _, err := s.GetRange(ctx, datastore.NewKey("/missing"), 0, 0); !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
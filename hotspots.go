@@ -0,0 +1,141 @@
+package pebbleds
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+const (
+	// hotspotDepth and hotspotWidth size the count-min sketch: the counts it
+	// estimates are off by at most a fraction of about 2/hotspotWidth of the
+	// samples, with a probability of about 1-2^-hotspotDepth.
+	hotspotDepth = 4
+	hotspotWidth = 2048
+)
+
+// HotKey is a frequently read key, as reported by HotKeys.
+type HotKey struct {
+	Key string
+	// Reads is the estimated number of reads of the key, extrapolated from
+	// the sampled ones.
+	Reads uint64
+}
+
+// hotspotSampler samples reads into a count-min sketch of the read counts of
+// the keys, tracking the k keys with the highest estimated counts.
+type hotspotSampler struct {
+	rate float64
+	k    int
+
+	mu     sync.Mutex
+	seeds  [hotspotDepth]maphash.Seed
+	counts [hotspotDepth][hotspotWidth]uint32
+	top    hotKeyHeap
+}
+
+func newHotspotSampler(rate float64, k int) *hotspotSampler {
+	s := &hotspotSampler{k: k, rate: math.Min(rate, 1)}
+	for i := range s.seeds {
+		s.seeds[i] = maphash.MakeSeed()
+	}
+	s.top.index = make(map[string]int, k)
+	return s
+}
+
+// observe records a read of the key, if sampled.
+func (s *hotspotSampler) observe(key string) {
+	// sample at random, as regular sampling would skip keys read in step
+	// with it.
+	if s.rate < 1 && rand.Float64() >= s.rate {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	estimate := uint32(math.MaxUint32)
+	for i := range s.counts {
+		c := &s.counts[i][maphash.String(s.seeds[i], key)%hotspotWidth]
+		if *c < math.MaxUint32 {
+			*c++
+		}
+		if *c < estimate {
+			estimate = *c
+		}
+	}
+
+	if i, ok := s.top.index[key]; ok {
+		s.top.keys[i].Reads = uint64(estimate)
+		heap.Fix(&s.top, i)
+		return
+	}
+	if len(s.top.keys) < s.k {
+		heap.Push(&s.top, HotKey{Key: key, Reads: uint64(estimate)})
+		return
+	}
+	if uint64(estimate) > s.top.keys[0].Reads {
+		delete(s.top.index, s.top.keys[0].Key)
+		s.top.keys[0] = HotKey{Key: key, Reads: uint64(estimate)}
+		s.top.index[key] = 0
+		heap.Fix(&s.top, 0)
+	}
+}
+
+func (s *hotspotSampler) report() []HotKey {
+	s.mu.Lock()
+	keys := make([]HotKey, len(s.top.keys))
+	copy(keys, s.top.keys)
+	s.mu.Unlock()
+	for i := range keys {
+		keys[i].Reads = uint64(math.Round(float64(keys[i].Reads) / s.rate))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Reads != keys[j].Reads {
+			return keys[i].Reads > keys[j].Reads
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// hotKeyHeap is a min-heap of the hot keys by estimated reads, indexed by key.
+type hotKeyHeap struct {
+	keys  []HotKey
+	index map[string]int
+}
+
+func (h *hotKeyHeap) Len() int { return len(h.keys) }
+
+func (h *hotKeyHeap) Less(i, j int) bool { return h.keys[i].Reads < h.keys[j].Reads }
+
+func (h *hotKeyHeap) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.index[h.keys[i].Key] = i
+	h.index[h.keys[j].Key] = j
+}
+
+func (h *hotKeyHeap) Push(x any) {
+	k := x.(HotKey)
+	h.index[k.Key] = len(h.keys)
+	h.keys = append(h.keys, k)
+}
+
+func (h *hotKeyHeap) Pop() any {
+	k := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	delete(h.index, k.Key)
+	return k
+}
+
+// HotKeys returns the most frequently read keys, by Get and Has, along with
+// their estimated read counts, most read first. It returns nil unless
+// sampling was enabled with WithHotspotSampling.
+func (d *Datastore) HotKeys() []HotKey {
+	if d.hotspots == nil {
+		return nil
+	}
+	return d.hotspots.report()
+}
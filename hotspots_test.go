@@ -0,0 +1,65 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestHotKeys(t *testing.T) {
+	d, cleanup := newDatastore(t, WithHotspotSampling(0.5, 5))
+	defer cleanup()
+
+	ctx := context.Background()
+	hot := make([]string, 5)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("/hot/%d", i)
+	}
+	for round := 0; round < 400; round++ {
+		for i, k := range hot {
+			// reads of the hot keys are skewed too, the first one being the
+			// hottest.
+			for j := 0; j < len(hot)-i; j++ {
+				_, _ = d.Get(ctx, datastore.NewKey(k))
+			}
+		}
+		// every cold key is read a handful of times overall.
+		for j := 0; j < 5; j++ {
+			_, _ = d.Has(ctx, datastore.NewKey(fmt.Sprintf("/cold/%d-%d", round, j)))
+		}
+	}
+
+	report := d.HotKeys()
+	if len(report) != len(hot) {
+		t.Fatalf("expected %d hot keys, got %v", len(hot), report)
+	}
+	got := make([]string, len(report))
+	for i, k := range report {
+		got[i] = k.Key
+		if i > 0 && k.Reads > report[i-1].Reads {
+			t.Fatalf("expected the report to be sorted by reads, got %v", report)
+		}
+	}
+	if got[0] != hot[0] {
+		t.Fatalf("expected %s to be the hottest key, got %v", hot[0], report)
+	}
+	sort.Strings(got)
+	for i := range hot {
+		if got[i] != hot[i] {
+			t.Fatalf("expected the hot keys %v, got %v", hot, report)
+		}
+	}
+	// the hottest key is read 2000 times, half of which are sampled.
+	if reads := report[0].Reads; reads < 1800 || reads > 2200 {
+		t.Fatalf("expected about 2000 reads of %s, got %d", hot[0], reads)
+	}
+
+	disabled, cleanup := newDatastore(t)
+	defer cleanup()
+	if report := disabled.HotKeys(); report != nil {
+		t.Fatalf("expected no report when disabled, got %v", report)
+	}
+}
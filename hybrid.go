@@ -0,0 +1,419 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// hybridInline tags values stored as-is in pebble.
+	hybridInline byte = iota
+	// hybridBlob tags pointers to values stored in the blob directory. The
+	// tag is followed by the value size (8 bytes, big endian) and the
+	// sha256 of the value.
+	hybridBlob
+)
+
+const hybridPointerLen = 1 + 8 + sha256.Size
+
+// HybridDatastore keeps small values in a pebble Datastore and stores values
+// larger than a threshold as individual files in a blob directory, keeping
+// only a pointer to them in pebble. This avoids the write amplification that
+// compactions incur when moving large values through the LSM levels, which
+// matters for stores holding big blocks.
+//
+// Values in the underlying Datastore are tagged to tell inline values and
+// pointers apart, so it must only be accessed through the HybridDatastore.
+// Blob files are written and synced before the pointer to them is committed;
+// a crash in between can leave orphaned files behind, but never dangling
+// pointers.
+type HybridDatastore struct {
+	ds        *Datastore
+	blobDir   string
+	threshold int
+
+	// locks serialize writes to the same key, so that blob files are not
+	// removed while being pointed at. Keys are striped by their hash. Reads
+	// do not take them, and follow the new pointer instead when the blob
+	// they read the pointer of was removed (see resolve).
+	locks [64]sync.Mutex
+}
+
+var _ ds.Datastore = (*HybridDatastore)(nil)
+var _ ds.PersistentDatastore = (*HybridDatastore)(nil)
+
+// NewHybridDatastore creates a HybridDatastore on top of the given Datastore,
+// storing values strictly larger than threshold bytes in blobDir, which is
+// created if missing. The HybridDatastore takes ownership of d, closing it on
+// Close.
+func NewHybridDatastore(d *Datastore, blobDir string, threshold int) (*HybridDatastore, error) {
+	if threshold < 0 {
+		return nil, fmt.Errorf("invalid hybrid datastore threshold: %d", threshold)
+	}
+	if err := os.MkdirAll(blobDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &HybridDatastore{
+		ds:        d,
+		blobDir:   blobDir,
+		threshold: threshold,
+	}, nil
+}
+
+// Datastore returns the underlying pebble Datastore.
+func (h *HybridDatastore) Datastore() *Datastore {
+	return h.ds
+}
+
+// blobPath returns the path of the blob file for the given key and value
+// hash. Files are spread across subdirectories by the first byte of the key
+// hash to keep directories reasonably small.
+func (h *HybridDatastore) blobPath(keyHash [sha256.Size]byte, valueHash []byte) string {
+	kh := hex.EncodeToString(keyHash[:])
+	return filepath.Join(h.blobDir, kh[:2], kh+"-"+hex.EncodeToString(valueHash))
+}
+
+func (h *HybridDatastore) lock(keyHash [sha256.Size]byte) func() {
+	mu := &h.locks[int(keyHash[0])%len(h.locks)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// decode resolves a stored value into the actual value.
+func (h *HybridDatastore) decode(key []byte, stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("invalid hybrid value for key %s: empty", key)
+	}
+	switch stored[0] {
+	case hybridInline:
+		return stored[1:], nil
+	case hybridBlob:
+		if len(stored) != hybridPointerLen {
+			return nil, fmt.Errorf("invalid hybrid blob pointer for key %s", key)
+		}
+		val, err := os.ReadFile(h.blobPath(sha256.Sum256(key), stored[9:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blob for key %s: %w", key, err)
+		}
+		return val, nil
+	default:
+		return nil, fmt.Errorf("invalid hybrid value tag for key %s: %d", key, stored[0])
+	}
+}
+
+// decodeSize returns the size of the actual value without reading blobs.
+func decodeSize(stored []byte) (int, error) {
+	if len(stored) == 0 {
+		return -1, fmt.Errorf("invalid hybrid value: empty")
+	}
+	switch stored[0] {
+	case hybridInline:
+		return len(stored) - 1, nil
+	case hybridBlob:
+		if len(stored) != hybridPointerLen {
+			return -1, fmt.Errorf("invalid hybrid blob pointer")
+		}
+		return int(binary.BigEndian.Uint64(stored[1:9])), nil
+	default:
+		return -1, fmt.Errorf("invalid hybrid value tag: %d", stored[0])
+	}
+}
+
+// removeBlob removes the blob pointed at by stored, if any.
+func (h *HybridDatastore) removeBlob(keyHash [sha256.Size]byte, stored []byte) error {
+	if len(stored) != hybridPointerLen || stored[0] != hybridBlob {
+		return nil
+	}
+	err := os.Remove(h.blobPath(keyHash, stored[9:]))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove blob: %w", err)
+	}
+	return nil
+}
+
+// writeBlob atomically writes a blob file, syncing it before returning.
+func writeBlob(path string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(value)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// resolve reads the value of key from stored with read. Readers do not take
+// the key locks, so an overwrite or a delete may remove the blob that stored
+// points at in the meantime: the pointer is then read again, and followed if
+// it changed.
+func (h *HybridDatastore) resolve(k []byte, stored []byte, read func(stored []byte) ([]byte, error)) ([]byte, error) {
+	for {
+		val, err := read(stored)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return val, err
+		}
+		current, gerr := h.ds.get(k)
+		if gerr != nil {
+			return nil, gerr
+		}
+		if bytes.Equal(current, stored) {
+			// the same value may have been written back since: read it a
+			// last time rather than failing right away.
+			return read(current)
+		}
+		stored = current
+	}
+}
+
+func (h *HybridDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	k := key.Bytes()
+	stored, err := h.ds.get(k)
+	if err != nil {
+		return nil, err
+	}
+	return h.resolve(k, stored, func(stored []byte) ([]byte, error) {
+		return h.decode(k, stored)
+	})
+}
+
+// GetRange reads length bytes of the value of key, starting at offset, like
+// Datastore.GetRange. Values stored as blobs are read from the requested
+// range of their file only.
+func (h *HybridDatastore) GetRange(ctx context.Context, key ds.Key, offset, length int) ([]byte, error) {
+	k := key.Bytes()
+	stored, err := h.ds.get(k)
+	if err != nil {
+		return nil, err
+	}
+	return h.resolve(k, stored, func(stored []byte) ([]byte, error) {
+		size, err := decodeSize(stored)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRange(size, offset, length); err != nil {
+			return nil, err
+		}
+		if stored[0] == hybridInline {
+			return bytes.Clone(stored[1+offset : 1+offset+length]), nil
+		}
+
+		f, err := os.Open(h.blobPath(sha256.Sum256(k), stored[9:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blob for key %s: %w", key, err)
+		}
+		defer f.Close()
+		val := make([]byte, length)
+		if _, err := f.ReadAt(val, int64(offset)); err != nil {
+			return nil, fmt.Errorf("failed to read blob for key %s: %w", key, err)
+		}
+		return val, nil
+	})
+}
+
+func (h *HybridDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return h.ds.Has(ctx, key)
+}
+
+func (h *HybridDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	stored, err := h.ds.get(key.Bytes())
+	if err != nil {
+		return -1, err
+	}
+	return decodeSize(stored)
+}
+
+// checkPut fails with the errors the underlying Datastore would fail the put
+// of key with, so that no blob is written for a put bound to fail.
+func (h *HybridDatastore) checkPut(ctx context.Context, k []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := h.ds.checkKeySize(k); err != nil {
+		return err
+	}
+	if err := h.ds.checkUserKey(k); err != nil {
+		return err
+	}
+	if g := h.ds.appendOnly; g != nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.check(k)
+	}
+	return nil
+}
+
+func (h *HybridDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	k := key.Bytes()
+	if err := h.checkPut(ctx, k); err != nil {
+		return err
+	}
+	keyHash := sha256.Sum256(k)
+	defer h.lock(keyHash)()
+
+	old, err := h.ds.get(k)
+	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return err
+	}
+
+	var stored []byte
+	if len(value) > h.threshold {
+		valueHash := sha256.Sum256(value)
+		stored = make([]byte, hybridPointerLen)
+		stored[0] = hybridBlob
+		binary.BigEndian.PutUint64(stored[1:9], uint64(len(value)))
+		copy(stored[9:], valueHash[:])
+		if err := writeBlob(h.blobPath(keyHash, valueHash[:]), value); err != nil {
+			return fmt.Errorf("failed to write blob: %w", err)
+		}
+	} else {
+		stored = make([]byte, 1+len(value))
+		stored[0] = hybridInline
+		copy(stored[1:], value)
+	}
+
+	if err := h.ds.Put(ctx, key, stored); err != nil {
+		// the new blob is not pointed at, unless it is the one of the old
+		// value.
+		if !bytes.Equal(old, stored) {
+			if rerr := h.removeBlob(keyHash, stored); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+		}
+		return err
+	}
+	// overwriting a value with the same content keeps the same blob.
+	if !bytes.Equal(old, stored) {
+		return h.removeBlob(keyHash, old)
+	}
+	return nil
+}
+
+func (h *HybridDatastore) Delete(ctx context.Context, key ds.Key) error {
+	k := key.Bytes()
+	keyHash := sha256.Sum256(k)
+	defer h.lock(keyHash)()
+
+	old, err := h.ds.get(k)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	}
+	if err := h.ds.Delete(ctx, key); err != nil {
+		return err
+	}
+	return h.removeBlob(keyHash, old)
+}
+
+// Query runs the query against the underlying Datastore. As the values
+// stored there are tagged, everything depending on them (filters, value
+// orders and sizes) is applied on the decoded entries instead of being
+// pushed down to pebble.
+func (h *HybridDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	base := query.Query{
+		Prefix:   q.Prefix,
+		KeysOnly: q.KeysOnly && !q.ReturnsSizes,
+	}
+	naive := q
+	naive.Prefix = ""
+	if len(q.Orders) == 1 {
+		switch q.Orders[0].(type) {
+		case query.OrderByKey, *query.OrderByKey, query.OrderByKeyDescending, *query.OrderByKeyDescending:
+			base.Orders = q.Orders
+			naive.Orders = nil
+		}
+	}
+
+	res, err := h.ds.Query(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil || base.KeysOnly {
+				return r, ok
+			}
+			if q.ReturnsSizes {
+				r.Size, r.Error = decodeSize(r.Value)
+			}
+			switch {
+			case q.KeysOnly:
+				r.Value = nil
+			case r.Error == nil:
+				k := []byte(r.Key)
+				r.Value, r.Error = h.resolve(k, r.Value, func(stored []byte) ([]byte, error) {
+					return h.decode(k, stored)
+				})
+			}
+			return r, true
+		},
+		Close: res.Close,
+	})
+	return query.NaiveQueryApply(naive, decoded), nil
+}
+
+func (h *HybridDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	// blobs are synced as they are written.
+	return h.ds.Sync(ctx, prefix)
+}
+
+// DiskUsage returns the disk usage of the underlying Datastore plus the size
+// of all the files in the blob directory.
+func (h *HybridDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	usage, err := h.ds.DiskUsage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = filepath.WalkDir(h.blobDir, func(_ string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		usage += uint64(info.Size())
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute blob directory usage: %w", err)
+	}
+	return usage, nil
+}
+
+// Close closes the underlying Datastore.
+func (h *HybridDatastore) Close() error {
+	return h.ds.Close()
+}
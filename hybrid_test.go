@@ -0,0 +1,257 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func newHybridDatastore(t *testing.T, threshold int) *HybridDatastore {
+	t.Helper()
+
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHybridDatastore(d, filepath.Join(t.TempDir(), "blobs"), threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+func countBlobs(t *testing.T, h *HybridDatastore) int {
+	t.Helper()
+
+	var n int
+	err := filepath.WalkDir(h.blobDir, func(_ string, e os.DirEntry, err error) error {
+		if err == nil && !e.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestHybridDatastore(t *testing.T) {
+	// half of the values of the generic suite land in the blob directory.
+	dstest.SubtestAll(t, newHybridDatastore(t, 64))
+}
+
+func TestHybridThreshold(t *testing.T) {
+	h := newHybridDatastore(t, 8)
+	ctx := context.Background()
+
+	small := datastore.NewKey("small")
+	large := datastore.NewKey("large")
+	smallVal := bytes.Repeat([]byte("s"), 8)
+	largeVal := bytes.Repeat([]byte("l"), 9)
+
+	if err := h.Put(ctx, small, smallVal); err != nil {
+		t.Fatal(err)
+	}
+	if countBlobs(t, h) != 0 {
+		t.Fatal("expected a value at the threshold to be stored inline")
+	}
+	if err := h.Put(ctx, large, largeVal); err != nil {
+		t.Fatal(err)
+	}
+	if countBlobs(t, h) != 1 {
+		t.Fatal("expected a value above the threshold to be stored as a blob")
+	}
+
+	for k, v := range map[datastore.Key][]byte{small: smallVal, large: largeVal} {
+		val, err := h.Get(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, v) {
+			t.Fatalf("key %s: expected %q, got %q", k, v, val)
+		}
+		size, err := h.GetSize(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(v) {
+			t.Fatalf("key %s: expected size %d, got %d", k, len(v), size)
+		}
+	}
+
+	res, err := h.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}, ReturnsSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !bytes.Equal(entries[0].Value, largeVal) || entries[0].Size != len(largeVal) ||
+		!bytes.Equal(entries[1].Value, smallVal) || entries[1].Size != len(smallVal) {
+		t.Fatalf("unexpected query results: %+v", entries)
+	}
+
+	// moving a value across tiers cleans up after itself.
+	if err := h.Put(ctx, large, smallVal); err != nil {
+		t.Fatal(err)
+	}
+	if countBlobs(t, h) != 0 {
+		t.Fatal("expected the blob to be removed once the value is inline")
+	}
+	if err := h.Put(ctx, small, largeVal); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete(ctx, small); err != nil {
+		t.Fatal(err)
+	}
+	if countBlobs(t, h) != 0 {
+		t.Fatal("expected the blob to be removed on delete")
+	}
+	if _, err := h.Get(ctx, small); err != datastore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := h.Delete(ctx, large); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := h.Has(ctx, large); err != nil || has {
+		t.Fatalf("expected the inline key to be deleted, got %t, %v", has, err)
+	}
+}
+
+func TestHybridDiskUsage(t *testing.T) {
+	h := newHybridDatastore(t, 1024)
+	ctx := context.Background()
+
+	before, err := h.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := h.Datastore().DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := bytes.Repeat([]byte("x"), 1<<20)
+	if err := h.Put(ctx, datastore.NewKey("blob"), blob); err != nil {
+		t.Fatal(err)
+	}
+	after, err := h.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after-before < uint64(len(blob)) {
+		t.Fatalf("expected disk usage to account for the blob, went from %d to %d", before, after)
+	}
+	if before < inner {
+		t.Fatalf("expected disk usage to include the pebble usage: %d < %d", before, inner)
+	}
+}
+
+func TestHybridConcurrentOverwrite(t *testing.T) {
+	h := newHybridDatastore(t, 8)
+	ctx := context.Background()
+	key := datastore.NewKey("/blob")
+
+	values := make([][]byte, 4)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte{byte('a' + i)}, 1024)
+	}
+	if err := h.Put(ctx, key, values[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	const rounds = 200
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for i := 1; i <= rounds; i++ {
+			if err := h.Put(ctx, key, values[i%len(values)]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// failing waits for the writer, which must not outlive the datastore.
+	fail := func(format string, args ...any) {
+		t.Helper()
+		<-done
+		t.Fatalf(format, args...)
+	}
+	for {
+		select {
+		case <-done:
+			select {
+			case err := <-errs:
+				t.Fatal(err)
+			default:
+			}
+			if n := countBlobs(t, h); n != 1 {
+				t.Fatalf("expected a single blob left, got %d", n)
+			}
+			return
+		default:
+		}
+		val, err := h.Get(ctx, key)
+		if err != nil {
+			fail("Get during overwrites: %v", err)
+		}
+		if len(val) != 1024 || bytes.Count(val, val[:1]) != len(val) {
+			fail("got a torn value of %d bytes", len(val))
+		}
+		if _, err := h.GetRange(ctx, key, 10, 10); err != nil {
+			fail("GetRange during overwrites: %v", err)
+		}
+	}
+}
+
+func TestHybridRejectedPut(t *testing.T) {
+	d, err := NewDatastoreWithOptions(t.TempDir(), nil,
+		WithMaxKeySize(16), WithReservedPrefix("/internal/"), WithAppendOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHybridDatastore(d, filepath.Join(t.TempDir(), "blobs"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx := context.Background()
+	large := bytes.Repeat([]byte("l"), 9)
+	if err := h.Put(ctx, datastore.NewKey("/b"), large); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		key    string
+		expect error
+	}{
+		{"canceled", canceled, "/c", context.Canceled},
+		{"key too large", ctx, "/ccccccccccccccccc", ErrKeyTooLarge},
+		{"reserved key", ctx, "/internal/c", ErrReservedKey},
+		{"non-monotonic key", ctx, "/a", ErrNonMonotonicKey},
+	} {
+		if err := h.Put(tc.ctx, datastore.NewKey(tc.key), large); !errors.Is(err, tc.expect) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expect, err)
+		}
+		if n := countBlobs(t, h); n != 1 {
+			t.Fatalf("%s: expected no blob to be written, found %d blobs", tc.name, n)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package pebbleds
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// IndexFunc computes the index keys of an entry, under which it is found by
+// QueryIndex. It must be deterministic, as it is called again with the old
+// value when the entry is overwritten or deleted, to remove its index
+// entries.
+type IndexFunc func(key ds.Key, value []byte) []ds.Key
+
+// indexOp is a write recorded by a Batch to maintain the indexes on commit,
+// along with the metadata of the value, if any (see PutWithMeta).
+type indexOp struct {
+	key    ds.Key
+	value  []byte
+	delete bool
+
+	meta    []byte
+	hasMeta bool
+}
+
+// RegisterIndex registers a secondary index, maintained by the datastore from
+// then on: every Put, Delete and SingleDelete, and every batch, updates the
+// index entries of the keys it writes atomically with them, under the
+// reserved prefix (see WithReservedPrefix). Entries written before the index
+// was registered are not indexed, and writes bypassing the Datastore methods,
+// such as DeleteRange and IngestSSTables, do not maintain indexes. Indexes
+// must therefore be registered right after opening, before any write, on
+// every open.
+//
+// Indexed writes read the previous value of the key and are serialized with
+// each other, which makes them noticeably slower than plain writes.
+func (d *Datastore) RegisterIndex(name string, fn IndexFunc) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid index name %q", name)
+	}
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+	if _, ok := d.indexes[name]; ok {
+		return fmt.Errorf("index %q already registered", name)
+	}
+	if d.indexes == nil {
+		d.indexes = make(map[string]IndexFunc)
+	}
+	d.indexes[name] = fn
+	atomic.StoreInt32(&d.indexed, 1)
+	return nil
+}
+
+// QueryIndex returns the keys of the entries that the index name maps to
+// indexKey, in key order.
+func (d *Datastore) QueryIndex(ctx context.Context, name string, indexKey ds.Key) ([]ds.Key, error) {
+	d.indexMu.Lock()
+	_, ok := d.indexes[name]
+	d.indexMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("index %q not registered", name)
+	}
+
+	prefix := d.indexEntryPrefix(name, indexKey)
+	iter, err := d.db.NewIterWithContext(ctx, &pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var keys []ds.Key
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			_ = iter.Close()
+			return nil, err
+		}
+		keys = append(keys, ds.RawKey(string(iter.Key()[len(prefix):])))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("pebble error reading index: %w", err)
+	}
+	return keys, nil
+}
+
+// indexEntryPrefix returns the prefix of the index entries of indexKey: the
+// entries append the primary key to it.
+func (d *Datastore) indexEntryPrefix(name string, indexKey ds.Key) []byte {
+	k := d.reservedKey("idx/" + name + "/")
+	k = binary.AppendUvarint(k, uint64(len(indexKey.String())))
+	return append(k, indexKey.String()...)
+}
+
+// indexWrites adds to the batch the index updates of writing value to key, or
+// deleting it, given its old value, if found. The caller must hold
+// d.indexMu.
+func (d *Datastore) indexWrites(b *pebble.Batch, key ds.Key, old []byte, found bool, op indexOp) error {
+	for name, fn := range d.indexes {
+		if found {
+			for _, ik := range fn(key, old) {
+				if err := b.Delete(append(d.indexEntryPrefix(name, ik), key.String()...), nil); err != nil {
+					return err
+				}
+			}
+		}
+		if op.delete {
+			continue
+		}
+		for _, ik := range fn(key, op.value) {
+			if err := b.Set(append(d.indexEntryPrefix(name, ik), key.String()...), nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBatched writes or deletes the key along with its index and metadata
+// updates, in a single batch. The delete is a single delete if single is set.
+func (d *Datastore) writeBatched(key ds.Key, op indexOp, single bool) error {
+	var (
+		old   []byte
+		found bool
+	)
+	if atomic.LoadInt32(&d.indexed) != 0 {
+		d.indexMu.Lock()
+		defer d.indexMu.Unlock()
+
+		var err error
+		old, err = d.get(key.Bytes())
+		found = err == nil
+		if err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+	}
+
+	var err error
+	b := d.db.NewBatch()
+	defer b.Close()
+	switch {
+	case !op.delete:
+		err = b.Set(key.Bytes(), d.encodeValue(op.value), nil)
+	case single:
+		err = b.SingleDelete(key.Bytes(), nil)
+	default:
+		err = b.Delete(key.Bytes(), nil)
+	}
+	if err == nil && atomic.LoadInt32(&d.indexed) != 0 {
+		err = d.indexWrites(b, key, old, found, op)
+	}
+	if err == nil && d.conf.metadata {
+		err = d.metaWrite(b, key, op)
+	}
+	if err == nil {
+		err = b.Commit(d.writeOptions())
+	}
+	return err
+}
+
+// applyIndexOps adds to the batch the index updates of the writes recorded by
+// a Batch, in order. The caller must hold d.indexMu.
+func (d *Datastore) applyIndexOps(b *pebble.Batch, ops []indexOp) error {
+	// values written earlier within the batch shadow the stored ones.
+	pending := make(map[string]*indexOp, len(ops))
+	for i := range ops {
+		op := &ops[i]
+		var (
+			old   []byte
+			found bool
+		)
+		if prev, ok := pending[op.key.String()]; ok {
+			old, found = prev.value, !prev.delete
+		} else {
+			v, err := d.get(op.key.Bytes())
+			switch {
+			case err == nil:
+				old, found = v, true
+			case !errors.Is(err, ds.ErrNotFound):
+				return err
+			}
+		}
+		if err := d.indexWrites(b, op.key, old, found, *op); err != nil {
+			return err
+		}
+		pending[op.key.String()] = op
+	}
+	return nil
+}
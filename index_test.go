@@ -0,0 +1,135 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+)
+
+func TestIndexes(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	err := d.RegisterIndex("color", func(key datastore.Key, value []byte) []datastore.Key {
+		if len(value) == 0 {
+			return nil
+		}
+		return []datastore.Key{datastore.NewKey(string(value))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RegisterIndex("color", nil); err == nil {
+		t.Fatal("expected registering an index twice to fail")
+	}
+
+	expect := func(color string, keys ...string) {
+		t.Helper()
+		got, err := d.QueryIndex(ctx, "color", datastore.NewKey(color))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotKeys := make([]string, len(got))
+		for i, k := range got {
+			gotKeys[i] = k.String()
+		}
+		if len(keys) == 0 {
+			keys = []string{}
+		}
+		if !reflect.DeepEqual(gotKeys, keys) {
+			t.Fatalf("expected %s to index %v, got %v", color, keys, gotKeys)
+		}
+	}
+	put := func(k, v string) {
+		t.Helper()
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("/a", "red")
+	put("/b", "red")
+	put("/c", "blue")
+	expect("red", "/a", "/b")
+	expect("blue", "/c")
+
+	// overwrites move the entry to its new index key.
+	put("/a", "blue")
+	expect("red", "/b")
+	expect("blue", "/a", "/c")
+
+	if err := d.Delete(ctx, datastore.NewKey("/c")); err != nil {
+		t.Fatal(err)
+	}
+	expect("blue", "/a")
+
+	put("/once", "green")
+	if err := d.SingleDelete(ctx, datastore.NewKey("/once")); err != nil {
+		t.Fatal(err)
+	}
+	expect("green")
+
+	// batches see their own earlier writes.
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []struct{ key, value string }{{"/d", "red"}, {"/b", ""}, {"/d", "green"}, {"/e", "red"}} {
+		if op.value == "" {
+			err = b.Delete(ctx, datastore.NewKey(op.key))
+		} else {
+			err = b.Put(ctx, datastore.NewKey(op.key), []byte(op.value))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// nothing is indexed until the batch commits.
+	expect("green")
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("red", "/e")
+	expect("green", "/d")
+
+	// failed commits write no index entries either.
+	cb, err := d.BatchWithCondition(ctx, datastore.NewKey("/guard"), []byte("never"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Put(ctx, datastore.NewKey("/f"), []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Commit(ctx); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("expected ErrConditionFailed, got %v", err)
+	}
+	expect("red", "/e")
+
+	// there are no stale index entries left: one per indexed entry.
+	iter, err := d.db.NewIter(&pebble.IterOptions{
+		LowerBound: d.reservedKey("idx/"),
+		UpperBound: prefixUpperBound(d.reservedKey("idx/")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 index entries, for /a, /d and /e, got %d", n)
+	}
+
+	if _, err := d.QueryIndex(ctx, "size", datastore.NewKey("/x")); err == nil {
+		t.Fatal("expected querying an unregistered index to fail")
+	}
+}
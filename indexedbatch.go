@@ -0,0 +1,62 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// IndexedBatch is a Batch that can be read from before it is committed: its
+// reads see the committed state of the store overlaid with the writes of the
+// batch, so that a pipeline can read back what it staged, e.g. to dedupe.
+//
+// Indexed batches keep their writes sorted, which makes them more expensive
+// to write to than a plain Batch; use them only when the reads are needed.
+type IndexedBatch struct {
+	*Batch
+}
+
+var _ ds.Batch = (*IndexedBatch)(nil)
+
+// IndexedBatch returns a new IndexedBatch.
+func (d *Datastore) IndexedBatch(ctx context.Context) (*IndexedBatch, error) {
+	return &IndexedBatch{&Batch{ds: d, batch: d.db.NewIndexedBatch()}}, nil
+}
+
+// Get reads a key, as Datastore.Get does, through the writes of the batch.
+func (b *IndexedBatch) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// deletes deferred by CoalesceDeletes are not in the batch yet.
+	if c := b.coalesce; c != nil {
+		if _, ok := c.pending[string(key.Bytes())]; ok {
+			return nil, ds.ErrNotFound
+		}
+	}
+	return b.ds.getFrom(b.batch, key.Bytes())
+}
+
+// Has reports whether the key exists, through the writes of the batch.
+func (b *IndexedBatch) Has(ctx context.Context, key ds.Key) (bool, error) {
+	_, err := b.Get(ctx, key)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return false, nil
+	case err == nil:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// GetSize returns the size of the value of the key, through the writes of
+// the batch.
+func (b *IndexedBatch) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	val, err := b.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(val), nil
+}
@@ -0,0 +1,101 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestIndexedBatch(t *testing.T) {
+	d, cleanup := newDatastore(t, WithValueChecksums(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	committed, deleted := datastore.NewKey("/committed"), datastore.NewKey("/deleted")
+	for _, k := range []datastore.Key{committed, deleted} {
+		if err := d.Put(ctx, k, []byte("stored")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := d.IndexedBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := datastore.NewKey("/staged")
+	if err := b.Put(ctx, staged, []byte("staged value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	// reads see the batch over the committed state, values decoded.
+	if val, err := b.Get(ctx, staged); err != nil || string(val) != "staged value" {
+		t.Fatalf("expected the staged value, got %q, %v", val, err)
+	}
+	if val, err := b.Get(ctx, committed); err != nil || string(val) != "stored" {
+		t.Fatalf("expected the committed value, got %q, %v", val, err)
+	}
+	if _, err := b.Get(ctx, deleted); !errors.Is(err, datastore.ErrNotFound) {
+		t.Fatalf("expected the staged delete to hide the key, got %v", err)
+	}
+	if has, err := b.Has(ctx, deleted); err != nil || has {
+		t.Fatalf("expected the deleted key to be missing, got %v, %v", has, err)
+	}
+	if size, err := b.GetSize(ctx, staged); err != nil || size != len("staged value") {
+		t.Fatalf("expected the staged size, got %d, %v", size, err)
+	}
+
+	// nothing is visible outside of the batch until committed.
+	if has, _ := d.Has(ctx, staged); has {
+		t.Fatal("expected the staged key to wait for the commit")
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(ctx, staged); err != nil || string(val) != "staged value" {
+		t.Fatalf("expected the committed value, got %q, %v", val, err)
+	}
+	if has, _ := d.Has(ctx, deleted); has {
+		t.Fatal("expected the delete to be committed")
+	}
+
+	// plain batches stay write-only.
+	plain, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.(datastore.Read); ok {
+		t.Fatal("expected plain batches not to expose reads")
+	}
+	if _, ok := plain.(interface {
+		Get(context.Context, datastore.Key) ([]byte, error)
+	}); ok {
+		t.Fatal("expected plain batches not to expose Get")
+	}
+}
+
+func TestIndexedBatchCoalescedDeletes(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := datastore.NewKey("/key")
+	if err := d.Put(ctx, key, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.IndexedBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.CoalesceDeletes(2)
+	if err := b.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := b.Has(ctx, key); err != nil || has {
+		t.Fatalf("expected the deferred delete to hide the key, got %v, %v", has, err)
+	}
+}
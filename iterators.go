@@ -0,0 +1,109 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrTooManyIterators is returned by queries that gave up waiting for an
+// iterator, when the limit set with WithMaxConcurrentIterators is reached.
+var ErrTooManyIterators = errors.New("too many open pebble iterators")
+
+// newQueryIter opens an iterator backing a query, first checking with the
+// read circuit breaker, if enabled, and waiting for a slot if the number of
+// iterators is limited. The caller must call releaseQueryIter with probe and
+// the error of closing the iterator once it is closed, unless it recorded the
+// outcome of the probe with the breaker itself, in which case probe is false
+// on release.
+func (d *Datastore) newQueryIter(ctx context.Context, r iterReader, opts *pebble.IterOptions) (iter *pebble.Iterator, probe bool, err error) {
+	if d.breaker != nil {
+		if probe, err = d.breaker.allow(); err != nil {
+			return nil, false, err
+		}
+	}
+	if d.iterSlots != nil {
+		select {
+		case d.iterSlots <- struct{}{}:
+		default:
+			select {
+			case d.iterSlots <- struct{}{}:
+			case <-ctx.Done():
+				if d.breaker != nil {
+					d.breaker.abandon(probe)
+				}
+				return nil, false, fmt.Errorf("%w: %s", ErrTooManyIterators, ctx.Err())
+			}
+		}
+	}
+	iter, err = d.openIter(ctx, r, opts)
+	if err != nil {
+		if d.iterSlots != nil {
+			<-d.iterSlots
+		}
+		if d.breaker != nil {
+			d.breaker.record(probe, err)
+		}
+		return nil, false, err
+	}
+	atomic.AddInt64(&d.openIters, 1)
+	return iter, probe, nil
+}
+
+// openIter opens an iterator, retrying on transient failures as configured
+// with WithIteratorRetries.
+func (d *Datastore) openIter(ctx context.Context, r iterReader, opts *pebble.IterOptions) (*pebble.Iterator, error) {
+	backoff := d.conf.iterRetryBackoff
+	for attempt := 0; ; attempt++ {
+		iter, err := r.NewIterWithContext(ctx, opts)
+		if err == nil || attempt >= d.conf.iterRetries || !retryableIterError(err) {
+			return iter, err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// retryableIterError tells whether opening an iterator may succeed if tried
+// again after failing with err.
+func retryableIterError(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, ErrClosed), errors.Is(err, pebble.ErrClosed):
+		return false
+	case pebble.IsCorruptionError(err):
+		return false
+	}
+	return true
+}
+
+// releaseQueryIter releases an iterator opened with newQueryIter, recording
+// the error of closing it, which reports every error met while iterating,
+// with the read circuit breaker.
+func (d *Datastore) releaseQueryIter(probe bool, err error) {
+	if d.breaker != nil {
+		d.breaker.record(probe, err)
+	}
+	atomic.AddInt64(&d.openIters, -1)
+	if d.iterSlots != nil {
+		<-d.iterSlots
+	}
+}
+
+// OpenIterators returns the number of iterators currently open for queries:
+// a query holds one until its results are exhausted or closed. A count that
+// keeps growing points at results that are never closed.
+func (d *Datastore) OpenIterators() int64 {
+	return atomic.LoadInt64(&d.openIters)
+}
@@ -0,0 +1,140 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestMaxConcurrentIterators(t *testing.T) {
+	d, cleanup := newDatastore(t, WithMaxConcurrentIterators(2))
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/iter/%03d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// results that are not consumed hold on to their iterator.
+	var open []query.Results
+	for i := 0; i < 2; i++ {
+		res, err := d.Query(ctx, query.Query{Prefix: "/iter"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		open = append(open, res)
+	}
+	if n := d.OpenIterators(); n != 2 {
+		t.Fatalf("expected 2 open iterators, got %d", n)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.Query(timeout, query.Query{Prefix: "/iter"}); !errors.Is(err, ErrTooManyIterators) {
+		t.Fatalf("expected ErrTooManyIterators, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := d.Query(ctx, query.Query{Prefix: "/iter"})
+		if err == nil {
+			_, err = res.Rest()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the query to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := open[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing results to unblock the query")
+	}
+
+	if err := open[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.OpenIterators(); n != 0 {
+		t.Fatalf("expected no open iterators, got %d", n)
+	}
+}
+
+// flakyReader fails to open the first iterators with err.
+type flakyReader struct {
+	iterReader
+	fails int
+	err   error
+	calls int
+}
+
+func (r *flakyReader) NewIterWithContext(ctx context.Context, o *pebble.IterOptions) (*pebble.Iterator, error) {
+	r.calls++
+	if r.calls <= r.fails {
+		return nil, r.err
+	}
+	return r.iterReader.NewIterWithContext(ctx, o)
+}
+
+func TestIteratorRetries(t *testing.T) {
+	ctx := context.Background()
+	errTransient := errors.New("transient failure")
+	for _, tc := range []struct {
+		name    string
+		retries int
+		fails   int
+		err     error
+		calls   int
+		ok      bool
+	}{
+		{"no retries", 0, 1, errTransient, 1, false},
+		{"recovers", 3, 3, errTransient, 4, true},
+		{"gives up", 3, 4, errTransient, 4, false},
+		{"corruption", 3, 1, pebble.ErrCorruption, 1, false},
+		{"cancelled", 3, 1, context.Canceled, 1, false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, WithIteratorRetries(tc.retries, time.Millisecond))
+			defer cleanup()
+			if err := d.Put(ctx, datastore.NewKey("/retry"), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+
+			r := &flakyReader{iterReader: d.db, fails: tc.fails, err: tc.err}
+			res, err := d.query(ctx, r, query.Query{}, pebble.IterOptions{})
+			if r.calls != tc.calls {
+				t.Fatalf("expected %d attempts, got %d", tc.calls, r.calls)
+			}
+			if !tc.ok {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("expected the query to succeed, got %d entries and %v", len(entries), err)
+			}
+		})
+	}
+}
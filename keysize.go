@@ -0,0 +1,19 @@
+package pebbleds
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeyTooLarge is returned by writes of keys larger than the limit set with
+// WithMaxKeySize.
+var ErrKeyTooLarge = errors.New("pebble datastore key too large")
+
+// checkKeySize fails with ErrKeyTooLarge if the key is larger than the
+// configured limit.
+func (d *Datastore) checkKeySize(key []byte) error {
+	if max := d.conf.maxKeySize; max > 0 && len(key) > max {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), max)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestMaxKeySize(t *testing.T) {
+	ctx := context.Background()
+	large := datastore.NewKey("/" + strings.Repeat("k", 2048))
+	small := datastore.NewKey("/small")
+
+	// no limit by default.
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+	if err := d.Put(ctx, large, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, cleanup = newDatastore(t, WithMaxKeySize(1024))
+	defer cleanup()
+	if err := d.Put(ctx, large, []byte("val")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := d.Put(ctx, small, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, large, []byte("val")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := d.Has(ctx, large); err != nil || has {
+		t.Fatalf("expected the large key not to be written, got %v, %v", has, err)
+	}
+	// oversized keys can still be deleted.
+	if err := d.Delete(ctx, large); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,432 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// The LRU index lives under the reserved prefix, outside of the datastore
+// keyspace.
+const (
+	// lruAccessName names the access order: tick (8 bytes, big endian)
+	// followed by the key, with no value.
+	lruAccessName = "lru/a/"
+	// lruKeyName names, for every key, its last access tick and the size of
+	// its entry (8 bytes each, big endian).
+	lruKeyName = "lru/k/"
+)
+
+// LRUDatastore bounds the size of a pebble Datastore by evicting the least
+// recently used keys once it grows past a cap, turning it into a persistent
+// cache.
+//
+// Pebble does not track accesses, so the LRUDatastore keeps an access-order
+// index in the underlying Datastore, outside of its keyspace. Every Get hit
+// rewrites the index entry of its key, and every Put and Delete updates it
+// within the same atomic batch as the write, so tracking costs about two
+// extra small writes per access. Has, GetSize and Query do not count as
+// accesses. Puts, deletes and evictions maintain the secondary indexes and
+// metadata of the underlying Datastore like its own writes. The underlying
+// Datastore must only be written through the LRUDatastore.
+//
+// The size is estimated as the sum of the lengths of the keys and values
+// stored, not counting the index nor Pebble's own overhead, so it is only an
+// approximation of the disk usage.
+type LRUDatastore struct {
+	ds      *Datastore
+	maxSize uint64
+
+	// accessPrefix and keyPrefix prefix the access order and the entries of
+	// the index.
+	accessPrefix []byte
+	keyPrefix    []byte
+
+	// mu serializes writes, to keep the index in line with the data.
+	mu   sync.Mutex
+	tick uint64
+	size uint64
+
+	evict     chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ ds.Datastore = (*LRUDatastore)(nil)
+var _ ds.PersistentDatastore = (*LRUDatastore)(nil)
+
+// NewLRUDatastore creates an LRUDatastore on top of the given Datastore,
+// evicting entries in the background whenever their total size exceeds
+// maxSize bytes. The size is computed from the index on creation, reading it
+// whole. The LRUDatastore takes ownership of d, closing it on Close.
+func NewLRUDatastore(d *Datastore, maxSize uint64) (*LRUDatastore, error) {
+	l := &LRUDatastore{
+		ds:           d,
+		maxSize:      maxSize,
+		accessPrefix: d.reservedKey(lruAccessName),
+		keyPrefix:    d.reservedKey(lruKeyName),
+		evict:        make(chan struct{}, 1),
+		closing:      make(chan struct{}),
+	}
+
+	iter, err := d.db.NewIter(&pebble.IterOptions{
+		LowerBound: l.keyPrefix,
+		UpperBound: prefixUpperBound(l.keyPrefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		tick, size := decodeLRUEntry(iter.Value())
+		if tick > l.tick {
+			l.tick = tick
+		}
+		l.size += size
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("pebble error reading lru index: %w", err)
+	}
+
+	l.wg.Add(1)
+	go l.evictLoop()
+	l.maybeEvict()
+	return l, nil
+}
+
+// Datastore returns the underlying pebble Datastore.
+func (l *LRUDatastore) Datastore() *Datastore {
+	return l.ds
+}
+
+// Size returns the estimated size of the stored entries, in bytes.
+func (l *LRUDatastore) Size() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+func (l *LRUDatastore) indexKey(key []byte) []byte {
+	return append(append([]byte(nil), l.keyPrefix...), key...)
+}
+
+func (l *LRUDatastore) accessKey(tick uint64, key []byte) []byte {
+	k := make([]byte, 0, len(l.accessPrefix)+8+len(key))
+	k = append(k, l.accessPrefix...)
+	k = binary.BigEndian.AppendUint64(k, tick)
+	return append(k, key...)
+}
+
+func encodeLRUEntry(tick, size uint64) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, tick), size)
+}
+
+func decodeLRUEntry(v []byte) (tick, size uint64) {
+	if len(v) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:])
+}
+
+// lookup returns the index entry of the key, if any. The caller must hold
+// l.mu.
+func (l *LRUDatastore) lookup(key []byte) (tick, size uint64, found bool, err error) {
+	v, closer, err := l.ds.db.Get(l.indexKey(key))
+	switch {
+	case errors.Is(err, pebble.ErrNotFound):
+		return 0, 0, false, nil
+	case err != nil:
+		return 0, 0, false, fmt.Errorf("pebble error reading lru index: %w", err)
+	}
+	tick, size = decodeLRUEntry(v)
+	return tick, size, true, closer.Close()
+}
+
+// touch records an access to the key within the batch, moving it to the most
+// recently used position. The caller must hold l.mu.
+func (l *LRUDatastore) touch(b *pebble.Batch, key []byte, oldTick uint64, found bool, size uint64) error {
+	if found {
+		if err := b.Delete(l.accessKey(oldTick, key), nil); err != nil {
+			return err
+		}
+	}
+	l.tick++
+	if err := b.Set(l.accessKey(l.tick, key), nil, nil); err != nil {
+		return err
+	}
+	return b.Set(l.indexKey(key), encodeLRUEntry(l.tick, size), nil)
+}
+
+// lockIndexes takes the index lock of the Datastore if indexes are registered,
+// returning the function releasing it.
+func (l *LRUDatastore) lockIndexes() func() {
+	if atomic.LoadInt32(&l.ds.indexed) == 0 {
+		return func() {}
+	}
+	l.ds.indexMu.Lock()
+	return l.ds.indexMu.Unlock
+}
+
+// maintain adds to the batch the index and metadata updates of the writes,
+// as the Datastore does for its own. The caller must hold the lock of
+// lockIndexes.
+func (l *LRUDatastore) maintain(b *pebble.Batch, ops []indexOp) error {
+	if atomic.LoadInt32(&l.ds.indexed) != 0 {
+		if err := l.ds.applyIndexOps(b, ops); err != nil {
+			return err
+		}
+	}
+	if l.ds.conf.metadata {
+		for _, op := range ops {
+			if err := l.ds.metaWrite(b, op.key, op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maybeEvict wakes up the evictor if the size is over the cap.
+func (l *LRUDatastore) maybeEvict() {
+	if l.Size() <= l.maxSize {
+		return
+	}
+	select {
+	case l.evict <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LRUDatastore) evictLoop() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.evict:
+			if err := l.Evict(context.Background()); err != nil {
+				l.ds.log.Errorf("pebble lru eviction failed: %s", err)
+			}
+		case <-l.closing:
+			return
+		}
+	}
+}
+
+// Evict deletes the least recently used entries until the size is within the
+// cap. It runs in the background when needed, but can be called to evict
+// synchronously.
+func (l *LRUDatastore) Evict(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size <= l.maxSize {
+		return nil
+	}
+
+	iter, err := l.ds.db.NewIterWithContext(ctx, &pebble.IterOptions{
+		LowerBound: l.accessPrefix,
+		UpperBound: prefixUpperBound(l.accessPrefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	defer l.lockIndexes()()
+	b := l.ds.db.NewBatch()
+	defer b.Close()
+	size := l.size
+	var ops []indexOp
+	for iter.First(); iter.Valid() && size > l.maxSize; iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := bytes.Clone(iter.Key()[len(l.accessPrefix)+8:])
+		_, entrySize, found, err := l.lookup(key)
+		if err != nil {
+			return err
+		}
+		if err := b.Delete(key, nil); err != nil {
+			return err
+		}
+		if err := b.Delete(iter.Key(), nil); err != nil {
+			return err
+		}
+		if err := b.Delete(l.indexKey(key), nil); err != nil {
+			return err
+		}
+		if found {
+			size -= entrySize
+		}
+		ops = append(ops, indexOp{key: ds.RawKey(string(key)), delete: true})
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("pebble error reading lru index: %w", err)
+	}
+	if err := l.maintain(b, ops); err != nil {
+		return fmt.Errorf("pebble error during lru eviction: %w", err)
+	}
+	if err := b.Commit(l.ds.writeOptions()); err != nil {
+		return fmt.Errorf("pebble error during lru eviction: %w", err)
+	}
+	l.ds.bumpGeneration()
+	l.size = size
+	return nil
+}
+
+func (l *LRUDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	val, err := l.ds.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	k := key.Bytes()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tick, size, found, err := l.lookup(k)
+	if err != nil || !found {
+		// evicted or deleted in the meantime; nothing to track.
+		return val, err
+	}
+	b := l.ds.db.NewBatch()
+	defer b.Close()
+	if err := l.touch(b, k, tick, found, size); err != nil {
+		return nil, fmt.Errorf("pebble error updating lru index: %w", err)
+	}
+	if err := b.Commit(l.ds.writeOptions()); err != nil {
+		return nil, fmt.Errorf("pebble error updating lru index: %w", err)
+	}
+	return val, nil
+}
+
+func (l *LRUDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return l.ds.Has(ctx, key)
+}
+
+func (l *LRUDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return l.ds.GetSize(ctx, key)
+}
+
+func (l *LRUDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	k := key.Bytes()
+	if err := l.ds.checkKeySize(k); err != nil {
+		return err
+	}
+	if err := l.ds.checkUserKey(k); err != nil {
+		return err
+	}
+	if err := l.put(key, value); err != nil {
+		return err
+	}
+	l.maybeEvict()
+	return nil
+}
+
+// put writes the value along with its index entry, subject to the
+// append-only check like Datastore.Put.
+func (l *LRUDatastore) put(key ds.Key, value []byte) error {
+	k := key.Bytes()
+	size := uint64(len(k) + len(value))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if g := l.ds.appendOnly; g != nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if err := g.check(k); err != nil {
+			return err
+		}
+	}
+	defer l.lockIndexes()()
+	tick, oldSize, found, err := l.lookup(k)
+	if err != nil {
+		return err
+	}
+	b := l.ds.db.NewBatch()
+	defer b.Close()
+	err = b.Set(k, l.ds.encodeValue(value), nil)
+	if err == nil {
+		err = l.touch(b, k, tick, found, size)
+	}
+	if err == nil {
+		err = l.maintain(b, []indexOp{{key: key, value: value}})
+	}
+	if err == nil {
+		err = b.Commit(l.ds.writeOptions())
+	}
+	if err != nil {
+		return fmt.Errorf("pebble error during set: %w", err)
+	}
+	if g := l.ds.appendOnly; g != nil {
+		g.advance(k)
+	}
+	l.ds.bumpGeneration()
+	l.size += size - oldSize
+	return nil
+}
+
+func (l *LRUDatastore) Delete(ctx context.Context, key ds.Key) error {
+	k := key.Bytes()
+	if err := l.ds.checkUserKey(k); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.lockIndexes()()
+	tick, size, found, err := l.lookup(k)
+	if err != nil {
+		return err
+	}
+	b := l.ds.db.NewBatch()
+	defer b.Close()
+	err = b.Delete(k, nil)
+	if err == nil && found {
+		err = b.Delete(l.accessKey(tick, k), nil)
+		if err == nil {
+			err = b.Delete(l.indexKey(k), nil)
+		}
+	}
+	if err == nil {
+		err = l.maintain(b, []indexOp{{key: key, delete: true}})
+	}
+	if err == nil {
+		err = b.Commit(l.ds.writeOptions())
+	}
+	if err != nil {
+		return fmt.Errorf("pebble error during delete: %w", err)
+	}
+	l.ds.bumpGeneration()
+	l.size -= size
+	return nil
+}
+
+// Query runs the query against the underlying Datastore, which leaves the LRU
+// index out like every internal key. Queries do not count as accesses.
+func (l *LRUDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return l.ds.Query(ctx, q)
+}
+
+func (l *LRUDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return l.ds.Sync(ctx, prefix)
+}
+
+// DiskUsage returns the disk usage of the underlying Datastore, index
+// included.
+func (l *LRUDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return l.ds.DiskUsage(ctx)
+}
+
+// Close stops the evictor and closes the underlying Datastore.
+func (l *LRUDatastore) Close() error {
+	l.closeOnce.Do(func() { close(l.closing) })
+	l.wg.Wait()
+	return l.ds.Close()
+}
@@ -0,0 +1,182 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func newLRUDatastore(t *testing.T, path string, maxSize uint64) *LRUDatastore {
+	t.Helper()
+
+	d, err := NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLRUDatastore(d, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLRUDatastoreSuite(t *testing.T) {
+	l := newLRUDatastore(t, t.TempDir(), 1<<30)
+	defer l.Close()
+
+	dstest.SubtestAll(t, l)
+}
+
+func TestLRUDatastoreEviction(t *testing.T) {
+	const (
+		maxSize   = 64 << 10
+		entrySize = 1 << 10
+	)
+	path := t.TempDir()
+	l := newLRUDatastore(t, path, maxSize)
+
+	ctx := context.Background()
+	key := func(i int) datastore.Key {
+		return datastore.NewKey(fmt.Sprintf("/lru/%04d", i))
+	}
+	hot := key(0)
+	for i := 0; i < 500; i++ {
+		if err := l.Put(ctx, key(i), make([]byte, entrySize)); err != nil {
+			t.Fatal(err)
+		}
+		// keep the first key in use.
+		if _, err := l.Get(ctx, hot); err != nil {
+			t.Fatalf("hot key evicted after %d puts: %s", i, err)
+		}
+		if err := l.Evict(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if size := l.Size(); size > maxSize {
+			t.Fatalf("size %d over the cap", size)
+		}
+	}
+
+	// the most recent keys survive, the old ones are gone.
+	for i, expect := range map[int]bool{1: false, 100: false, 498: true, 499: true} {
+		if has, _ := l.Has(ctx, key(i)); has != expect {
+			t.Fatalf("expected presence of %s to be %t", key(i), expect)
+		}
+	}
+
+	// the index is invisible to queries.
+	res, err := l.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entriesSize uint64
+	for _, e := range entries {
+		entriesSize += uint64(len(e.Key) + entrySize)
+	}
+	if entriesSize != l.Size() {
+		t.Fatalf("expected size %d to match the %d entries, got %d", l.Size(), len(entries), entriesSize)
+	}
+
+	// the size survives a restart.
+	size := l.Size()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = newLRUDatastore(t, path, maxSize)
+	defer l.Close()
+	if l.Size() != size {
+		t.Fatalf("expected size %d after reopening, got %d", size, l.Size())
+	}
+}
+
+func TestLRUDatastoreBackgroundEviction(t *testing.T) {
+	const maxSize = 16 << 10
+	l := newLRUDatastore(t, t.TempDir(), maxSize)
+	defer l.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := l.Put(ctx, datastore.NewKey(fmt.Sprintf("/lru/%04d", i)), make([]byte, 1<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Size() > maxSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("size still over the cap: %d", l.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLRUDatastoreIndexesAndMetadata(t *testing.T) {
+	d, cleanup := newDatastore(t, WithMetadata(true))
+	defer cleanup()
+	ctx := context.Background()
+	err := d.RegisterIndex("value", func(key datastore.Key, value []byte) []datastore.Key {
+		return []datastore.Key{datastore.NewKey(string(value))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for a single entry.
+	l, err := NewLRUDatastore(d, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	expect := func(value string, keys ...string) {
+		t.Helper()
+		got, err := d.QueryIndex(ctx, "value", datastore.NewKey(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotKeys := make([]string, len(got))
+		for i, k := range got {
+			gotKeys[i] = k.String()
+		}
+		if fmt.Sprint(gotKeys) != fmt.Sprint(keys) {
+			t.Fatalf("expected %s to index %v, got %v", value, keys, gotKeys)
+		}
+	}
+
+	a, b := datastore.NewKey("/a"), datastore.NewKey("/b")
+	x, y := strings.Repeat("x", 12), strings.Repeat("y", 12)
+	if err := d.PutWithMeta(ctx, a, []byte("old"), []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(ctx, a, []byte(x)); err != nil {
+		t.Fatal(err)
+	}
+	expect("old")
+	expect(x, "/a")
+	if _, meta, err := d.GetWithMeta(ctx, a); err != nil || meta != nil {
+		t.Fatalf("expected the put to replace the metadata, got %q, %v", meta, err)
+	}
+
+	// evicting /a drops its index entry.
+	if err := l.Put(ctx, b, []byte(y)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Evict(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(x)
+	expect(y, "/b")
+
+	if err := l.Delete(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	expect(y)
+}
@@ -0,0 +1,148 @@
+package pebbleds
+
+import (
+	"container/heap"
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// MergeQuery runs the query against several stores holding disjoint parts of
+// a keyspace, e.g. shards, and merges their results into a single result set,
+// as if they were returned by a single store holding every key.
+//
+// Every store is queried in key order, and the results are merged by pulling
+// the smallest key across them, so key orders come out globally ordered
+// without buffering. Filters apply per store, while offset and limit apply to
+// the merged stream. Orders other than by key are applied in memory over the
+// merged results. Keys present in several stores are returned once per store;
+// see DeduplicateKeys.
+//
+// An error returned by any of the stores ends the merged results, as its last
+// result.
+func MergeQuery(ctx context.Context, q query.Query, stores ...ds.Read) (query.Results, error) {
+	base := q
+	base.Offset, base.Limit = 0, 0
+	naive := query.Query{Offset: q.Offset, Limit: q.Limit}
+	descending := false
+	switch {
+	case len(q.Orders) == 0:
+		base.Orders = []query.Order{query.OrderByKey{}}
+	case len(q.Orders) == 1 && isOrderByKey(q.Orders[0]):
+		_, descending = q.Orders[0].(query.OrderByKeyDescending)
+		if _, ok := q.Orders[0].(*query.OrderByKeyDescending); ok {
+			descending = true
+		}
+	default:
+		base.Orders, naive.Orders = []query.Order{query.OrderByKey{}}, q.Orders
+	}
+	if naive.Orders == nil && q.Limit > 0 {
+		// no store needs to return more than the merged results can use.
+		base.Limit = q.Offset + q.Limit
+	}
+
+	m := &mergeHeap{descending: descending}
+	for _, s := range stores {
+		res, err := s.Query(ctx, base)
+		if err != nil {
+			_ = m.close()
+			return nil, err
+		}
+		m.all = append(m.all, res)
+	}
+
+	started, done := false, false
+	var failed error
+	// pull moves the cursor to the next result of its store, pushing it back
+	// onto the heap unless the store is exhausted or failed.
+	pull := func(c *mergeCursor) {
+		r, ok := c.res.NextSync()
+		switch {
+		case !ok:
+		case r.Error != nil:
+			failed = r.Error
+		default:
+			c.current = r
+			heap.Push(m, c)
+		}
+	}
+	merged := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			if !started {
+				started = true
+				for i, res := range m.all {
+					pull(&mergeCursor{index: i, res: res})
+				}
+			}
+			if done {
+				return query.Result{}, false
+			}
+			if failed != nil {
+				done = true
+				return query.Result{Error: failed}, true
+			}
+			if m.Len() == 0 {
+				return query.Result{}, false
+			}
+			c := heap.Pop(m).(*mergeCursor)
+			r := c.current
+			pull(c)
+			return r, true
+		},
+		Close: m.close,
+	})
+	return query.NaiveQueryApply(naive, merged), nil
+}
+
+func isOrderByKey(o query.Order) bool {
+	switch o.(type) {
+	case query.OrderByKey, *query.OrderByKey, query.OrderByKeyDescending, *query.OrderByKeyDescending:
+		return true
+	}
+	return false
+}
+
+// mergeCursor is the next result of one of the merged stores.
+type mergeCursor struct {
+	index   int
+	res     query.Results
+	current query.Result
+}
+
+// mergeHeap orders the cursors by their next key, breaking ties by store.
+type mergeHeap struct {
+	descending bool
+	all        []query.Results
+	cursors    []*mergeCursor
+}
+
+func (m *mergeHeap) close() error {
+	var firstErr error
+	for _, res := range m.all {
+		if err := res.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *mergeHeap) Len() int { return len(m.cursors) }
+
+func (m *mergeHeap) Less(i, j int) bool {
+	a, b := m.cursors[i], m.cursors[j]
+	if a.current.Key != b.current.Key {
+		return (a.current.Key < b.current.Key) != m.descending
+	}
+	return a.index < b.index
+}
+
+func (m *mergeHeap) Swap(i, j int) { m.cursors[i], m.cursors[j] = m.cursors[j], m.cursors[i] }
+
+func (m *mergeHeap) Push(x any) { m.cursors = append(m.cursors, x.(*mergeCursor)) }
+
+func (m *mergeHeap) Pop() any {
+	c := m.cursors[len(m.cursors)-1]
+	m.cursors = m.cursors[:len(m.cursors)-1]
+	return c
+}
@@ -0,0 +1,146 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestMergeQuery(t *testing.T) {
+	ctx := context.Background()
+	single, cleanup := newDatastore(t)
+	defer cleanup()
+	shards := make([]datastore.Read, 3)
+	for i := range shards {
+		d, cleanup := newDatastore(t)
+		defer cleanup()
+		shards[i] = d
+	}
+
+	for i := 0; i < 200; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/m/%03d", i))
+		value := []byte(fmt.Sprint(i % 7))
+		if err := single.Put(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		h := fnv.New32a()
+		_, _ = h.Write(key.Bytes())
+		if err := shards[h.Sum32()%3].(*Datastore).Put(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, q := range map[string]query.Query{
+		"by key":          {Prefix: "/m", Orders: []query.Order{query.OrderByKey{}}},
+		"descending":      {Orders: []query.Order{query.OrderByKeyDescending{}}},
+		"offset limit":    {Orders: []query.Order{query.OrderByKey{}}, Offset: 17, Limit: 42},
+		"desc limit":      {Orders: []query.Order{query.OrderByKeyDescending{}}, Offset: 3, Limit: 10},
+		"filter":          {Orders: []query.Order{query.OrderByKey{}}, Filters: []query.Filter{query.FilterValueCompare{Op: query.Equal, Value: []byte("3")}}, Limit: 5},
+		"by value":        {Orders: []query.Order{query.OrderByValue{}, query.OrderByKey{}}, Limit: 20},
+		"keys only":       {KeysOnly: true, Orders: []query.Order{query.OrderByKey{}}, Offset: 190},
+		"offset past end": {Orders: []query.Order{query.OrderByKey{}}, Offset: 500},
+	} {
+		q := q
+		t.Run(name, func(t *testing.T) {
+			want := queryEntries(t, single, q)
+			res, err := MergeQuery(ctx, q, shards...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("expected %d entries, got %d", len(want), len(got))
+			}
+			for i := range want {
+				if got[i].Key != want[i].Key || string(got[i].Value) != string(want[i].Value) {
+					t.Fatalf("entry %d: expected %s=%q, got %s=%q", i, want[i].Key, want[i].Value, got[i].Key, got[i].Value)
+				}
+			}
+		})
+	}
+}
+
+func queryEntries(t *testing.T, d *Datastore, q query.Query) []query.Entry {
+	t.Helper()
+	res, err := d.Query(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// failingRead returns an error after the results of the wrapped Datastore.
+type failingRead struct {
+	*Datastore
+	err error
+}
+
+func (f failingRead) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	res, err := f.Datastore.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	failed := false
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			if r, ok := res.NextSync(); ok {
+				return r, ok
+			}
+			if failed {
+				return query.Result{}, false
+			}
+			failed = true
+			return query.Result{Error: f.err}, true
+		},
+		Close: res.Close,
+	}), nil
+}
+
+func TestMergeQueryErrors(t *testing.T) {
+	ctx := context.Background()
+	a, cleanup := newDatastore(t)
+	defer cleanup()
+	b, cleanup := newDatastore(t)
+	defer cleanup()
+	for i := 0; i < 10; i++ {
+		if err := a.Put(ctx, datastore.NewKey(fmt.Sprintf("/a/%d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ctx, datastore.NewKey(fmt.Sprintf("/b/%d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errShard := errors.New("shard failure")
+	res, err := MergeQuery(ctx, query.Query{}, a, failingRead{Datastore: b, err: errShard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	var last error
+	for r := range res.Next() {
+		if r.Error != nil {
+			last = r.Error
+			continue
+		}
+		n++
+	}
+	if !errors.Is(last, errShard) {
+		t.Fatalf("expected the shard error to be surfaced, got %v", last)
+	}
+	if n != 20 {
+		t.Fatalf("expected the results before the failure, got %d", n)
+	}
+}
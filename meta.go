@@ -0,0 +1,133 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// metaName names the metadata stored alongside values, under the reserved
+// prefix, followed by the key of the value.
+const metaName = "meta/"
+
+// ErrMetadataDisabled is returned by the metadata methods unless metadata
+// was enabled with WithMetadata.
+var ErrMetadataDisabled = errors.New("pebble datastore metadata is disabled")
+
+// batchedWrites tells whether point writes must go through a batch, to
+// update indexes or metadata along with them.
+func (d *Datastore) batchedWrites() bool {
+	return d.conf.metadata || atomic.LoadInt32(&d.indexed) != 0
+}
+
+func (d *Datastore) metaKey(key ds.Key) []byte {
+	return append(d.reservedKey(metaName), key.String()...)
+}
+
+// metaWrite adds to the batch the metadata update of the write: storing the
+// metadata given along with the value, if any, or removing the metadata of
+// the previous value otherwise.
+func (d *Datastore) metaWrite(b *pebble.Batch, key ds.Key, op indexOp) error {
+	if op.hasMeta && !op.delete {
+		return b.Set(d.metaKey(key), d.encodeValue(op.meta), nil)
+	}
+	return b.Delete(d.metaKey(key), nil)
+}
+
+// PutWithMeta stores the value along with a small metadata sidecar, such as
+// its content type or origin, atomically. The metadata lives under the
+// reserved prefix, apart from the value: it is not returned by Get nor Query,
+// but by GetWithMeta and QueryMeta. It is removed along with the value by
+// Delete, and replaced by the next Put, which removes it unless it is a
+// PutWithMeta.
+//
+// Metadata requires WithMetadata, which makes every Put and Delete write the
+// metadata key along with the value; this fails with ErrMetadataDisabled
+// otherwise.
+func (d *Datastore) PutWithMeta(ctx context.Context, key ds.Key, value, meta []byte) error {
+	if !d.conf.metadata {
+		return ErrMetadataDisabled
+	}
+	if err := d.checkKeySize(key.Bytes()); err != nil {
+		return err
+	}
+	if err := d.checkUserKey(key.Bytes()); err != nil {
+		return err
+	}
+	d.condMu.RLock()
+	defer d.condMu.RUnlock()
+	err := d.writeBatched(key, indexOp{key: key, value: value, meta: meta, hasMeta: true}, false)
+	if err != nil {
+		return fmt.Errorf("pebble error during set: %w", err)
+	}
+	d.bumpGeneration()
+	return nil
+}
+
+// GetWithMeta returns the value of the key along with its metadata, read
+// from the same point in time. The metadata is nil if the value was stored
+// without any. It fails with ds.ErrNotFound if the key is missing.
+func (d *Datastore) GetWithMeta(ctx context.Context, key ds.Key) (value, meta []byte, err error) {
+	if !d.conf.metadata {
+		return nil, nil, ErrMetadataDisabled
+	}
+	snap := d.db.NewSnapshot()
+	defer snap.Close()
+
+	value, err = d.getFrom(snap, key.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err = d.read(snap, d.metaKey(key))
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return value, nil, nil
+	case err != nil:
+		return nil, nil, err
+	}
+	return value, meta, nil
+}
+
+// QueryMeta runs the query over the metadata of the values rather than the
+// values themselves: the entries are keyed like the values they belong to,
+// and hold their metadata. Values stored without metadata are skipped. The
+// prefix is interpreted as in Query; filters, orders, offset and limit are
+// applied in memory over the metadata entries.
+func (d *Datastore) QueryMeta(ctx context.Context, q query.Query) (query.Results, error) {
+	if !d.conf.metadata {
+		return nil, ErrMetadataDisabled
+	}
+	prefix := string(d.reservedKey(metaName))
+	lower, upper := d.prefixBounds(q.Prefix)
+	lower = append([]byte(prefix), lower...)
+	if upper != nil {
+		upper = append([]byte(prefix), upper...)
+	} else {
+		upper = prefixUpperBound([]byte(prefix))
+	}
+
+	base := query.Query{KeysOnly: q.KeysOnly, ReturnsSizes: q.ReturnsSizes}
+	res, err := d.query(ctx, d.queryReader(), base, pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return nil, err
+	}
+	stripped := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			r, ok := res.NextSync()
+			if ok && r.Error == nil {
+				r.Key = strings.TrimPrefix(r.Key, prefix)
+			}
+			return r, ok
+		},
+		Close: res.Close,
+	})
+	naive := q
+	naive.Prefix = ""
+	return query.NaiveQueryApply(naive, stripped), nil
+}
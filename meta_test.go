@@ -0,0 +1,109 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestMetadata(t *testing.T) {
+	d, cleanup := newDatastore(t, WithMetadata(true))
+	defer cleanup()
+
+	ctx := context.Background()
+	check := func(key string, value, meta string, found bool) {
+		t.Helper()
+		v, m, err := d.GetWithMeta(ctx, datastore.NewKey(key))
+		if !found {
+			if !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("%s: expected not found, got %v", key, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != value || string(m) != meta {
+			t.Fatalf("%s: got %q/%q, expected %q/%q", key, v, m, value, meta)
+		}
+	}
+
+	if err := d.PutWithMeta(ctx, datastore.NewKey("/a"), []byte("1"), []byte("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithMeta(ctx, datastore.NewKey("/b"), []byte("2"), []byte("image/png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	check("/a", "1", "text/plain", true)
+	check("/c", "3", "", true)
+
+	// the metadata is hidden from regular reads.
+	if v, err := d.Get(ctx, datastore.NewKey("/a")); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	entries := queryEntries(t, d, query.Query{})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+
+	res, err := d.QueryMeta(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metas, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 || metas[0].Key != "/a" || string(metas[0].Value) != "text/plain" ||
+		metas[1].Key != "/b" || string(metas[1].Value) != "image/png" {
+		t.Fatalf("unexpected metadata entries: %v", metas)
+	}
+
+	// a plain put drops the metadata, deletes remove both.
+	if err := d.Put(ctx, datastore.NewKey("/a"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	check("/a", "4", "", true)
+	if err := d.Delete(ctx, datastore.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	check("/b", "", "", false)
+
+	if err := d.PutWithMeta(ctx, datastore.NewKey("/d"), []byte("5"), []byte("m")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, datastore.NewKey("/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err = d.QueryMeta(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metas, err := res.Rest(); err != nil || len(metas) != 0 {
+		t.Fatalf("expected no metadata left, got %v, %v", metas, err)
+	}
+}
+
+func TestMetadataDisabled(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	err := d.PutWithMeta(ctx, datastore.NewKey("/a"), []byte("1"), []byte("m"))
+	if !errors.Is(err, ErrMetadataDisabled) {
+		t.Fatalf("expected ErrMetadataDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	log "github.com/ipfs/go-log/v2"
+)
+
+// MirrorPolicy defines how a MirroredDatastore handles failed writes to its
+// secondary datastore.
+type MirrorPolicy int
+
+const (
+	// MirrorBestEffort logs failed writes to the secondary and carries on, so
+	// the secondary never fails operations on the primary.
+	MirrorBestEffort MirrorPolicy = iota
+	// MirrorStrict returns failed writes to the secondary to the caller. As
+	// the primary is written first, the write has been applied to the
+	// primary when that happens.
+	MirrorStrict
+)
+
+// MirroredDatastore dual-writes to a primary and a secondary datastore, while
+// only ever reading from the primary. It is meant for live migrations between
+// datastore backends: once the secondary holds a full copy of the data
+// (backfilled separately), callers can cut over to it without downtime.
+//
+// Writes are applied to the primary first, and only forwarded to the
+// secondary if they succeeded there.
+type MirroredDatastore struct {
+	primary   ds.Datastore
+	secondary ds.Datastore
+	policy    MirrorPolicy
+	log       log.StandardLogger
+}
+
+var _ ds.Datastore = (*MirroredDatastore)(nil)
+var _ ds.Batching = (*MirroredDatastore)(nil)
+
+// NewMirroredDatastore creates a MirroredDatastore mirroring writes on primary
+// to secondary, handling secondary failures according to policy. Failures are
+// logged with the logger of the primary if it is a pebble Datastore (see
+// WithLogger), and with the "pebble" go-log logger otherwise.
+func NewMirroredDatastore(primary, secondary ds.Datastore, policy MirrorPolicy) *MirroredDatastore {
+	l := log.StandardLogger(logger)
+	if d, ok := primary.(*Datastore); ok {
+		l = d.log
+	}
+	return &MirroredDatastore{
+		primary:   primary,
+		secondary: secondary,
+		policy:    policy,
+		log:       l,
+	}
+}
+
+// secondaryErr handles an error on the secondary according to the policy.
+func (m *MirroredDatastore) secondaryErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if m.policy == MirrorStrict {
+		return fmt.Errorf("mirrored %s failed on secondary: %w", op, err)
+	}
+	m.log.Warnf("mirrored %s failed on secondary: %s", op, err)
+	return nil
+}
+
+func (m *MirroredDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return m.primary.Get(ctx, key)
+}
+
+func (m *MirroredDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return m.primary.Has(ctx, key)
+}
+
+func (m *MirroredDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return m.primary.GetSize(ctx, key)
+}
+
+func (m *MirroredDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return m.primary.Query(ctx, q)
+}
+
+func (m *MirroredDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := m.primary.Put(ctx, key, value); err != nil {
+		return err
+	}
+	return m.secondaryErr("put", m.secondary.Put(ctx, key, value))
+}
+
+func (m *MirroredDatastore) Delete(ctx context.Context, key ds.Key) error {
+	if err := m.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	return m.secondaryErr("delete", m.secondary.Delete(ctx, key))
+}
+
+func (m *MirroredDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	if err := m.primary.Sync(ctx, prefix); err != nil {
+		return err
+	}
+	return m.secondaryErr("sync", m.secondary.Sync(ctx, prefix))
+}
+
+// Batch returns a batch mirrored on both datastores, which must both support
+// batching.
+func (m *MirroredDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	pb, ok := m.primary.(ds.Batching)
+	if !ok {
+		return nil, ds.ErrBatchUnsupported
+	}
+	sb, ok := m.secondary.(ds.Batching)
+	if !ok {
+		return nil, ds.ErrBatchUnsupported
+	}
+
+	primary, err := pb.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := sb.Batch(ctx)
+	if err != nil {
+		if err := m.secondaryErr("batch", err); err != nil {
+			return nil, err
+		}
+		// carry on with the primary alone.
+		return primary, nil
+	}
+	return &mirroredBatch{m: m, primary: primary, secondary: secondary}, nil
+}
+
+// Close closes both datastores.
+func (m *MirroredDatastore) Close() error {
+	return errors.Join(m.primary.Close(), m.secondary.Close())
+}
+
+type mirroredBatch struct {
+	m                  *MirroredDatastore
+	primary, secondary ds.Batch
+}
+
+func (b *mirroredBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := b.primary.Put(ctx, key, value); err != nil {
+		return err
+	}
+	return b.m.secondaryErr("batch put", b.secondary.Put(ctx, key, value))
+}
+
+func (b *mirroredBatch) Delete(ctx context.Context, key ds.Key) error {
+	if err := b.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	return b.m.secondaryErr("batch delete", b.secondary.Delete(ctx, key))
+}
+
+func (b *mirroredBatch) Commit(ctx context.Context) error {
+	if err := b.primary.Commit(ctx); err != nil {
+		return err
+	}
+	return b.m.secondaryErr("batch commit", b.secondary.Commit(ctx))
+}
@@ -0,0 +1,151 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+var errFailing = errors.New("failing datastore")
+
+// failingDatastore fails every write.
+type failingDatastore struct {
+	datastore.Batching
+}
+
+func (f *failingDatastore) Put(context.Context, datastore.Key, []byte) error {
+	return errFailing
+}
+
+func (f *failingDatastore) Delete(context.Context, datastore.Key) error {
+	return errFailing
+}
+
+func (f *failingDatastore) Batch(context.Context) (datastore.Batch, error) {
+	return nil, errFailing
+}
+
+func TestMirroredDatastore(t *testing.T) {
+	primary, cleanup := newDatastore(t)
+	defer cleanup()
+
+	dstest.SubtestAll(t, NewMirroredDatastore(primary, dssync.MutexWrap(datastore.NewMapDatastore()), MirrorStrict))
+}
+
+func TestMirroredWrites(t *testing.T) {
+	primary, cleanup := newDatastore(t)
+	defer cleanup()
+	secondary := dssync.MutexWrap(datastore.NewMapDatastore())
+	m := NewMirroredDatastore(primary, secondary, MirrorStrict)
+
+	ctx := context.Background()
+	a, b := datastore.NewKey("a"), datastore.NewKey("b")
+	if err := m.Put(ctx, a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := m.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put(ctx, b, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []datastore.Datastore{primary, secondary} {
+		for _, k := range []datastore.Key{a, b} {
+			if has, err := d.Has(ctx, k); err != nil || !has {
+				t.Fatalf("expected %s to be written to both datastores: %t, %v", k, has, err)
+			}
+		}
+	}
+
+	if err := m.Delete(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := secondary.Has(ctx, a); has {
+		t.Fatal("expected the delete to be mirrored")
+	}
+
+	// reads only hit the primary.
+	if err := secondary.Put(ctx, a, []byte("secondary only")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, a); err != datastore.ErrNotFound {
+		t.Fatalf("expected reads to come from the primary, got %v", err)
+	}
+	if err := primary.Put(ctx, b, []byte("primary only")); err != nil {
+		t.Fatal(err)
+	}
+	val, err := m.Get(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, []byte("primary only")) {
+		t.Fatalf("expected the primary value, got %q", val)
+	}
+}
+
+func TestMirroredSecondaryFailures(t *testing.T) {
+	ctx := context.Background()
+	key := datastore.NewKey("a")
+
+	t.Run("best effort", func(t *testing.T) {
+		l := &recordingLogger{}
+		primary, cleanup := newDatastore(t, WithLogger(l))
+		defer cleanup()
+		m := NewMirroredDatastore(primary, &failingDatastore{datastore.NewMapDatastore()}, MirrorBestEffort)
+
+		if err := m.Put(ctx, key, []byte("a")); err != nil {
+			t.Fatalf("expected secondary failures to be ignored, got %v", err)
+		}
+		if !l.logged("mirrored put failed on secondary") {
+			t.Fatal("expected the failure to be logged with the logger of the primary")
+		}
+		if has, _ := primary.Has(ctx, key); !has {
+			t.Fatal("expected the primary to be written")
+		}
+		if err := m.Delete(ctx, key); err != nil {
+			t.Fatalf("expected secondary failures to be ignored, got %v", err)
+		}
+		// batches carry on with the primary alone.
+		batch, err := m.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Put(ctx, key, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if has, _ := primary.Has(ctx, key); !has {
+			t.Fatal("expected the primary to be written")
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		primary, cleanup := newDatastore(t)
+		defer cleanup()
+		m := NewMirroredDatastore(primary, &failingDatastore{datastore.NewMapDatastore()}, MirrorStrict)
+
+		if err := m.Put(ctx, key, []byte("a")); !errors.Is(err, errFailing) {
+			t.Fatalf("expected the secondary failure, got %v", err)
+		}
+		if has, _ := primary.Has(ctx, key); !has {
+			t.Fatal("expected the primary to be written before the secondary")
+		}
+		if err := m.Delete(ctx, key); !errors.Is(err, errFailing) {
+			t.Fatalf("expected the secondary failure, got %v", err)
+		}
+		if _, err := m.Batch(ctx); !errors.Is(err, errFailing) {
+			t.Fatalf("expected the secondary failure, got %v", err)
+		}
+	})
+}
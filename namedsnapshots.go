@@ -0,0 +1,174 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-log/v2"
+)
+
+var (
+	// ErrSnapshotNotFound is returned for named snapshots that do not exist,
+	// or that have been released.
+	ErrSnapshotNotFound = errors.New("pebble datastore snapshot not found")
+	// ErrSnapshotExists is returned when creating a named snapshot under a
+	// name in use.
+	ErrSnapshotExists = errors.New("pebble datastore snapshot already exists")
+	// ErrTooManySnapshots is returned when creating a named snapshot past the
+	// limit set with WithNamedSnapshotLimits.
+	ErrTooManySnapshots = errors.New("too many pebble datastore snapshots")
+)
+
+// NamedSnapshotInfo describes a named snapshot, as listed by NamedSnapshots.
+type NamedSnapshotInfo struct {
+	Name    string
+	Created time.Time
+}
+
+type namedSnapshot struct {
+	info NamedSnapshotInfo
+	snap *pebble.Snapshot
+	// expiry releases the snapshot once it reaches the max age, if any.
+	expiry *time.Timer
+}
+
+// namedSnapshots holds the named snapshots of the datastore.
+type namedSnapshots struct {
+	// mu is held for reading while iterators are created over a snapshot,
+	// and for writing while snapshots are created and released.
+	mu    sync.RWMutex
+	snaps map[string]*namedSnapshot
+	log   log.StandardLogger
+}
+
+// release releases the snapshot. The caller must hold s.mu for writing.
+func (s *namedSnapshots) release(name string, ns *namedSnapshot) {
+	delete(s.snaps, name)
+	if ns.expiry != nil {
+		ns.expiry.Stop()
+	}
+	if err := ns.snap.Close(); err != nil {
+		s.log.Errorf("pebble error releasing snapshot %q: %s", name, err)
+	}
+}
+
+// releaseAll releases every snapshot, on Close.
+func (s *namedSnapshots) releaseAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, ns := range s.snaps {
+		s.release(name, ns)
+	}
+}
+
+// CreateNamedSnapshot takes a snapshot of the store under the given name, for
+// QueryNamedSnapshot to read the store as of now later on, until released
+// with ReleaseNamedSnapshot.
+//
+// A snapshot keeps compactions from dropping the data it sees, so that
+// overwritten and deleted entries keep taking space for as long as it is
+// held, and tombstones keep slowing down reads. Long-held snapshots of stores
+// under heavy overwrites or deletes can retain a lot of space: their number
+// and age are bounded with WithNamedSnapshotLimits.
+func (d *Datastore) CreateNamedSnapshot(name string) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	s := &d.named
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snaps[name]; ok {
+		return fmt.Errorf("%w: %q", ErrSnapshotExists, name)
+	}
+	if max := d.conf.maxNamedSnapshots; max > 0 && len(s.snaps) >= max {
+		return fmt.Errorf("%w: %d are held already", ErrTooManySnapshots, len(s.snaps))
+	}
+	if s.snaps == nil {
+		s.snaps = make(map[string]*namedSnapshot)
+	}
+	ns := &namedSnapshot{
+		info: NamedSnapshotInfo{Name: name, Created: time.Now()},
+		snap: d.db.NewSnapshot(),
+	}
+	if age := d.conf.maxNamedSnapshotAge; age > 0 {
+		ns.expiry = time.AfterFunc(age, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// the name may have been released and taken again since.
+			if s.snaps[name] == ns {
+				s.log.Warnf("releasing pebble snapshot %q past its max age of %s", name, age)
+				s.release(name, ns)
+			}
+		})
+	}
+	s.snaps[name] = ns
+	return nil
+}
+
+// QueryNamedSnapshot runs the query over the store as it was when the named
+// snapshot was taken, like Query otherwise. It fails with ErrSnapshotNotFound
+// if there is no such snapshot. Results keep streaming from the snapshot if it
+// is released in the meantime.
+func (d *Datastore) QueryNamedSnapshot(ctx context.Context, name string, q query.Query) (query.Results, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.wg.Done()
+
+	s := &d.named
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ns, ok := s.snaps[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+	}
+	opts, ok := d.queryIterOptions(q)
+	if !ok {
+		// no key can possibly match.
+		return query.ResultsWithEntries(q, []query.Entry{}), nil
+	}
+	return d.query(ctx, ns.snap, q, opts)
+}
+
+// ReleaseNamedSnapshot releases the named snapshot, letting compactions drop
+// the data only it sees. It fails with ErrSnapshotNotFound if there is no
+// such snapshot. Named snapshots are released on Close as well.
+func (d *Datastore) ReleaseNamedSnapshot(name string) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	s := &d.named
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns, ok := s.snaps[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+	}
+	s.release(name, ns)
+	return nil
+}
+
+// NamedSnapshots lists the named snapshots held, oldest first.
+func (d *Datastore) NamedSnapshots() []NamedSnapshotInfo {
+	s := &d.named
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]NamedSnapshotInfo, 0, len(s.snaps))
+	for _, ns := range s.snaps {
+		infos = append(infos, ns.info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
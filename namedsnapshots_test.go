@@ -0,0 +1,113 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func snapshotEntries(t *testing.T, d *Datastore, name string) map[string]string {
+	t.Helper()
+	res, err := d.QueryNamedSnapshot(context.Background(), name, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string, len(entries))
+	for _, e := range entries {
+		m[e.Key] = string(e.Value)
+	}
+	return m
+}
+
+func TestNamedSnapshots(t *testing.T) {
+	d, cleanup := newDatastore(t, WithNamedSnapshotLimits(2, 0))
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := d.Put(ctx, datastore.NewKey("/a"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/b"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNamedSnapshot("hourly"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNamedSnapshot("hourly"); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("expected ErrSnapshotExists, got %v", err)
+	}
+
+	if err := d.Put(ctx, datastore.NewKey("/a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, datastore.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/c"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	old := snapshotEntries(t, d, "hourly")
+	if len(old) != 2 || old["/a"] != "old" || old["/b"] != "old" {
+		t.Fatalf("unexpected snapshot view: %v", old)
+	}
+	live := queryEntries(t, d, query.Query{})
+	if len(live) != 2 {
+		t.Fatalf("unexpected live view: %v", live)
+	}
+
+	if err := d.CreateNamedSnapshot("later"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNamedSnapshot("third"); !errors.Is(err, ErrTooManySnapshots) {
+		t.Fatalf("expected ErrTooManySnapshots, got %v", err)
+	}
+	if infos := d.NamedSnapshots(); len(infos) != 2 || infos[0].Name != "hourly" || infos[1].Name != "later" {
+		t.Fatalf("unexpected snapshots: %v", infos)
+	}
+	if later := snapshotEntries(t, d, "later"); later["/a"] != "new" || later["/c"] != "new" {
+		t.Fatalf("unexpected snapshot view: %v", later)
+	}
+
+	if err := d.ReleaseNamedSnapshot("hourly"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReleaseNamedSnapshot("hourly"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+	if _, err := d.QueryNamedSnapshot(ctx, "hourly", query.Query{}); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+
+	// the remaining snapshot is released on Close.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamedSnapshotMaxAge(t *testing.T) {
+	d, cleanup := newDatastore(t, WithNamedSnapshotLimits(0, 10*time.Millisecond))
+	defer cleanup()
+
+	if err := d.CreateNamedSnapshot("short"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.NamedSnapshots()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot not released past its max age")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := d.QueryNamedSnapshot(context.Background(), "short", query.Query{}); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,599 @@
+package pebbleds
+
+import (
+	"os"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-log/v2"
+)
+
+// PrefixMode controls how Query interprets query.Query.Prefix.
+type PrefixMode int
+
+const (
+	// NamespacedPrefix treats the prefix as a key namespace: it is cleaned
+	// like a ds.Key and a trailing "/" is appended (unless the prefix is the
+	// root). Query(prefix="/a") therefore matches "/a/b", but neither "/a"
+	// itself nor "/ab". This is the default, and matches the semantics of
+	// most other go-datastore implementations.
+	NamespacedPrefix PrefixMode = iota
+	// RawPrefix treats the prefix as a plain byte prefix, used verbatim.
+	// Query(prefix="/a") matches "/a", "/ab" and "/a/b". An empty prefix
+	// matches every key.
+	RawPrefix
+)
+
+// EntryErrorMode controls how queries handle errors reading an entry, such as
+// a failed value read or a checksum mismatch.
+type EntryErrorMode int
+
+const (
+	// ReportEntryErrors sends an error result in place of the entry and goes
+	// on with the next ones. Entries that fail while skipping the offset are
+	// reported too, and do not count towards it. This is the default.
+	ReportEntryErrors EntryErrorMode = iota
+	// FailOnEntryErrors sends an error result in place of the entry and ends
+	// the query.
+	FailOnEntryErrors
+)
+
+// config holds the go-ds-pebble specific settings, as opposed to the ones
+// passed down to Pebble itself.
+type config struct {
+	prefixMode             PrefixMode
+	entryErrorMode         EntryErrorMode
+	consistencyCheckOnOpen bool
+	syncInterval           time.Duration
+	snapshotInterval       time.Duration
+	valueChecksums         bool
+	split                  pebble.Split
+	commitWindow           time.Duration
+	closeStageTimeout      time.Duration
+	slowOpThreshold        time.Duration
+	maxIterators           int
+	maxKeySize             int
+	operationTimeout       time.Duration
+	boundsCacheSize        int
+	sortMemoryBudget       int64
+	sortTempDir            string
+	maxNaiveQueryEntries   int
+	iterRetries            int
+	iterRetryBackoff       time.Duration
+	metadata               bool
+	ampInterval            time.Duration
+	ampSamples             int
+	prefetch               int
+	appendOnly             bool
+	maxNamedSnapshots      int
+	maxNamedSnapshotAge    time.Duration
+	reservedPrefix         string
+	hotspotRate            float64
+	hotspotKeys            int
+	dirMode                os.FileMode
+	errorIfNotExists       bool
+	sync                   bool
+	logger                 log.StandardLogger
+
+	scrubInterval    time.Duration
+	scrubBytesPerSec int64
+	scrubReport      func(error)
+
+	breakerThreshold int
+	breakerWindow    time.Duration
+	breakerCooldown  time.Duration
+
+	// setupSteps run in order right after opening the database. Any
+	// failure closes it and fails NewDatastore.
+	setupSteps []func(*Datastore) error
+
+	// pebbleOpts are applied in order to the pebble.Options right before
+	// opening the database. They allow for Options that are shorthands for
+	// Pebble settings.
+	pebbleOpts []func(*pebble.Options)
+}
+
+// Option configures go-ds-pebble specific behaviour of a Datastore.
+type Option func(*config)
+
+func defaultConfig() config {
+	return config{
+		prefixMode:     NamespacedPrefix,
+		reservedPrefix: defaultReservedPrefix,
+		logger:         logger,
+
+		maxNaiveQueryEntries: defaultMaxNaiveQueryEntries,
+		maxNamedSnapshots:    defaultMaxNamedSnapshots,
+	}
+}
+
+// WithEntryErrorMode sets how queries handle errors reading an entry. See
+// EntryErrorMode for the available modes. Defaults to ReportEntryErrors.
+func WithEntryErrorMode(mode EntryErrorMode) Option {
+	return func(c *config) {
+		c.entryErrorMode = mode
+	}
+}
+
+// WithPrefixMode sets how Query matches keys against the query prefix. See
+// PrefixMode for the available modes. Defaults to NamespacedPrefix.
+func WithPrefixMode(mode PrefixMode) Option {
+	return func(c *config) {
+		c.prefixMode = mode
+	}
+}
+
+// WithConsistencyCheckOnOpen makes NewDatastore run Pebble's consistency
+// checks (see pebble.DB.CheckLevels) right after opening the database, failing
+// to open if they report any problem. This catches corruption at startup
+// rather than at the first bad read.
+//
+// The check reads every key in the store, so startup time grows linearly with
+// the size of the store.
+func WithConsistencyCheckOnOpen(enabled bool) Option {
+	return func(c *config) {
+		c.consistencyCheckOnOpen = enabled
+	}
+}
+
+// WithMaxManifestFileSize sets the size in bytes above which Pebble rolls
+// the MANIFEST over into a new file (pebble.Options.MaxManifestFileSize).
+// Small values rotate more often, leaving many small MANIFEST files behind
+// (see pebble.Options.NumPrevManifest), while large values keep a longer
+// history per file at the cost of a bigger on-disk footprint and slower
+// replay on open.
+func WithMaxManifestFileSize(size int64) Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.MaxManifestFileSize = size
+		})
+	}
+}
+
+// WithSyncInterval makes the datastore fsync the WAL every interval from a
+// background goroutine, while individual writes stay unsynced. This bounds
+// how much acknowledged data a crash can lose to about the last interval,
+// at a fraction of the cost of syncing every write. It has no effect when
+// the WAL is disabled. Disabled by default.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.syncInterval = interval
+	}
+}
+
+// WithManualCompaction disables Pebble's automatic compactions
+// (pebble.Options.DisableAutomaticCompactions), which is useful for bulk
+// loads: compacting once at the end with CompactAll is cheaper than
+// compacting repeatedly while loading. Reads get slower as files pile up in
+// L0 in the meantime, and writes eventually stall once L0 reaches
+// pebble.Options.L0StopWritesThreshold.
+//
+// Pebble cannot resume automatic compactions on an open database, so they
+// stay disabled until the datastore is reopened without this option.
+func WithManualCompaction(enabled bool) Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.DisableAutomaticCompactions = enabled
+		})
+	}
+}
+
+// WithValueChecksums makes the datastore append a CRC-32C checksum to every
+// value it writes and verify it on every read, failing with
+// ErrChecksumMismatch when they disagree. Pebble already checksums its blocks;
+// this adds end-to-end integrity for the values themselves, catching
+// corruption introduced outside of Pebble's block layer.
+//
+// The checksum is part of the stored value, so the setting must stay the same
+// for the lifetime of the store: values written without checksums fail to
+// verify once enabled, and values written with them come back with the
+// checksum attached once disabled. Disabled by default.
+func WithValueChecksums(enabled bool) Option {
+	return func(c *config) {
+		c.valueChecksums = enabled
+	}
+}
+
+// WithSplit sets the Split function of the comparer (pebble.Comparer.Split)
+// instead of the one go-ds-pebble forces by default, which treats every key as
+// a prefix of its own so that bloom filters serve point lookups. A nil split
+// keeps the default.
+//
+// Split determines which part of a key is fed to bloom filters and, for
+// iterators, the prefix that Pebble can use filters to seek on. A function
+// that does not suit the key scheme silently makes Has and Get for missing
+// keys read from disk instead of answering from the filters, or worse, makes
+// lookups miss keys if it does not satisfy the contract documented on
+// pebble.Split. It must also stay the same for the lifetime of the store, as
+// filters already written keep the prefixes they were built with. Only use it
+// with a key scheme designed for prefix-grouped filtering.
+func WithSplit(split pebble.Split) Option {
+	return func(c *config) {
+		c.split = split
+	}
+}
+
+// WithCommitWindow makes Batch commits wait up to window for other batches to
+// be committed, and commits all of them together in a single Pebble commit.
+// This trades a little latency for throughput when many goroutines commit
+// small batches in quick succession.
+//
+// Every batch is still applied atomically, and batches are applied in the
+// order their Commit calls arrive. As a group is committed at once, a failure
+// fails every batch in it. Commit only returns once its batch is committed, so
+// its writes are visible to reads issued afterwards.
+//
+// Pebble already pipelines concurrent commits, and batches are committed
+// without syncing, so the waiting can outweigh the savings; measure with
+// BenchmarkSmallBatches on the target workload before enabling. Disabled by
+// default.
+func WithCommitWindow(window time.Duration) Option {
+	return func(c *config) {
+		c.commitWindow = window
+	}
+}
+
+// WithMemTableStopWritesThreshold sets how many memtables may be queued,
+// either being written to or waiting to be flushed, before Pebble stalls
+// writes (pebble.Options.MemTableStopWritesThreshold). Higher values absorb
+// longer write bursts before stalling, while flushes catch up.
+//
+// Memory use grows accordingly: up to threshold × pebble.Options.MemTableSize
+// bytes can be held in memtables at once.
+func WithMemTableStopWritesThreshold(threshold int) Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.MemTableStopWritesThreshold = threshold
+		})
+	}
+}
+
+// WithDirMode sets the permissions the datastore directory is created with
+// when it does not exist yet, e.g. 0o700 to keep other users of the host
+// away from the data. The process umask still applies on top of it. An
+// existing directory is left as is. Defaults to Pebble's own behaviour.
+//
+// Only the directory itself is affected: the files and subdirectories Pebble
+// creates within it get Pebble's permissions (subject to the umask too),
+// which go-ds-pebble cannot control. A restrictive directory mode is enough
+// to keep them private, since they cannot be reached without traversing the
+// directory.
+func WithDirMode(mode os.FileMode) Option {
+	return func(c *config) {
+		c.dirMode = mode
+	}
+}
+
+// WithReadCircuitBreaker makes reads, both point reads (Get, Has and GetSize)
+// and queries, fail fast with ErrCircuitOpen once threshold of them in a row
+// have failed, with no more than window between the first and the last
+// failure. A query fails if opening its iterator does, or if the iterator
+// reports an error once closed. This keeps a node whose disk is failing from
+// amplifying the problem with more IO. After cooldown, a single read is let
+// through: the breaker closes if it succeeds, and stays open for another
+// cooldown otherwise. Missing keys are not failures. Disabled by default.
+func WithReadCircuitBreaker(threshold int, window, cooldown time.Duration) Option {
+	return func(c *config) {
+		c.breakerThreshold = threshold
+		c.breakerWindow = window
+		c.breakerCooldown = cooldown
+	}
+}
+
+// WithCloseStageTimeout bounds how long Close waits on each stage of the
+// shutdown, such as waiting for in-flight operations or flushing. When a stage
+// takes longer, Close logs and returns an ErrCloseTimeout error naming it
+// instead of hanging, and the shutdown completes in the background. No
+// timeout by default.
+func WithCloseStageTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.closeStageTimeout = timeout
+	}
+}
+
+// WithSnapshotReads makes Get, Has, GetSize and Query, as well as QueryRange,
+// QueryPrefixes, QueryWithBlockFilters, ProbeMany, FirstKey and LastKey, read
+// from a snapshot of the store that is refreshed every interval, instead of
+// from its latest state. Reads then trade freshness for not contending with the
+// write path.
+//
+// Reads are stale by up to interval: writes, including the datastore's own,
+// only become visible to them once the snapshot is next refreshed. Other
+// operations, such as ScanPrefix, conditional batches and the
+// read-modify-write operations of the wrappers in this package, keep reading
+// the latest state. A snapshot keeps compactions from dropping the data it
+// sees, so long intervals under heavy overwrites or deletes retain more
+// space. Disabled by default.
+func WithSnapshotReads(interval time.Duration) Option {
+	return func(c *config) {
+		c.snapshotInterval = interval
+	}
+}
+
+// WithScrubber starts a background scrubber that reads through the whole
+// store every interval, to detect silent corruption before it is read.
+// Reading makes Pebble verify the checksums of the blocks it loads from disk,
+// and the scrubber verifies value checksums too when WithValueChecksums is
+// enabled. Every corruption found is passed to report, from the scrubber
+// goroutine. Blocks already in the block cache are not read from disk again.
+//
+// Reads are throttled to bytesPerSecond of keys and values, to leave
+// foreground traffic alone; zero or less means no throttling. A pass
+// interrupted by Close is abandoned. Disabled by default.
+func WithScrubber(interval time.Duration, bytesPerSecond int64, report func(err error)) Option {
+	return func(c *config) {
+		c.scrubInterval = interval
+		c.scrubBytesPerSec = bytesPerSecond
+		c.scrubReport = report
+	}
+}
+
+// WithSlowOpThreshold makes the datastore log Get, Has, GetSize, Put, Delete
+// and Query calls that take longer than threshold, with the key (or query
+// prefix) and the time taken. Queries are timed until their iterator is
+// positioned on the first entry, not while their results are consumed. To
+// keep logging cheap under a latency spike, at most one slow operation is
+// logged per second, along with how many were left out. Disabled by default.
+func WithSlowOpThreshold(threshold time.Duration) Option {
+	return func(c *config) {
+		c.slowOpThreshold = threshold
+	}
+}
+
+// WithErrorIfNotExists makes NewDatastore fail with an error matching
+// pebble.ErrDBDoesNotExist when there is no store at the path yet, instead of
+// creating a fresh, empty one as it does by default. Nothing is created at the
+// path in that case. This catches misconfigured paths, such as a volume that
+// failed to mount, before anything is written to the wrong place.
+func WithErrorIfNotExists(enabled bool) Option {
+	return func(c *config) {
+		c.errorIfNotExists = enabled
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.ErrorIfNotExists = enabled
+		})
+	}
+}
+
+// WithMaxConcurrentIterators bounds the number of iterators open for queries
+// at once (see OpenIterators). Past the limit, queries wait for another query
+// to release its iterator, and fail with ErrTooManyIterators once their
+// context is done. This keeps a consumer that leaks unclosed results from
+// exhausting the resources of the store, at the cost of stalling queries
+// instead. Queries built on others, such as those with orders applied in
+// memory, hold a single iterator at a time. Unlimited by default.
+func WithMaxConcurrentIterators(limit int) Option {
+	return func(c *config) {
+		c.maxIterators = limit
+	}
+}
+
+// WithMaxKeySize makes writes of keys larger than size bytes fail with
+// ErrKeyTooLarge. Reads and deletes of such keys are still allowed, so that
+// keys written before the limit was set can be cleaned up.
+//
+// Pebble handles large keys, but inefficiently: every key is a bloom filter
+// prefix of its own (see WithSplit), and keys are repeated in index blocks, so
+// keys approaching the block size (pebble.Options.Levels[i].BlockSize, 4KiB by
+// default) bloat sstables and slow down seeks for the whole store. Keys well
+// under 1KiB, such as the few dozen bytes of a CID-based key, are recommended.
+// Unlimited by default.
+func WithMaxKeySize(size int) Option {
+	return func(c *config) {
+		c.maxKeySize = size
+	}
+}
+
+// WithDefaultOperationTimeout bounds the operations called with a context
+// that has no deadline to timeout, as if their context had one. A deadline
+// set on the context always wins, even if it is later. This is a safety net
+// against operations that hang forever in code that does not consistently set
+// deadlines.
+//
+// The timeout only applies to operations that can be interrupted: queries,
+// which fail with context.DeadlineExceeded as their last result once it
+// expires, ScanPrefix and ExportSSTables. Pebble offers no way to interrupt a
+// point read or write once started. No timeout by default.
+func WithDefaultOperationTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.operationTimeout = timeout
+	}
+}
+
+// WithQueryBoundsCache caches the iterator bounds computed from query
+// prefixes, for up to size distinct prefixes. Computing them normalizes the
+// prefix as a key and allocates the bounds on every query, which is
+// measurable for hot prefixes queried at high rates. Once full, a cached
+// prefix is evicted at random to make room for the next one. No cache by
+// default.
+func WithQueryBoundsCache(size int) Option {
+	return func(c *config) {
+		c.boundsCacheSize = size
+	}
+}
+
+// WithExternalSort bounds the memory used by queries ordered other than by
+// key to about budget bytes of keys and values. Such orders are applied in
+// memory over the whole result set, which can exhaust the memory on large
+// prefixes; with a budget, results are instead sorted in runs that are
+// spilled to temporary files under tempDir (os.TempDir if empty) and merged
+// back while streaming. Queries then need up to the size of their results in
+// temporary space, which is released when their results are closed. Orders
+// are applied entirely in memory by default.
+func WithExternalSort(budget int64, tempDir string) Option {
+	return func(c *config) {
+		c.sortMemoryBudget = budget
+		c.sortTempDir = tempDir
+	}
+}
+
+// WithReservedPrefix sets the prefix of the keys reserved for internal
+// metadata, such as the LRU index, "\x00" by default, which datastore keys
+// cannot start with. Writes of user keys under it fail with ErrReservedKey, so
+// that they cannot corrupt the metadata, and reads leave its keys out. The
+// prefix must not change once metadata has been written, as it would be lost.
+// An empty prefix keeps the default.
+func WithReservedPrefix(prefix string) Option {
+	return func(c *config) {
+		if prefix != "" {
+			c.reservedPrefix = prefix
+		}
+	}
+}
+
+// WithHotspotSampling samples a fraction rate of the Get and Has calls to
+// track the k most read keys, reported by HotKeys, which helps find the
+// hotspots behind cache churn. Sampled reads are counted in a fixed-size
+// count-min sketch, so the overhead is a hash and a short lock per sampled
+// read, and the reported counts are estimates. A rate of 1 samples every
+// read. Disabled by default.
+func WithHotspotSampling(rate float64, k int) Option {
+	return func(c *config) {
+		c.hotspotRate = rate
+		c.hotspotKeys = k
+	}
+}
+
+// defaultMaxNaiveQueryEntries is the default of WithMaxNaiveQueryEntries.
+const defaultMaxNaiveQueryEntries = 10_000_000
+
+// WithMaxNaiveQueryEntries bounds the number of entries buffered by queries
+// ordered other than by key and without a limit, which are sorted in memory
+// over the whole result set: past max entries, they fail with
+// ErrResultSetTooLarge instead of risking running out of memory. Queries with
+// a limit are not bounded, nor are those sorted within the budget set with
+// WithExternalSort. A max <= 0 removes the bound. Defaults to 10 million
+// entries.
+func WithMaxNaiveQueryEntries(max int) Option {
+	return func(c *config) {
+		c.maxNaiveQueryEntries = max
+	}
+}
+
+// WithIteratorRetries makes queries retry opening their iterator up to
+// retries times when it fails, waiting backoff before the first retry and
+// twice as long before every next one, so that transient failures under
+// resource pressure do not surface to callers. Failures that cannot be
+// transient, such as a done context, a closed store or corruption, are
+// returned right away, and errors while iterating are never retried. No
+// retries by default.
+func WithIteratorRetries(retries int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.iterRetries = retries
+		c.iterRetryBackoff = backoff
+	}
+}
+
+// WithMetadata enables storing metadata alongside values, with PutWithMeta.
+// Every Put and Delete then also removes the metadata of the key, within the
+// same batch, costing an extra tombstone per write. Disabled by default.
+func WithMetadata(enabled bool) Option {
+	return func(c *config) {
+		c.metadata = enabled
+	}
+}
+
+// WithAmplificationSampling samples the read and write amplification of the
+// store every interval, keeping the latest samples in memory, so that
+// AmplificationSeries and AmplificationTrend can tell how they evolve without
+// an external time-series database. Each sample reads the Pebble metrics,
+// which is cheap. Disabled by default.
+func WithAmplificationSampling(interval time.Duration, samples int) Option {
+	return func(c *config) {
+		c.ampInterval = interval
+		c.ampSamples = samples
+	}
+}
+
+// WithPrefetch makes ScanPrefix and Query read up to entries ahead of the
+// consumer on a background goroutine, values included, so that traversals
+// that take time on every entry rarely wait on disk for the next one. Query
+// results are buffered as they are read; ScanPrefix then fetches every value,
+// even those the callback does not ask for. The goroutine stops along with
+// the scan or the results, and on Close. Disabled by default.
+func WithPrefetch(entries int) Option {
+	return func(c *config) {
+		c.prefetch = entries
+	}
+}
+
+// WithAppendOnly enforces that keys are only ever written in increasing
+// order, as in append-only logs: Put and batches fail with
+// ErrNonMonotonicKey for keys that are not greater than every key written
+// before, in byte order. The greatest key written is recovered from the last
+// key of the store on open, so it drops back if that key was deleted. Writes
+// that bypass Put and batches, such as PutWithMeta, ReplacePrefix,
+// SecureErase and IngestSSTables, are not checked. Disabled by default.
+func WithAppendOnly(enabled bool) Option {
+	return func(c *config) {
+		c.appendOnly = enabled
+	}
+}
+
+// defaultMaxNamedSnapshots is the default of WithNamedSnapshotLimits.
+const defaultMaxNamedSnapshots = 16
+
+// WithNamedSnapshotLimits bounds the named snapshots of CreateNamedSnapshot,
+// which keep compactions from reclaiming space for as long as they are held:
+// past maxCount snapshots, creating one fails with ErrTooManySnapshots, and
+// snapshots are released automatically once they reach maxAge, with a
+// warning. A value <= 0 removes the bound. Defaults to 16 snapshots, of any
+// age.
+func WithNamedSnapshotLimits(maxCount int, maxAge time.Duration) Option {
+	return func(c *config) {
+		c.maxNamedSnapshots = maxCount
+		c.maxNamedSnapshotAge = maxAge
+	}
+}
+
+// WithBloomFilters sets bloom filters of bitsPerKey bits per key on every
+// level, letting lookups of missing keys skip the sstables that do not hold
+// them, or removes them if bitsPerKey <= 0. 10 bits per key give a 1% false
+// positive rate. Pebble skips the filters of the bottommost level on Get and
+// Has, as it expects most lookups there to find their key. Filters are
+// written along with the sstables: existing ones keep the filters they were
+// written with until rewritten, such as by RebuildFilters after reopening the
+// store with different filters.
+func WithBloomFilters(bitsPerKey int) Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.EnsureDefaults()
+			setBloomFilters(o, bitsPerKey)
+		})
+	}
+}
+
+// WithSync makes every write wait for the WAL to be synced to stable storage
+// before returning (see pebble.Sync), so that acknowledged writes survive a
+// machine crash. Otherwise writes only reach the OS, and may be lost on a
+// crash until synced by Sync, WithSyncInterval or a later synced write.
+// A Batch is synced once, on Commit, however many writes it holds, which
+// amortizes the cost of syncing over them. Defaults to false.
+func WithSync(enabled bool) Option {
+	return func(c *config) {
+		c.sync = enabled
+	}
+}
+
+// WithLogger sets the logger of the datastore, which is also handed down to
+// Pebble (pebble.Options.Logger), overriding the "pebble" go-log logger used
+// by default. A nil logger restores the default.
+func WithLogger(l log.StandardLogger) Option {
+	return func(c *config) {
+		if l == nil {
+			l = logger
+		}
+		c.logger = l
+	}
+}
+
+// WithReadOnly opens the database read-only (pebble.Options.ReadOnly): it is
+// neither created nor modified, and every write fails with
+// pebble.ErrReadOnly. The directory lock is still taken, so a read-only
+// datastore cannot share the database with another process.
+func WithReadOnly(enabled bool) Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.ReadOnly = enabled
+		})
+	}
+}
@@ -0,0 +1,461 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestMaxManifestFileSize(t *testing.T) {
+	rotations := func(t *testing.T, options ...Option) int32 {
+		var created int32
+		opts := &pebble.Options{
+			EventListener: &pebble.EventListener{
+				ManifestCreated: func(pebble.ManifestCreateInfo) {
+					atomic.AddInt32(&created, 1)
+				},
+			},
+		}
+		opts.EnsureDefaults()
+
+		d, err := NewDatastoreWithOptions(t.TempDir(), opts, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		opened := atomic.LoadInt32(&created)
+		ctx := context.Background()
+		// every flush records a version edit in the manifest.
+		for i := 0; i < 5; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return atomic.LoadInt32(&created) - opened
+	}
+
+	if n := rotations(t); n != 0 {
+		t.Fatalf("expected no rotations with the default size, got %d", n)
+	}
+	// the first edit overflows the tiny manifest, and every later one rotates it.
+	if n := rotations(t, WithMaxManifestFileSize(1)); n < 4 {
+		t.Fatalf("expected a rotation per flush, got %d", n)
+	}
+}
+
+// newCrashableOptions returns pebble options backed by a strict in-memory
+// filesystem, in which a "/db" directory can be used to simulate crashes
+// through crashAndReopen.
+func newCrashableOptions(t *testing.T) (*pebble.Options, *vfs.MemFS) {
+	t.Helper()
+
+	fs := vfs.NewStrictMem()
+	if err := fs.MkdirAll("/db", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.OpenDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	_ = root.Close()
+
+	opts := &pebble.Options{FS: fs}
+	opts.EnsureDefaults()
+	return opts, fs
+}
+
+// crashAndReopen simulates a machine crash, dropping everything that wasn't
+// synced to fs, and reopens the datastore.
+func crashAndReopen(t *testing.T, d *Datastore, fs *vfs.MemFS) *Datastore {
+	t.Helper()
+
+	fs.SetIgnoreSyncs(true)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+
+	d, err := NewDatastore("/db", d.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+func TestSyncInterval(t *testing.T) {
+	survives := func(t *testing.T, options ...Option) bool {
+		opts, fs := newCrashableOptions(t)
+		d, err := NewDatastoreWithOptions("/db", opts, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		key := datastore.NewKey("key")
+		if err := d.Put(ctx, key, []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		d = crashAndReopen(t, d, fs)
+		has, err := d.Has(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return has
+	}
+
+	if survives(t) {
+		t.Fatal("expected the unsynced write to be lost")
+	}
+	if !survives(t, WithSyncInterval(10*time.Millisecond)) {
+		t.Fatal("expected the write to survive once the sync interval elapsed")
+	}
+}
+
+func TestSyncIntervalClose(t *testing.T) {
+	d, cleanup := newDatastore(t, WithSyncInterval(time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		cleanup()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not stop the sync goroutine")
+	}
+	// the goroutine is accounted in the waitgroup close waited for.
+	d.wg.Wait()
+}
+
+func TestSplit(t *testing.T) {
+	ctx := context.Background()
+
+	var calls atomic.Int64
+	split := func(key []byte) int {
+		calls.Add(1)
+		return len(key)
+	}
+	opts := &pebble.Options{}
+	opts.EnsureDefaults()
+	for i := range opts.Levels {
+		opts.Levels[i].FilterPolicy = bloom.FilterPolicy(10)
+	}
+	d, err := NewDatastoreWithOptions(t.TempDir(), opts, WithSplit(split))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Put(ctx, datastore.NewKey("a"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	// flushing builds the bloom filters, which splits every key.
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() == 0 {
+		t.Fatal("expected the custom split to be used")
+	}
+
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+	if got := d.opts.Comparer.Split([]byte("abc")); got != 3 {
+		t.Fatalf("expected the default split to apply, got %d", got)
+	}
+	if pebble.DefaultComparer.Split != nil {
+		t.Fatal("the shared default comparer must not be modified")
+	}
+}
+
+func TestMemTableStopWritesThreshold(t *testing.T) {
+	stalls := func(t *testing.T, threshold int) int64 {
+		var stalls atomic.Int64
+		opts := &pebble.Options{
+			MemTableSize: 1 << 16,
+			EventListener: &pebble.EventListener{
+				// slow flushes down, so that memtables queue up.
+				FlushBegin:      func(pebble.FlushInfo) { time.Sleep(20 * time.Millisecond) },
+				WriteStallBegin: func(pebble.WriteStallBeginInfo) { stalls.Add(1) },
+			},
+		}
+		opts.EnsureDefaults()
+		d, err := NewDatastoreWithOptions(t.TempDir(), opts, WithMemTableStopWritesThreshold(threshold))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		if d.opts.MemTableStopWritesThreshold != threshold {
+			t.Fatalf("expected threshold %d, got %d", threshold, d.opts.MemTableStopWritesThreshold)
+		}
+
+		ctx := context.Background()
+		val := make([]byte, 1024)
+		for i := 0; i < 1024; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/burst/%05d", i)), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return stalls.Load()
+	}
+
+	low, high := stalls(t, 2), stalls(t, 64)
+	if low == 0 {
+		t.Fatal("expected writes to stall with a low threshold")
+	}
+	if high >= low {
+		t.Fatalf("expected fewer stalls with a higher threshold, got %d vs %d", high, low)
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "db")
+	d, err := NewDatastoreWithOptions(path, nil, WithDirMode(0o700))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Fatalf("expected directory mode 0700, got %o", perm)
+	}
+}
+
+func TestErrorIfNotExists(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := NewDatastoreWithOptions(missing, nil, WithErrorIfNotExists(true)); !errors.Is(err, pebble.ErrDBDoesNotExist) {
+		t.Fatalf("expected ErrDBDoesNotExist, got %v", err)
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected nothing to be created, got %v", err)
+	}
+
+	// e.g. an empty mount point.
+	empty := t.TempDir()
+	if _, err := NewDatastoreWithOptions(empty, nil, WithErrorIfNotExists(true)); !errors.Is(err, pebble.ErrDBDoesNotExist) {
+		t.Fatalf("expected ErrDBDoesNotExist, got %v", err)
+	}
+
+	// stores are created by default.
+	d, err := NewDatastore(missing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = NewDatastoreWithOptions(missing, nil, WithErrorIfNotExists(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	opts, fs := newCrashableOptions(t)
+	d, err := NewDatastoreWithOptions("/db", opts, WithSync(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	put := datastore.NewKey("put")
+	if err := d.Put(ctx, put, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batched := datastore.NewKey("batched")
+	if err := b.Put(ctx, batched, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	d = crashAndReopen(t, d, fs)
+	for _, key := range []datastore.Key{put, batched} {
+		has, err := d.Has(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			t.Fatalf("expected synced write of %s to survive the crash", key)
+		}
+	}
+}
+
+func TestSyncLastWrite(t *testing.T) {
+	ctx := context.Background()
+	key := datastore.NewKey("/prefix/key")
+	tcs := []struct {
+		name  string
+		write func(d *Datastore) error
+		// want is the value expected after the crash, nil if deleted.
+		want []byte
+	}{
+		{"put", func(d *Datastore) error {
+			return d.Put(ctx, key, []byte("last"))
+		}, []byte("last")},
+		{"delete", func(d *Datastore) error {
+			return d.Delete(ctx, key)
+		}, nil},
+		{"batch", func(d *Datastore) error {
+			b, err := d.Batch(ctx)
+			if err != nil {
+				return err
+			}
+			if err := b.Delete(ctx, key); err != nil {
+				return err
+			}
+			return b.Commit(ctx)
+		}, nil},
+		{"replace prefix", func(d *Datastore) error {
+			return d.ReplacePrefix(ctx, datastore.NewKey("/prefix"), []query.Entry{{Key: key.String(), Value: []byte("last")}})
+		}, []byte("last")},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			opts, fs := newCrashableOptions(t)
+			d, err := NewDatastoreWithOptions("/db", opts, WithSync(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Put(ctx, key, []byte("first")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.write(d); err != nil {
+				t.Fatal(err)
+			}
+
+			d = crashAndReopen(t, d, fs)
+			val, err := d.Get(ctx, key)
+			switch {
+			case tc.want == nil && !errors.Is(err, datastore.ErrNotFound):
+				t.Fatalf("expected the deletion to survive the crash, got %q, %v", val, err)
+			case tc.want != nil && (err != nil || string(val) != string(tc.want)):
+				t.Fatalf("expected %q to survive the crash, got %q, %v", tc.want, val, err)
+			}
+		})
+	}
+}
+
+// recordingLogger records the messages logged through it.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+// logged tells whether a message starting with prefix was recorded.
+func (l *recordingLogger) logged(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if strings.HasPrefix(m, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *recordingLogger) Debug(args ...interface{})                 { l.record(fmt.Sprint(args...)) }
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Error(args ...interface{})                 { l.record(fmt.Sprint(args...)) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Fatal(args ...interface{})                 { l.record(fmt.Sprint(args...)) }
+func (l *recordingLogger) Fatalf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Info(args ...interface{})                  { l.record(fmt.Sprint(args...)) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Panic(args ...interface{})                 { l.record(fmt.Sprint(args...)) }
+func (l *recordingLogger) Panicf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Warn(args ...interface{})                  { l.record(fmt.Sprint(args...)) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record(format, args...) }
+
+func TestLogger(t *testing.T) {
+	l := &recordingLogger{}
+	d, cleanup := newDatastore(t, WithLogger(l), WithConsistencyCheckOnOpen(true))
+	defer cleanup()
+	if d.opts.Logger != l {
+		t.Fatal("expected the logger to be handed down to pebble")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.messages) != 1 || !strings.HasPrefix(l.messages[0], "pebble consistency check passed") {
+		t.Fatalf("expected the consistency check to be logged, got %q", l.messages)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := t.TempDir()
+	ctx := context.Background()
+	key := datastore.NewKey("key")
+
+	d, err := NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, key, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDatastoreWithOptions(path, nil, WithReadOnly(true), WithSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if val, err := d.Get(ctx, key); err != nil || string(val) != "val" {
+		t.Fatalf("expected val, got %q, %v", val, err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("other"), []byte("val")); !errors.Is(err, pebble.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly on put, got %v", err)
+	}
+	if err := d.Delete(ctx, key); !errors.Is(err, pebble.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly on delete, got %v", err)
+	}
+	if err := d.Sync(ctx, datastore.NewKey("")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+// ErrInvalidCursor is returned by QueryAfter when given a cursor it did not
+// return.
+var ErrInvalidCursor = errors.New("pebble datastore invalid pagination cursor")
+
+// Page is a page of results returned by QueryAfter.
+type Page struct {
+	// Entries are the entries of the page, in key order.
+	Entries []query.Entry
+	// NextCursor resumes after the last entry of the page, or is empty if
+	// the page is the last one. A full page may be followed by an empty last
+	// page.
+	NextCursor string
+}
+
+// QueryAfter returns the page of at most limit entries under prefix that
+// follows the cursor, in key order. The prefix is interpreted as in Query,
+// according to the configured PrefixMode, and an empty cursor starts with the
+// first page.
+//
+// Unlike offsets, which skip over every entry of the previous pages, cursors
+// seek straight to where the previous page ended, so that every page costs
+// O(limit) however deep it is. Cursors are opaque and must be passed with the
+// same prefix they were returned for. They never expire: as a cursor only
+// records the last key returned, entries put or deleted after it between
+// pages are seen or missed as they should, and no entry is returned twice,
+// even if the last key returned is deleted in the meantime.
+func (d *Datastore) QueryAfter(ctx context.Context, prefix string, cursor string, limit int) (Page, error) {
+	if limit <= 0 {
+		return Page{}, errors.New("pagination requires a positive limit")
+	}
+	q := query.Query{Prefix: prefix, Limit: limit}
+	lower, upper, ok := d.queryBounds(q)
+	if !ok {
+		return Page{}, nil
+	}
+	if cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return Page{}, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+		}
+		// resume right after the last key returned.
+		if after := append(last, 0); bytes.Compare(after, lower) > 0 {
+			lower = after
+		}
+		if upper != nil && bytes.Compare(lower, upper) >= 0 {
+			return Page{}, nil
+		}
+	}
+
+	opts, ok := d.userIterOptions(lower, upper)
+	if !ok {
+		return Page{}, nil
+	}
+	res, err := d.query(ctx, d.queryReader(), q, opts)
+	if err != nil {
+		return Page{}, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return Page{}, err
+	}
+	page := Page{Entries: entries}
+	if len(entries) == limit {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Key))
+	}
+	return page, nil
+}
@@ -0,0 +1,120 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestQueryAfter(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := func(i int) datastore.Key {
+		return datastore.NewKey(fmt.Sprintf("/page/%04d", i))
+	}
+	for i := 0; i < 1000; i += 2 {
+		if err := d.Put(ctx, key(i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// outside of the prefix.
+	for _, k := range []string{"/pag", "/page", "/pagez"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paginate := func(limit int, between func(page int, last string)) []string {
+		var keys []string
+		cursor := ""
+		for page := 0; ; page++ {
+			p, err := d.QueryAfter(ctx, "/page", cursor, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Entries) > limit {
+				t.Fatalf("expected at most %d entries, got %d", limit, len(p.Entries))
+			}
+			for _, e := range p.Entries {
+				keys = append(keys, e.Key)
+			}
+			if p.NextCursor == "" {
+				return keys
+			}
+			if between != nil {
+				between(page, p.Entries[len(p.Entries)-1].Key)
+			}
+			cursor = p.NextCursor
+		}
+	}
+
+	keys := paginate(37, nil)
+	if len(keys) != 500 {
+		t.Fatalf("expected 500 keys, got %d", len(keys))
+	}
+	for i, k := range keys {
+		if k != key(2*i).String() {
+			t.Fatalf("expected %s at %d, got %s", key(2*i), i, k)
+		}
+	}
+	// pages ending right at the last key are followed by an empty one.
+	if keys := paginate(100, nil); len(keys) != 500 {
+		t.Fatalf("expected 500 keys, got %d", len(keys))
+	}
+
+	// between pages, put the odd keys right before and after the last one
+	// returned, and delete the last one.
+	before, after := make(map[string]bool), make(map[string]bool)
+	keys = paginate(50, func(page int, last string) {
+		var i int
+		if _, err := fmt.Sscanf(last, "/page/%04d", &i); err != nil {
+			t.Fatal(err)
+		}
+		for k, inserted := range map[datastore.Key]map[string]bool{key(i - 1): before, key(i + 1): after} {
+			if err := d.Put(ctx, k, []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			inserted[k.String()] = true
+		}
+		if err := d.Delete(ctx, datastore.NewKey(last)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	seen := make(map[string]bool)
+	for i, k := range keys {
+		if seen[k] {
+			t.Fatalf("%s returned twice", k)
+		}
+		seen[k] = true
+		if i > 0 && k <= keys[i-1] {
+			t.Fatalf("expected keys in order, got %s after %s", k, keys[i-1])
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		if !seen[key(i).String()] {
+			t.Fatalf("expected %s to be returned", key(i))
+		}
+	}
+	for k := range after {
+		if !seen[k] {
+			t.Fatalf("expected %s, put after the cursor, to be returned", k)
+		}
+	}
+	for k := range before {
+		if seen[k] && !after[k] {
+			t.Fatalf("expected %s, put before the cursor, not to be returned", k)
+		}
+	}
+	if len(keys) != 500+len(after) {
+		t.Fatalf("expected %d keys, got %d", 500+len(after), len(keys))
+	}
+
+	if _, err := d.QueryAfter(ctx, "/page", "not a cursor!", 10); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// Persisted reads.
+//
+// GetPersisted and QueryPersisted only see the data that has been flushed to
+// sstables, ignoring the memtables, i.e. the state of the store as of the last
+// flush (see pebble.IterOptions.OnlyReadGuaranteedDurable). This lines reads
+// up with what tools processing sstables externally, or checkpoints, see.
+//
+// Persisted is stricter than durable: writes synced to the WAL survive a
+// crash, but stay invisible to these reads until their memtable is flushed.
+// Pebble defines this option as reading the guaranteed-durable state and only
+// happens to implement it by ignoring memtables, so this relies on the
+// current Pebble behaviour.
+
+// GetPersisted is like Get, but only reads data that has been flushed to
+// sstables. Flushed data that has since been overwritten or deleted in the
+// memtables is still returned.
+func (d *Datastore) GetPersisted(ctx context.Context, key ds.Key) ([]byte, error) {
+	k := key.Bytes()
+	iter, err := d.db.NewIterWithContext(ctx, &pebble.IterOptions{
+		LowerBound:                k,
+		UpperBound:                append(k[:len(k):len(k)], 0),
+		OnlyReadGuaranteedDurable: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	if !iter.First() || !bytes.Equal(iter.Key(), k) {
+		if err := iter.Error(); err != nil {
+			return nil, fmt.Errorf("pebble error during persisted get: %w", err)
+		}
+		return nil, ds.ErrNotFound
+	}
+	val, err := iter.ValueAndErr()
+	if err != nil {
+		return nil, fmt.Errorf("pebble error during persisted get: %w", err)
+	}
+	val, err = d.decodeValue(k, val)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(val), nil
+}
+
+// QueryPersisted is like Query, but only reads data that has been flushed to
+// sstables.
+func (d *Datastore) QueryPersisted(ctx context.Context, q query.Query) (query.Results, error) {
+	opts, ok := d.queryIterOptions(q)
+	if !ok {
+		return query.ResultsWithEntries(q, []query.Entry{}), nil
+	}
+	opts.OnlyReadGuaranteedDurable = true
+	return d.query(ctx, d.db, q, opts)
+}
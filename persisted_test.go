@@ -0,0 +1,54 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestPersistedReads(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := datastore.NewKey("/persisted/a")
+	if err := d.Put(ctx, key, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	persisted := func() (int, error) {
+		t.Helper()
+		res, err := d.QueryPersisted(ctx, query.Query{Prefix: "/persisted"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.GetPersisted(ctx, key)
+		return len(entries), err
+	}
+
+	// still in the memtable.
+	if n, err := persisted(); n != 0 || !errors.Is(err, datastore.ErrNotFound) {
+		t.Fatalf("expected unflushed data to be invisible, got %d entries and %v", n, err)
+	}
+	if _, err := d.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := persisted(); n != 1 || err != nil {
+		t.Fatalf("expected flushed data to be visible, got %d entries and %v", n, err)
+	}
+	val, err := d.GetPersisted(ctx, key)
+	if err != nil || string(val) != "val" {
+		t.Fatalf("unexpected value %q: %v", val, err)
+	}
+}
@@ -0,0 +1,108 @@
+package pebbleds
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// prefetchedEntry is an entry read ahead of a ScanPrefix callback.
+type prefetchedEntry struct {
+	key   string
+	value []byte
+	err   error
+}
+
+// scanPrefetched runs the ScanPrefix callback over the entries of iter, which
+// a background goroutine reads ahead, values included, up to n entries past
+// the one the callback is given. It returns the error of the callback, if
+// any, along with whether the scan ran through the whole iterator.
+func (d *Datastore) scanPrefetched(ctx context.Context, iter *pebble.Iterator, n int, fn func(e *LazyEntry) error) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	entries := make(chan prefetchedEntry, n)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(entries)
+		for iter.First(); iter.Valid(); iter.Next() {
+			e := prefetchedEntry{key: string(iter.Key())}
+			val, err := iter.ValueAndErr()
+			if err == nil {
+				val, err = d.decodeValue(iter.Key(), val)
+			}
+			e.value, e.err = append([]byte(nil), val...), err
+			select {
+			case entries <- e:
+			case <-ctx.Done():
+				return
+			case <-d.closing:
+				return
+			}
+		}
+	}()
+	// the iterator must not be used past the return of the scan.
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	e := LazyEntry{ds: d, prefetched: true}
+	for pe := range entries {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		e.Key, e.value, e.valueErr = pe.key, pe.value, pe.err
+		if err := fn(&e); err != nil {
+			return false, err
+		}
+	}
+	select {
+	case <-d.closing:
+		return false, ErrClosed
+	default:
+	}
+	return true, ctx.Err()
+}
+
+// prefetchResults reads the results ahead on a background goroutine, up to n
+// results past the one being consumed, until they are closed.
+func prefetchResults(q query.Query, res query.Results, n int) query.Results {
+	results := make(chan query.Result, n)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(results)
+		for {
+			r, ok := res.NextSync()
+			if !ok {
+				return
+			}
+			select {
+			case results <- r:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var closeOnce sync.Once
+	var closeErr error
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			r, ok := <-results
+			return r, ok
+		},
+		Close: func() error {
+			closeOnce.Do(func() {
+				close(stop)
+				// unblocks the goroutine if it is waiting on the results.
+				closeErr = res.Close()
+				<-done
+			})
+			return closeErr
+		},
+	})
+}
@@ -0,0 +1,347 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// prefixUpperBound returns the smallest key that is greater than every key
+// starting with prefix, or nil if there is no such key.
+func prefixUpperBound(prefix []byte) []byte {
+	// if the prefix is 0x01..., we want 0x02 as an upper bound.
+	// if the prefix is 0x0000ff..., we want 0x0001 as an upper bound.
+	// if the prefix is 0x0000ff01..., we want 0x0000ff02 as an upper bound.
+	// if the prefix is 0xffffff..., we don't want an upper bound.
+	// if the prefix is 0xff..., we don't want an upper bound.
+	// if the prefix is empty, we don't want an upper bound.
+	// basically, we want to find the last byte that can be lexicographically incremented.
+	var upper []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		b := prefix[i]
+		if b == 0xff {
+			continue
+		}
+		upper = make([]byte, i+1)
+		copy(upper, prefix)
+		upper[i] = b + 1
+		break
+	}
+	return upper
+}
+
+// deleteRange adds the deletion of every key in [lower, upper) to the batch.
+// A nil upper bound means there is no upper bound, which a range tombstone
+// cannot express, so the range then ends right after the last key stored.
+func (d *Datastore) deleteRange(ctx context.Context, b *pebble.Batch, lower, upper []byte) error {
+	if upper != nil {
+		return b.DeleteRange(lower, upper, nil)
+	}
+
+	iter, err := d.db.NewIterWithContext(ctx, &pebble.IterOptions{LowerBound: lower})
+	if err != nil {
+		return err
+	}
+	if !iter.Last() {
+		return iter.Close()
+	}
+	upper = append(bytes.Clone(iter.Key()), 0)
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return b.DeleteRange(lower, upper, nil)
+}
+
+// deleteUserRange is like deleteRange, but leaves out the keys under the
+// reserved prefix, failing with ErrReservedKey if the range lies within it.
+// The metadata of the deleted keys is deleted along with them.
+func (d *Datastore) deleteUserRange(ctx context.Context, b *pebble.Batch, lower, upper []byte) error {
+	reserved := []byte(d.conf.reservedPrefix)
+	if bytes.HasPrefix(lower, reserved) {
+		return fmt.Errorf("%w: range %q is under the reserved prefix", ErrReservedKey, lower)
+	}
+	if d.conf.metadata {
+		meta := d.reservedKey(metaName)
+		metaUpper := prefixUpperBound(meta)
+		if upper != nil {
+			metaUpper = append(meta[:len(meta):len(meta)], upper...)
+		}
+		if err := d.deleteRange(ctx, b, append(meta, lower...), metaUpper); err != nil {
+			return err
+		}
+	}
+	// the range may span the reserved prefix, in which case it is split in
+	// two around it.
+	if bytes.HasPrefix(reserved, lower) && (upper == nil || bytes.Compare(reserved, upper) < 0) {
+		if err := d.deleteRange(ctx, b, lower, reserved); err != nil {
+			return err
+		}
+		if lower = prefixUpperBound(reserved); lower == nil {
+			return nil
+		}
+	}
+	return d.deleteRange(ctx, b, lower, upper)
+}
+
+// DeleteRange atomically deletes every key under prefix, which is interpreted
+// as in Query, according to the configured PrefixMode, with a single range
+// deletion rather than a tombstone per key. An empty prefix deletes every
+// key. The internal keys under the reserved prefix are left untouched, and
+// DeleteRange does not maintain secondary indexes.
+func (d *Datastore) DeleteRange(ctx context.Context, prefix ds.Key) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	lower, upper := d.prefixBounds(prefix.String())
+	b := d.db.NewBatch()
+	defer b.Close()
+	if err := d.deleteUserRange(ctx, b, lower, upper); err != nil {
+		return fmt.Errorf("pebble error during delete range within batch: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.Commit(d.writeOptions()); err != nil {
+		return fmt.Errorf("pebble error during delete range: %w", err)
+	}
+	d.bumpGeneration()
+	return nil
+}
+
+// DeleteRange adds the deletion of every key under prefix to the batch, like
+// Datastore.DeleteRange. Keys put within the batch afterwards survive the
+// deletion, while keys put earlier are deleted with the others. The deleted
+// keys are not reported to the OnCommit hooks, which only see the keys
+// deleted with Delete.
+func (b *Batch) DeleteRange(ctx context.Context, prefix ds.Key) error {
+	lower, upper := b.ds.prefixBounds(prefix.String())
+	if err := b.ds.deleteUserRange(ctx, b.batch, lower, upper); err != nil {
+		return fmt.Errorf("pebble error during delete range within batch: %w", err)
+	}
+	return nil
+}
+
+// ReplacePrefix atomically replaces all the keys under prefix with the given
+// entries: readers either see the entire old set of keys or the entire new
+// one, never a mix of both. The prefix is interpreted as in Query, according
+// to the configured PrefixMode, and every entry must fall under it. Keys
+// outside of the prefix, including the internal ones under the reserved
+// prefix, are left untouched. Secondary indexes are maintained as by Put, and
+// the metadata of the replaced keys is removed.
+func (d *Datastore) ReplacePrefix(ctx context.Context, prefix ds.Key, entries []query.Entry) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	lower, upper := d.prefixBounds(prefix.String())
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		k := ds.NewKey(e.Key).Bytes()
+		if !bytes.HasPrefix(k, lower) {
+			return fmt.Errorf("entry %s is not under prefix %s", e.Key, lower)
+		}
+		if err := d.checkKeySize(k); err != nil {
+			return err
+		}
+		if err := d.checkUserKey(k); err != nil {
+			return err
+		}
+		keys[i] = k
+	}
+
+	b := d.db.NewBatch()
+	defer b.Close()
+
+	if err := d.deleteUserRange(ctx, b, lower, upper); err != nil {
+		return fmt.Errorf("pebble error during delete range within batch: %w", err)
+	}
+	for i, e := range entries {
+		if err := b.Set(keys[i], d.encodeValue(e.Value), nil); err != nil {
+			return fmt.Errorf("pebble error during set within batch: %w", err)
+		}
+	}
+	if atomic.LoadInt32(&d.indexed) != 0 {
+		d.indexMu.Lock()
+		defer d.indexMu.Unlock()
+		if err := d.replaceIndexOps(ctx, b, lower, upper, entries); err != nil {
+			return fmt.Errorf("pebble error updating indexes: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.Commit(d.writeOptions()); err != nil {
+		return err
+	}
+	d.bumpGeneration()
+	return nil
+}
+
+// replaceIndexOps adds to the batch the index updates of ReplacePrefix: the
+// deletion of every key stored within [lower, upper), followed by the writes
+// of the new entries. The caller must hold d.indexMu.
+func (d *Datastore) replaceIndexOps(ctx context.Context, b *pebble.Batch, lower, upper []byte, entries []query.Entry) error {
+	opts, _ := d.userIterOptions(lower, upper)
+	iter, err := d.db.NewIterWithContext(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	var ops []indexOp
+	for iter.First(); iter.Valid(); iter.Next() {
+		ops = append(ops, indexOp{key: ds.RawKey(string(iter.Key())), delete: true})
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ops = append(ops, indexOp{key: ds.NewKey(e.Key), value: e.Value})
+	}
+	return d.applyIndexOps(b, ops)
+}
+
+// QueryPrefixes runs the query over the union of several prefixes, each
+// interpreted as in Query, streaming a single result set. The query must not
+// set a Prefix; offset and limit apply to the combined results.
+//
+// Prefixes nested within others are dropped, so every key is returned once
+// even if the prefixes overlap. As prefixes cover disjoint key ranges
+// otherwise, results are returned in key order unless ordered otherwise,
+// running one prefix after the other. Orders other than by key are applied in
+// memory over the combined results.
+func (d *Datastore) QueryPrefixes(ctx context.Context, prefixes []string, q query.Query) (query.Results, error) {
+	if q.Prefix != "" {
+		return nil, errors.New("multi-prefix queries do not support prefixes")
+	}
+
+	// sort the prefixes by the keys they match, and drop the nested ones.
+	type prefixRange struct {
+		prefix string
+		lower  string
+	}
+	ranges := make([]prefixRange, len(prefixes))
+	for i, p := range prefixes {
+		ranges[i] = prefixRange{prefix: p, lower: d.queryPrefix(p)}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].lower < ranges[j].lower
+	})
+	disjoint := ranges[:0]
+	for _, r := range ranges {
+		if len(disjoint) > 0 && strings.HasPrefix(r.lower, disjoint[len(disjoint)-1].lower) {
+			continue
+		}
+		disjoint = append(disjoint, r)
+	}
+
+	base := q
+	base.Offset, base.Limit = 0, 0
+	naive := query.Query{Offset: q.Offset, Limit: q.Limit}
+	if len(q.Orders) == 1 {
+		switch q.Orders[0].(type) {
+		case query.OrderByKeyDescending, *query.OrderByKeyDescending:
+			for i, j := 0, len(disjoint)-1; i < j; i, j = i+1, j-1 {
+				disjoint[i], disjoint[j] = disjoint[j], disjoint[i]
+			}
+		case query.OrderByKey, *query.OrderByKey:
+		default:
+			base.Orders, naive.Orders = nil, q.Orders
+		}
+	} else if len(q.Orders) > 1 {
+		base.Orders, naive.Orders = nil, q.Orders
+	}
+
+	var current query.Results
+	next := 0
+	combined := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				if current == nil {
+					if next == len(disjoint) {
+						return query.Result{}, false
+					}
+					sub := base
+					sub.Prefix = disjoint[next].prefix
+					next++
+					res, err := d.Query(ctx, sub)
+					if err != nil {
+						return query.Result{Error: err}, true
+					}
+					current = res
+				}
+				r, ok := current.NextSync()
+				if ok {
+					return r, true
+				}
+				if err := current.Close(); err != nil {
+					return query.Result{Error: err}, true
+				}
+				current = nil
+			}
+		},
+		Close: func() error {
+			if current == nil {
+				return nil
+			}
+			return current.Close()
+		},
+	})
+	return query.NaiveQueryApply(naive, combined), nil
+}
+
+// FirstKey returns the first entry under prefix, in key order, seeking
+// straight to it rather than scanning the prefix. The prefix is interpreted as
+// in Query, according to the configured PrefixMode. It fails with
+// ds.ErrNotFound if there is no entry under the prefix. Like Query, it reads
+// from the snapshot of WithSnapshotReads when enabled.
+func (d *Datastore) FirstKey(ctx context.Context, prefix string) (ds.Key, []byte, error) {
+	return d.edgeKey(ctx, prefix, (*pebble.Iterator).First)
+}
+
+// LastKey returns the last entry under prefix, in key order, like FirstKey.
+func (d *Datastore) LastKey(ctx context.Context, prefix string) (ds.Key, []byte, error) {
+	return d.edgeKey(ctx, prefix, (*pebble.Iterator).Last)
+}
+
+func (d *Datastore) edgeKey(ctx context.Context, prefix string, seek func(*pebble.Iterator) bool) (ds.Key, []byte, error) {
+	if err := d.acquire(); err != nil {
+		return ds.Key{}, nil, err
+	}
+	defer d.wg.Done()
+
+	opts, ok := d.userIterOptions(d.prefixBounds(prefix))
+	if !ok {
+		return ds.Key{}, nil, ds.ErrNotFound
+	}
+	iter, err := d.queryReader().NewIterWithContext(ctx, &opts)
+	if err != nil {
+		return ds.Key{}, nil, err
+	}
+	defer iter.Close()
+
+	if !seek(iter) {
+		if err := iter.Error(); err != nil {
+			return ds.Key{}, nil, fmt.Errorf("pebble error during seek: %w", err)
+		}
+		return ds.Key{}, nil, ds.ErrNotFound
+	}
+	val, err := iter.ValueAndErr()
+	if err != nil {
+		return ds.Key{}, nil, fmt.Errorf("pebble error reading value: %w", err)
+	}
+	val, err = d.decodeValue(iter.Key(), val)
+	if err != nil {
+		return ds.Key{}, nil, err
+	}
+	return ds.RawKey(string(iter.Key())), append([]byte{}, val...), nil
+}
@@ -0,0 +1,487 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestPrefixUpperBound(t *testing.T) {
+	tcs := []struct {
+		prefix, upper []byte
+	}{
+		{[]byte{0x01}, []byte{0x02}},
+		{[]byte{0x00, 0x00, 0xff}, []byte{0x00, 0x01}},
+		{[]byte{0x00, 0x00, 0xff, 0x01}, []byte{0x00, 0x00, 0xff, 0x02}},
+		{[]byte{0xff, 0xff, 0xff}, nil},
+		{[]byte{0xff}, nil},
+		{[]byte{}, nil},
+		{[]byte("/a/"), []byte("/a0")},
+	}
+	for _, tc := range tcs {
+		if got := prefixUpperBound(tc.prefix); string(got) != string(tc.upper) || (got == nil) != (tc.upper == nil) {
+			t.Errorf("prefix %x: expected upper bound %x, got %x", tc.prefix, tc.upper, got)
+		}
+	}
+}
+
+func TestReplacePrefix(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/p", "/p/old-1", "/p/old-2", "/pp", "/q/x"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := d.ReplacePrefix(ctx, datastore.NewKey("/p"), []query.Entry{
+		{Key: "/p/new-1", Value: []byte("1")},
+		{Key: "/p/new-2/x", Value: []byte("2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Key)
+	}
+	expected := "/a /p /p/new-1 /p/new-2/x /pp /q/x"
+	if strings.Join(got, " ") != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	err = d.ReplacePrefix(ctx, datastore.NewKey("/p"), []query.Entry{{Key: "/q/y"}})
+	if err == nil {
+		t.Fatal("expected an error replacing with an entry outside the prefix")
+	}
+	if has, _ := d.Has(ctx, datastore.NewKey("/p/new-1")); !has {
+		t.Fatal("expected a failed replace to leave the prefix untouched")
+	}
+}
+
+func TestReplacePrefixIndexesAndMetadata(t *testing.T) {
+	d, cleanup := newDatastore(t, WithMetadata(true), WithReservedPrefix("/.pebbleds/"))
+	defer cleanup()
+
+	ctx := context.Background()
+	err := d.RegisterIndex("value", func(key datastore.Key, value []byte) []datastore.Key {
+		return []datastore.Key{datastore.NewKey(string(value))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/p/old", "/p/kept"} {
+		if err := d.PutWithMeta(ctx, datastore.NewKey(k), []byte("red"), []byte("m")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with a custom reserved prefix, the root prefix spans the internal keys.
+	err = d.ReplacePrefix(ctx, datastore.NewKey("/"), []query.Entry{
+		{Key: "/p/kept", Value: []byte("blue")},
+		{Key: "/p/new", Value: []byte("red")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(color string, keys ...string) {
+		t.Helper()
+		got, err := d.QueryIndex(ctx, "value", datastore.NewKey(color))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotKeys := make([]string, len(got))
+		for i, k := range got {
+			gotKeys[i] = k.String()
+		}
+		if strings.Join(gotKeys, " ") != strings.Join(keys, " ") {
+			t.Fatalf("expected %s to index %v, got %v", color, keys, gotKeys)
+		}
+	}
+	expect("red", "/p/new")
+	expect("blue", "/p/kept")
+
+	res, err := d.QueryMeta(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta) != 0 {
+		t.Fatalf("expected the metadata of the replaced keys to be removed, got %v", meta)
+	}
+
+	cleanup()
+	if err := d.ReplacePrefix(ctx, datastore.NewKey("/p"), nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	keys := []string{"/a", "/a/b", "/a/b/c", "/a/c", "/ab", "/a\xff", "/a\xff\xff", "/a\xffz", "/b"}
+	tcs := []struct {
+		name   string
+		mode   PrefixMode
+		prefix datastore.Key
+		left   string
+	}{
+		{"nested", NamespacedPrefix, datastore.NewKey("/a"), "/a /ab /a\xff /a\xff\xff /a\xffz /b"},
+		{"nested deeper", NamespacedPrefix, datastore.NewKey("/a/b"), "/a /a/b /a/c /ab /a\xff /a\xff\xff /a\xffz /b"},
+		{"root", NamespacedPrefix, datastore.Key{}, ""},
+		{"raw", RawPrefix, datastore.RawKey("/a/b"), "/a /a/c /ab /a\xff /a\xff\xff /a\xffz /b"},
+		{"raw ending in 0xff", RawPrefix, datastore.RawKey("/a\xff"), "/a /a/b /a/b/c /a/c /ab /b"},
+		// an empty raw prefix has no upper bound, and spans the reserved
+		// prefix.
+		{"raw empty", RawPrefix, datastore.Key{}, ""},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, WithPrefixMode(tc.mode), WithMetadata(true))
+			defer cleanup()
+
+			ctx := context.Background()
+			for _, k := range keys {
+				if err := d.PutWithMeta(ctx, datastore.RawKey(k), []byte(k), []byte("meta")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			internal := d.reservedKey("internal")
+			if err := d.db.Set(internal, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.DeleteRange(ctx, tc.prefix); err != nil {
+				t.Fatal(err)
+			}
+
+			var left []string
+			for _, k := range keys {
+				has, err := d.Has(ctx, datastore.RawKey(k))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, closer, err := d.db.Get(d.metaKey(datastore.RawKey(k)))
+				if err == nil {
+					_ = closer.Close()
+				}
+				if hasMeta := err == nil; has != hasMeta {
+					t.Fatalf("%q: expected the metadata to go with the value", k)
+				}
+				if has {
+					left = append(left, k)
+				}
+			}
+			if strings.Join(left, " ") != tc.left {
+				t.Fatalf("expected %q left, got %q", tc.left, left)
+			}
+			if _, closer, err := d.db.Get(internal); err != nil {
+				t.Fatalf("expected reserved keys to be left untouched: %v", err)
+			} else {
+				_ = closer.Close()
+			}
+		})
+	}
+}
+
+func TestBatchDeleteRange(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/p/1", "/p/2", "/q"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := b.(*Batch)
+	if err := batch.Put(ctx, datastore.NewKey("/p/before"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.DeleteRange(ctx, datastore.NewKey("/p")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put(ctx, datastore.NewKey("/p/after"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(ctx, datastore.NewKey("/p/1")); !has {
+		t.Fatal("expected the deletion to wait for the commit")
+	}
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range queryEntries(t, d, query.Query{KeysOnly: true, Orders: []query.Order{query.OrderByKey{}}}) {
+		got = append(got, e.Key)
+	}
+	if expected := "/a /p/after /q"; strings.Join(got, " ") != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestReplacePrefixAtomic(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	const n = 100
+	set := func(gen int) []query.Entry {
+		entries := make([]query.Entry, n)
+		for i := range entries {
+			// generations use distinct keys, so a mix is detectable.
+			entries[i] = query.Entry{
+				Key:   fmt.Sprintf("/p/%d-%03d", gen, i),
+				Value: []byte(fmt.Sprint(gen)),
+			}
+		}
+		return entries
+	}
+
+	ctx := context.Background()
+	if err := d.ReplacePrefix(ctx, datastore.NewKey("/p"), set(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				res, err := d.Query(ctx, query.Query{Prefix: "/p"})
+				if err != nil {
+					errs <- err
+					return
+				}
+				entries, err := res.Rest()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(entries) != n {
+					errs <- fmt.Errorf("expected %d entries, got %d", n, len(entries))
+					return
+				}
+				for _, e := range entries {
+					if string(e.Value) != string(entries[0].Value) {
+						errs <- fmt.Errorf("observed a mix of generations %s and %s", entries[0].Value, e.Value)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for gen := 1; gen <= 50; gen++ {
+		if err := d.ReplacePrefix(ctx, datastore.NewKey("/p"), set(gen)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryPrefixes(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"/blocks/a", "/blocks/b", "/other/a", "/pins/a", "/pins/b", "/pins/c/d"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcs := []struct {
+		name     string
+		prefixes []string
+		q        query.Query
+		expect   []string
+	}{
+		{
+			name:     "union",
+			prefixes: []string{"/pins", "/blocks"},
+			expect:   []string{"/blocks/a", "/blocks/b", "/pins/a", "/pins/b", "/pins/c/d"},
+		},
+		{
+			name:     "overlapping",
+			prefixes: []string{"/pins/c", "/pins", "/blocks", "/blocks"},
+			expect:   []string{"/blocks/a", "/blocks/b", "/pins/a", "/pins/b", "/pins/c/d"},
+		},
+		{
+			name:     "descending",
+			prefixes: []string{"/blocks", "/pins"},
+			q:        query.Query{Orders: []query.Order{query.OrderByKeyDescending{}}},
+			expect:   []string{"/pins/c/d", "/pins/b", "/pins/a", "/blocks/b", "/blocks/a"},
+		},
+		{
+			name:     "offset and limit across prefixes",
+			prefixes: []string{"/blocks", "/pins"},
+			q:        query.Query{Offset: 1, Limit: 3},
+			expect:   []string{"/blocks/b", "/pins/a", "/pins/b"},
+		},
+		{
+			name:     "value order",
+			prefixes: []string{"/blocks", "/pins"},
+			q:        query.Query{Orders: []query.Order{query.OrderByValueDescending{}}, Limit: 2},
+			expect:   []string{"/pins/c/d", "/pins/b"},
+		},
+		{
+			name:     "none",
+			prefixes: nil,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.QueryPrefixes(ctx, tc.prefixes, tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Key)
+			}
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestFirstLastKey(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		mode        PrefixMode
+		keys        []string
+		prefix      string
+		first, last string
+	}{
+		{
+			name:   "namespaced",
+			keys:   []string{"/a", "/b", "/b/1", "/b/2/x", "/b/3", "/bb", "/c"},
+			prefix: "/b",
+			first:  "/b/1",
+			last:   "/b/3",
+		},
+		{
+			name:   "root",
+			keys:   []string{"/a", "/b/1", "/c"},
+			prefix: "/",
+			first:  "/a",
+			last:   "/c",
+		},
+		{
+			name:   "0xff prefix",
+			mode:   RawPrefix,
+			keys:   []string{"/\xfe", "/\xff", "/\xff\x00", "/\xff\xff", "/\xff\xff\xff"},
+			prefix: "/\xff",
+			first:  "/\xff",
+			last:   "/\xff\xff\xff",
+		},
+		{
+			name:   "0xff suffix",
+			mode:   RawPrefix,
+			keys:   []string{"/a\xfe", "/a\xff", "/a\xff\xff", "/b"},
+			prefix: "/a\xff",
+			first:  "/a\xff",
+			last:   "/a\xff\xff",
+		},
+		{
+			name:   "uncleaned keys",
+			mode:   RawPrefix,
+			keys:   []string{"/x/a//b", "/x/b//c", "/y"},
+			prefix: "/x/",
+			first:  "/x/a//b",
+			last:   "/x/b//c",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, WithPrefixMode(tc.mode))
+			defer cleanup()
+			for _, k := range tc.keys {
+				if err := d.Put(ctx, datastore.RawKey(k), []byte("value of "+k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for name, get := range map[string]func(context.Context, string) (datastore.Key, []byte, error){
+				tc.first: d.FirstKey,
+				tc.last:  d.LastKey,
+			} {
+				key, value, err := get(ctx, tc.prefix)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key.String() != name || string(value) != "value of "+name {
+					t.Fatalf("expected %q, got %q=%q", name, key, value)
+				}
+			}
+
+			if _, _, err := d.FirstKey(ctx, "/empty"); !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound for an empty prefix, got %v", err)
+			}
+			if _, _, err := d.LastKey(ctx, "/empty"); !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound for an empty prefix, got %v", err)
+			}
+		})
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		d, cleanup := newDatastore(t)
+		defer cleanup()
+		if err := d.Put(ctx, datastore.NewKey("/a"), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := d.FirstKey(ctx, "/"); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+		if _, _, err := d.LastKey(ctx, "/"); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package pebbleds
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+)
+
+// Tuning presets.
+//
+// WriteOptimized, ReadOptimized and Balanced are Options that tune Pebble for
+// common workload profiles, as a starting point rather than a replacement for
+// measuring the target workload. They override the corresponding fields of the
+// pebble.Options passed to NewDatastore, and later options override them in
+// turn, e.g. WithMemTableStopWritesThreshold passed after a preset.
+
+// bloomBitsPerKey is the size of the bloom filters set by the presets, good
+// for a 1% false positive rate.
+const bloomBitsPerKey = 10
+
+// WriteOptimized tunes Pebble for sustained ingest with rare reads, such as
+// log ingestion: large memtables absorb bursts and build fewer, larger L0
+// files, more compactions run at once, and L0 is left to grow further before
+// compacting or stalling writes. Reads pay for it with higher read
+// amplification. Memtables can take up to 256MiB.
+func WriteOptimized() Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.EnsureDefaults()
+			o.MemTableSize = 64 << 20
+			o.MemTableStopWritesThreshold = 4
+			o.L0CompactionThreshold = 8
+			o.L0StopWritesThreshold = 40
+			o.LBaseMaxBytes = 512 << 20
+			o.MaxConcurrentCompactions = func() int { return 4 }
+		})
+	}
+}
+
+// ReadOptimized tunes Pebble for read-heavy workloads: bloom filters on every
+// level let lookups of missing keys skip sstables, and L0 is compacted as
+// soon as it holds two files to keep read amplification low, at the cost of
+// more compaction work per write.
+func ReadOptimized() Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.EnsureDefaults()
+			setBloomFilters(o, bloomBitsPerKey)
+			o.MemTableSize = 16 << 20
+			o.MemTableStopWritesThreshold = 2
+			o.L0CompactionThreshold = 2
+			o.L0StopWritesThreshold = 12
+			o.MaxConcurrentCompactions = func() int { return 2 }
+		})
+	}
+}
+
+// Balanced tunes Pebble for mixed workloads: bloom filters on every level, and
+// memtables larger than Pebble's defaults, with its default L0 thresholds.
+func Balanced() Option {
+	return func(c *config) {
+		c.pebbleOpts = append(c.pebbleOpts, func(o *pebble.Options) {
+			o.EnsureDefaults()
+			setBloomFilters(o, bloomBitsPerKey)
+			o.MemTableSize = 32 << 20
+			o.MemTableStopWritesThreshold = 2
+			o.L0CompactionThreshold = 4
+			o.L0StopWritesThreshold = 12
+			o.MaxConcurrentCompactions = func() int { return 2 }
+		})
+	}
+}
+
+// setBloomFilters sets bloom filters of bitsPerKey bits per key on every
+// level, or removes them if bitsPerKey <= 0.
+func setBloomFilters(o *pebble.Options, bitsPerKey int) {
+	for i := range o.Levels {
+		if bitsPerKey <= 0 {
+			o.Levels[i].FilterPolicy = nil
+			continue
+		}
+		o.Levels[i].FilterPolicy = bloom.FilterPolicy(bitsPerKey)
+		o.Levels[i].FilterType = pebble.TableFilter
+	}
+}
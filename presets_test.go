@@ -0,0 +1,65 @@
+package pebbleds
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestPresets(t *testing.T) {
+	tcs := []struct {
+		name        string
+		preset      Option
+		memTable    uint64
+		stopWrites  int
+		l0Compact   int
+		l0Stop      int
+		compactions int
+		filters     bool
+	}{
+		{"write optimized", WriteOptimized(), 64 << 20, 4, 8, 40, 4, false},
+		{"read optimized", ReadOptimized(), 16 << 20, 2, 2, 12, 2, true},
+		{"balanced", Balanced(), 32 << 20, 2, 4, 12, 2, true},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, tc.preset)
+			defer cleanup()
+
+			o := d.opts
+			if o.MemTableSize != tc.memTable || o.MemTableStopWritesThreshold != tc.stopWrites {
+				t.Fatalf("unexpected memtable settings: %d bytes, %d memtables", o.MemTableSize, o.MemTableStopWritesThreshold)
+			}
+			if o.L0CompactionThreshold != tc.l0Compact || o.L0StopWritesThreshold != tc.l0Stop {
+				t.Fatalf("unexpected L0 thresholds: %d, %d", o.L0CompactionThreshold, o.L0StopWritesThreshold)
+			}
+			if n := o.MaxConcurrentCompactions(); n != tc.compactions {
+				t.Fatalf("expected %d concurrent compactions, got %d", tc.compactions, n)
+			}
+			for i, l := range o.Levels {
+				if hasFilter := l.FilterPolicy != nil; hasFilter != tc.filters {
+					t.Fatalf("expected filters on level %d to be %t", i, tc.filters)
+				}
+			}
+		})
+	}
+
+	// later options win.
+	d, cleanup := newDatastore(t, WriteOptimized(), WithMemTableStopWritesThreshold(8))
+	defer cleanup()
+	if n := d.opts.MemTableStopWritesThreshold; n != 8 {
+		t.Fatalf("expected the later option to win, got %d", n)
+	}
+
+	// presets also apply to user provided options.
+	opts := &pebble.Options{}
+	d2, err := NewDatastoreWithOptions(t.TempDir(), opts, ReadOptimized())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if d2.opts.L0CompactionThreshold != 2 || d2.opts.Levels[0].FilterPolicy == nil {
+		t.Fatal("expected the preset to apply")
+	}
+}
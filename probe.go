@@ -0,0 +1,109 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ProbeResult is the outcome of probing a single key with ProbeMany.
+type ProbeResult struct {
+	Key    ds.Key
+	Exists bool
+	// Value holds a copy of the stored value, or nil if the key is absent.
+	Value []byte
+}
+
+// ProbeMany checks for the existence of many keys at once and reads the
+// values of those that exist. Results are returned in the same order as the
+// given keys.
+//
+// This is the combined equivalent of calling Has and then Get for every key:
+// it reads from the same state, the snapshot of WithSnapshotReads if enabled,
+// and goes through the read circuit breaker as a single read. The keys are
+// looked up in sorted order with a single iterator, seeking each of them by
+// prefix so that the bloom filters of the sstables skip the absent ones, as
+// for Has. Over keys flushed to sstables, half of them absent, this is several
+// times cheaper than Has then Get (see BenchmarkProbeMany).
+func (d *Datastore) ProbeMany(ctx context.Context, keys []ds.Key) ([]ProbeResult, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.wg.Done()
+
+	res := make([]ProbeResult, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	var probe bool
+	if d.breaker != nil {
+		var err error
+		if probe, err = d.breaker.allow(); err != nil {
+			return nil, err
+		}
+	}
+	err := d.probeMany(ctx, keys, res)
+	if d.breaker != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			d.breaker.abandon(probe)
+		} else {
+			d.breaker.record(probe, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (d *Datastore) probeMany(ctx context.Context, keys []ds.Key, res []ProbeResult) error {
+	raw := make([][]byte, len(keys))
+	order := make([]int, len(keys))
+	for i, k := range keys {
+		res[i].Key = k
+		raw[i] = k.Bytes()
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(raw[order[i]], raw[order[j]]) < 0
+	})
+
+	last := raw[order[len(order)-1]]
+	iter, err := d.queryReader().NewIterWithContext(ctx, &pebble.IterOptions{
+		LowerBound: raw[order[0]],
+		UpperBound: append(last[:len(last):len(last)], 0),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !iter.SeekPrefixGE(raw[i]) || !bytes.Equal(iter.Key(), raw[i]) {
+			if err := iter.Error(); err != nil {
+				return fmt.Errorf("pebble error during probe: %w", err)
+			}
+			continue
+		}
+		val, err := iter.ValueAndErr()
+		if err != nil {
+			return fmt.Errorf("pebble error during probe: %w", err)
+		}
+		val, err = d.decodeValue(raw[i], val)
+		if err != nil {
+			return err
+		}
+		res[i].Exists = true
+		res[i].Value = make([]byte, len(val))
+		copy(res[i].Value, val)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestProbeMany(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"b", "d", "a/x"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte("val-"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an empty value still exists.
+	if err := d.Put(ctx, datastore.NewKey("e"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("d"),
+		datastore.NewKey("a"),
+		datastore.NewKey("b"),
+		datastore.NewKey("c"),
+		datastore.NewKey("a/x"),
+		datastore.NewKey("e"),
+		datastore.NewKey("z"),
+		datastore.NewKey("b"),
+	}
+	res, err := d.ProbeMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), len(res))
+	}
+
+	expected := map[string][]byte{
+		"/b":   []byte("val-b"),
+		"/d":   []byte("val-d"),
+		"/a/x": []byte("val-a/x"),
+		"/e":   {},
+	}
+	for i, r := range res {
+		if r.Key != keys[i] {
+			t.Fatalf("result %d: expected key %s, got %s", i, keys[i], r.Key)
+		}
+		val, ok := expected[r.Key.String()]
+		if r.Exists != ok {
+			t.Fatalf("key %s: expected exists=%t", r.Key, ok)
+		}
+		if !ok {
+			if r.Value != nil {
+				t.Fatalf("key %s: expected nil value for absent key", r.Key)
+			}
+			continue
+		}
+		if !bytes.Equal(r.Value, val) {
+			t.Fatalf("key %s: expected value %q, got %q", r.Key, val, r.Value)
+		}
+	}
+
+	res, err = d.ProbeMany(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected no results, got %d", len(res))
+	}
+}
+
+func TestProbeManyReads(t *testing.T) {
+	ctx := context.Background()
+	key := datastore.NewKey("/a")
+
+	t.Run("snapshot reads", func(t *testing.T) {
+		d, cleanup := newDatastore(t, WithSnapshotReads(time.Hour))
+		defer cleanup()
+		if err := d.Put(ctx, key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		// like Has, the probe reads from the snapshot, which predates the
+		// write.
+		has, err := d.Has(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := d.ProbeMany(ctx, []datastore.Key{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Exists != has {
+			t.Fatalf("expected the probe to agree with Has (%t)", has)
+		}
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		d, cleanup := newDatastore(t, WithReadCircuitBreaker(1, time.Second, time.Hour))
+		defer cleanup()
+		d.breaker.record(false, errors.New("read failed"))
+		if _, err := d.ProbeMany(ctx, []datastore.Key{key}); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected ErrCircuitOpen, got %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		d, cleanup := newDatastore(t)
+		cleanup()
+		if _, err := d.ProbeMany(ctx, []datastore.Key{key}); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	})
+}
+
+func benchmarkProbeKeys(b *testing.B) (*Datastore, []datastore.Key, func()) {
+	d, cleanup := newDatastore(b)
+
+	ctx := context.Background()
+	keys := make([]datastore.Key, 1000)
+	for i := range keys {
+		keys[i] = datastore.NewKey(fmt.Sprintf("key-%04d", i))
+		// only every other key is present.
+		if i%2 == 0 {
+			if err := d.Put(ctx, keys[i], []byte("value")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	// read from sstables, where absent keys are answered by bloom filters.
+	if err := d.db.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	return d, keys, cleanup
+}
+
+func BenchmarkProbeMany(b *testing.B) {
+	d, keys, cleanup := benchmarkProbeKeys(b)
+	defer cleanup()
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.ProbeMany(ctx, keys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHasThenGet(b *testing.B) {
+	d, keys, cleanup := benchmarkProbeKeys(b)
+	defer cleanup()
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, k := range keys {
+			has, err := d.Has(ctx, k)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !has {
+				continue
+			}
+			if _, err := d.Get(ctx, k); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Package prom exposes the metrics of a pebble Datastore to Prometheus. It is
+// kept apart from the datastore so that only its users depend on the
+// Prometheus client.
+package prom
+
+import (
+	"context"
+	"net/http"
+
+	pebbleds "github.com/ipfs/go-ds-pebble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pebbleds"
+
+var (
+	upDesc = prometheus.NewDesc(namespace+"_up",
+		"Whether the datastore is open.", nil, nil)
+	diskUsageDesc = prometheus.NewDesc(namespace+"_disk_usage_bytes",
+		"Space taken on disk by the datastore.", nil, nil)
+	l0FilesDesc = prometheus.NewDesc(namespace+"_l0_files",
+		"Number of sstables in L0.", nil, nil)
+	readAmpDesc = prometheus.NewDesc(namespace+"_read_amplification",
+		"Number of sorted runs a read may have to look into.", nil, nil)
+	writeAmpDesc = prometheus.NewDesc(namespace+"_write_amplification",
+		"Bytes written to disk per byte written to the datastore, since it was opened.", nil, nil)
+	compactionDebtDesc = prometheus.NewDesc(namespace+"_compaction_debt_bytes",
+		"Estimated bytes to compact for the LSM to reach a stable state.", nil, nil)
+	blockCacheHitRatioDesc = prometheus.NewDesc(namespace+"_block_cache_hit_ratio",
+		"Fraction of block reads served by the block cache, since the datastore was opened.", nil, nil)
+	mutationsDesc = prometheus.NewDesc(namespace+"_mutations_total",
+		"Successful mutations, since the datastore was opened.", nil, nil)
+	openIteratorsDesc = prometheus.NewDesc(namespace+"_open_iterators",
+		"Iterators currently open for queries.", nil, nil)
+	activeQueriesDesc = prometheus.NewDesc(namespace+"_active_queries",
+		"Queries currently streaming results.", nil, nil)
+)
+
+// Collector collects the metrics of a Datastore on every scrape.
+type Collector struct {
+	ds *pebbleds.Datastore
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a Collector for the metrics of d, to be registered
+// with a prometheus.Registerer.
+func NewCollector(d *pebbleds.Datastore) *Collector {
+	return &Collector{ds: d}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		upDesc, diskUsageDesc, l0FilesDesc, readAmpDesc, writeAmpDesc, compactionDebtDesc,
+		blockCacheHitRatioDesc, mutationsDesc, openIteratorsDesc, activeQueriesDesc,
+	} {
+		ch <- d
+	}
+}
+
+// Collect reports the metrics of the Datastore. Once it is closed, only
+// pebbleds_up is reported, as 0.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s, err := c.ds.Status(context.Background())
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	gauge(upDesc, 1)
+	gauge(diskUsageDesc, float64(s.DiskUsageBytes))
+	gauge(l0FilesDesc, float64(s.L0Files))
+	gauge(readAmpDesc, float64(s.ReadAmp))
+	gauge(writeAmpDesc, s.WriteAmp)
+	gauge(compactionDebtDesc, float64(s.CompactionDebtBytes))
+	gauge(blockCacheHitRatioDesc, s.BlockCacheHitRatio)
+	gauge(openIteratorsDesc, float64(c.ds.OpenIterators()))
+	gauge(activeQueriesDesc, float64(len(c.ds.ActiveQueries())))
+	ch <- prometheus.MustNewConstMetric(mutationsDesc, prometheus.CounterValue, float64(c.ds.Generation()))
+}
+
+// Handler returns an http.Handler serving the metrics of d in the Prometheus
+// text format, ready to be mounted on /metrics. It uses a registry of its own,
+// holding only the metrics of d; register a Collector with another registry
+// to serve them along with others.
+func Handler(d *pebbleds.Datastore) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(d))
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,72 @@
+package prom
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	pebbleds "github.com/ipfs/go-ds-pebble"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHandler(t *testing.T) {
+	d, err := pebbleds.NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/b", "/c"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(d)
+	body := scrape(t, h)
+	for _, line := range []string{
+		"pebbleds_up 1",
+		"pebbleds_mutations_total 3",
+		"pebbleds_l0_files 0",
+		"pebbleds_open_iterators 0",
+		"pebbleds_active_queries 0",
+		"# TYPE pebbleds_disk_usage_bytes gauge",
+		"# TYPE pebbleds_block_cache_hit_ratio gauge",
+		"# TYPE pebbleds_compaction_debt_bytes gauge",
+		"# TYPE pebbleds_read_amplification gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected the metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	body = scrape(t, h)
+	if !strings.Contains(body, "pebbleds_up 0\n") || strings.Contains(body, "pebbleds_disk_usage_bytes") {
+		t.Fatalf("expected only pebbleds_up 0 once closed, got:\n%s", body)
+	}
+}
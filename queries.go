@@ -0,0 +1,89 @@
+package pebbleds
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+// QueryInfo describes a query in flight, as listed by ActiveQueries.
+type QueryInfo struct {
+	// ID identifies the query for CancelQuery.
+	ID uint64
+	// Prefix is the prefix of the query, as passed to it.
+	Prefix string
+	// Started is when the query started streaming results.
+	Started time.Time
+}
+
+// queryRegistry tracks the queries in flight, so that they can be listed and
+// cancelled.
+type queryRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*activeQuery
+}
+
+type activeQuery struct {
+	info   QueryInfo
+	cancel context.CancelFunc
+}
+
+// register records a query starting to stream results, and returns its id
+// along with the context it must run under, which CancelQuery cancels.
+func (r *queryRegistry) register(ctx context.Context, q query.Query) (context.Context, uint64) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		r.active = make(map[uint64]*activeQuery)
+	}
+	r.nextID++
+	r.active[r.nextID] = &activeQuery{
+		info:   QueryInfo{ID: r.nextID, Prefix: q.Prefix, Started: time.Now()},
+		cancel: cancel,
+	}
+	return ctx, r.nextID
+}
+
+func (r *queryRegistry) deregister(id uint64) {
+	r.mu.Lock()
+	q := r.active[id]
+	delete(r.active, id)
+	r.mu.Unlock()
+	if q != nil {
+		q.cancel()
+	}
+}
+
+// ActiveQueries lists the queries currently streaming results, oldest first.
+// A query stays listed until its results are exhausted or closed.
+func (d *Datastore) ActiveQueries() []QueryInfo {
+	d.queries.mu.Lock()
+	infos := make([]QueryInfo, 0, len(d.queries.active))
+	for _, q := range d.queries.active {
+		infos = append(infos, q.info)
+	}
+	d.queries.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// CancelQuery cancels the query with the given id, as listed by
+// ActiveQueries: it stops streaming and returns context.Canceled as its last
+// result. It returns false if no such query is in flight.
+func (d *Datastore) CancelQuery(id uint64) bool {
+	d.queries.mu.Lock()
+	q := d.queries.active[id]
+	d.queries.mu.Unlock()
+	if q == nil {
+		return false
+	}
+	q.cancel()
+	return true
+}
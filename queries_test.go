@@ -0,0 +1,182 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/cockroachdb/pebble/vfs/errorfs"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestCancelQuery(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/q/%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := d.Query(ctx, query.Query{Prefix: "/q"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	if r, ok := res.NextSync(); !ok || r.Error != nil {
+		t.Fatalf("expected a first result, got %v %v", r, ok)
+	}
+
+	active := d.ActiveQueries()
+	if len(active) != 1 || active[0].Prefix != "/q" {
+		t.Fatalf("expected the query to be listed, got %v", active)
+	}
+	if !d.CancelQuery(active[0].ID) {
+		t.Fatal("expected the query to be cancelled")
+	}
+
+	var last query.Result
+	n := 1
+	for r := range res.Next() {
+		last = r
+		n++
+	}
+	if !errors.Is(last.Error, context.Canceled) {
+		t.Fatalf("expected the query to end with context.Canceled, got %v", last.Error)
+	}
+	if n > 100 {
+		t.Fatalf("expected the query to stop early, got %d results", n)
+	}
+
+	if active := d.ActiveQueries(); len(active) != 0 {
+		t.Fatalf("expected no query in flight, got %v", active)
+	}
+	if d.CancelQuery(active[0].ID) {
+		t.Fatal("expected cancelling a finished query to fail")
+	}
+}
+
+func TestQueryFilterOffset(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	var all []query.Entry
+	for i := 0; i < 20; i++ {
+		e := query.Entry{Key: fmt.Sprintf("/f/%03d", i), Value: []byte("odd"), Size: 3}
+		if i%2 == 0 {
+			e.Value, e.Size = []byte("even"), 4
+		}
+		if err := d.Put(ctx, datastore.NewKey(e.Key), e.Value); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, e)
+	}
+
+	even := query.FilterValueCompare{Op: query.Equal, Value: []byte("even")}
+	for _, tc := range []struct {
+		name string
+		q    query.Query
+		want string
+	}{
+		// the offset counts the entries matching the filters only.
+		{"offset", query.Query{Filters: []query.Filter{even}, Offset: 3}, "/f/006 /f/008 /f/010 /f/012 /f/014 /f/016 /f/018"},
+		{"offset and limit", query.Query{Filters: []query.Filter{even}, Offset: 3, Limit: 2}, "/f/006 /f/008"},
+		{"descending", query.Query{Filters: []query.Filter{even}, Offset: 3, Limit: 2, Orders: []query.Order{query.OrderByKeyDescending{}}}, "/f/012 /f/010"},
+		{"offset past the matches", query.Query{Filters: []query.Filter{even}, Offset: 10}, ""},
+		{"offset of the last match", query.Query{Filters: []query.Filter{even}, Offset: 9}, "/f/018"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.q.Prefix = "/f"
+			var got []string
+			for _, e := range queryEntries(t, d, tc.q) {
+				got = append(got, e.Key)
+			}
+			if strings.Join(got, " ") != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+
+			// the semantics are those of go-datastore's naive implementation.
+			naive, err := query.NaiveQueryApply(tc.q, query.ResultsWithEntries(tc.q, all)).Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, e := range naive {
+				want = append(want, e.Key)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected the naive results %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestQueryIteratorErrorDuringOffset(t *testing.T) {
+	errInjected := errors.New("injected read failure")
+	var failing atomic.Bool
+	fs := errorfs.Wrap(vfs.NewMem(), errorfs.InjectorFunc(func(op errorfs.Op) error {
+		if failing.Load() && op.Kind == errorfs.OpFileReadAt && strings.HasSuffix(op.Path, ".sst") {
+			return errInjected
+		}
+		return nil
+	}))
+	opts := &pebble.Options{FS: fs}
+	opts.EnsureDefaults()
+	d, err := NewDatastore("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values spanning many blocks, read from disk rather than the memtable
+	// or the block cache.
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("v"), 1<<10)
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/e/%03d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// reopening starts over with an empty block cache.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewDatastore("/db", opts); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the first block is read on creating the query, the next ones while
+	// skipping the offset.
+	res, err := d.Query(ctx, query.Query{Prefix: "/e", Offset: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.Store(true)
+	results, errs := 0, 0
+	for r := range res.Next() {
+		results++
+		if errors.Is(r.Error, errInjected) {
+			errs++
+		} else {
+			t.Fatalf("expected the injected error, got %v", r)
+		}
+	}
+	if results != 1 || errs != 1 {
+		t.Fatalf("expected the query to end with a single error, got %d results", results)
+	}
+}
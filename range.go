@@ -0,0 +1,46 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// QueryRange runs a query over the keys within [start, end): start is
+// inclusive and end is exclusive. A zero start key means the beginning of
+// the keyspace, and a zero end key means no upper bound.
+//
+// Unlike prefix queries, the range is used verbatim as iterator bounds, with
+// no namespacing semantics: QueryRange(/blocks/m, /blocks/s) returns
+// /blocks/m, /blocks/m/x and /blocks/r, but not /blocks/s. As with every read,
+// the internal keys under the reserved prefix are left out. The query must not
+// set a Prefix; every other field, including orders, filters, offset and
+// limit, is applied as in Query.
+func (d *Datastore) QueryRange(ctx context.Context, start, end ds.Key, q query.Query) (query.Results, error) {
+	if q.Prefix != "" {
+		return nil, errors.New("range queries do not support prefixes")
+	}
+
+	var lower, upper []byte
+	if start.String() != "" {
+		lower = start.Bytes()
+	}
+	if end.String() != "" {
+		upper = end.Bytes()
+		c := bytes.Compare(lower, upper)
+		if c > 0 {
+			return nil, errors.New("invalid range: start is after end")
+		}
+		if c == 0 {
+			return query.ResultsWithEntries(q, []query.Entry{}), nil
+		}
+	}
+	opts, ok := d.userIterOptions(lower, upper)
+	if !ok {
+		return query.ResultsWithEntries(q, []query.Entry{}), nil
+	}
+	return d.query(ctx, d.queryReader(), q, opts)
+}
@@ -0,0 +1,92 @@
+package pebbleds
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestQueryRange(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/blocks/a", "/blocks/m", "/blocks/m/x", "/blocks/r", "/blocks/s", "/blocks/z", "/c"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcs := []struct {
+		name       string
+		start, end datastore.Key
+		q          query.Query
+		expect     []string
+	}{
+		{
+			name:   "range",
+			start:  datastore.NewKey("/blocks/m"),
+			end:    datastore.NewKey("/blocks/s"),
+			expect: []string{"/blocks/m", "/blocks/m/x", "/blocks/r"},
+		},
+		{
+			name:   "descending",
+			start:  datastore.NewKey("/blocks/m"),
+			end:    datastore.NewKey("/blocks/s"),
+			q:      query.Query{Orders: []query.Order{query.OrderByKeyDescending{}}},
+			expect: []string{"/blocks/r", "/blocks/m/x", "/blocks/m"},
+		},
+		{
+			name:   "offset and limit",
+			start:  datastore.NewKey("/blocks/a"),
+			end:    datastore.NewKey("/c"),
+			q:      query.Query{Offset: 1, Limit: 3},
+			expect: []string{"/blocks/m", "/blocks/m/x", "/blocks/r"},
+		},
+		{
+			name:   "open start",
+			end:    datastore.NewKey("/blocks/m"),
+			expect: []string{"/a", "/blocks/a"},
+		},
+		{
+			name:   "open end",
+			start:  datastore.NewKey("/blocks/z"),
+			expect: []string{"/blocks/z", "/c"},
+		},
+		{
+			name:  "empty",
+			start: datastore.NewKey("/blocks/m"),
+			end:   datastore.NewKey("/blocks/m"),
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.q.KeysOnly = true
+			res, err := d.QueryRange(ctx, tc.start, tc.end, tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Key)
+			}
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+
+	if _, err := d.QueryRange(ctx, datastore.NewKey("/b"), datastore.NewKey("/a"), query.Query{}); err == nil {
+		t.Fatal("expected an error for an inverted range")
+	}
+	if _, err := d.QueryRange(ctx, datastore.Key{}, datastore.Key{}, query.Query{Prefix: "/a"}); err == nil {
+		t.Fatal("expected an error for a prefixed range query")
+	}
+}
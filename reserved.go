@@ -0,0 +1,67 @@
+package pebbleds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// defaultReservedPrefix is the default prefix of the keys reserved for
+// internal metadata, such as the LRU index. Datastore keys always start with
+// "/", so they cannot collide with it.
+const defaultReservedPrefix = "\x00"
+
+// ErrReservedKey is returned by writes of keys under the prefix reserved for
+// internal metadata (see WithReservedPrefix).
+var ErrReservedKey = errors.New("pebble datastore key is reserved")
+
+// reservedKey returns the key of the internal metadata named name, under the
+// reserved prefix.
+func (d *Datastore) reservedKey(name string) []byte {
+	return append([]byte(d.conf.reservedPrefix), name...)
+}
+
+// checkUserKey fails with ErrReservedKey if the key falls under the reserved
+// prefix, which only internal features may write to.
+func (d *Datastore) checkUserKey(key []byte) error {
+	if bytes.HasPrefix(key, []byte(d.conf.reservedPrefix)) {
+		return fmt.Errorf("%w: %q is under the reserved prefix %q", ErrReservedKey, key, d.conf.reservedPrefix)
+	}
+	return nil
+}
+
+// userIterOptions returns the options of an iterator over the keys within
+// [lower, upper), leaving out those under the reserved prefix so that internal
+// metadata never shows up in user reads. When the reserved prefix covers
+// either end of the range, the bounds are narrowed around it; when it lies
+// strictly within the range, its keys are skipped instead, as a single
+// iterator cannot be split in two. It returns false if no user key can fall
+// within the range, along with options that still yield no key.
+func (d *Datastore) userIterOptions(lower, upper []byte) (pebble.IterOptions, bool) {
+	reserved := []byte(d.conf.reservedPrefix)
+	reservedUpper := prefixUpperBound(reserved)
+	skipping := pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+		SkipPoint: func(key []byte) bool {
+			return bytes.HasPrefix(key, reserved)
+		},
+	}
+	switch {
+	case upper != nil && bytes.Compare(upper, reserved) <= 0,
+		reservedUpper != nil && bytes.Compare(lower, reservedUpper) >= 0:
+		// the range lies entirely before or after the reserved prefix.
+	case bytes.Compare(lower, reserved) >= 0:
+		if reservedUpper == nil || (upper != nil && bytes.Compare(reservedUpper, upper) >= 0) {
+			return skipping, false
+		}
+		lower = reservedUpper
+	case upper != nil && (reservedUpper == nil || bytes.Compare(upper, reservedUpper) <= 0):
+		upper = reserved
+	default:
+		return skipping, true
+	}
+	return pebble.IterOptions{LowerBound: lower, UpperBound: upper}, true
+}
@@ -0,0 +1,212 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestReservedPrefix(t *testing.T) {
+	d, cleanup := newDatastore(t, WithReservedPrefix("/.pebbleds/"))
+	defer cleanup()
+
+	ctx := context.Background()
+	reserved := datastore.NewKey("/.pebbleds/x")
+	if err := d.Put(ctx, reserved, nil); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("expected Put to fail with ErrReservedKey, got %v", err)
+	}
+	if err := d.Delete(ctx, reserved); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("expected Delete to fail with ErrReservedKey, got %v", err)
+	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, reserved, nil); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("expected Batch.Put to fail with ErrReservedKey, got %v", err)
+	}
+	if err := b.Delete(ctx, reserved); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("expected Batch.Delete to fail with ErrReservedKey, got %v", err)
+	}
+	if err := d.ReplacePrefix(ctx, datastore.NewKey("/.pebbleds"), nil); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("expected ReplacePrefix to fail with ErrReservedKey, got %v", err)
+	}
+
+	allowed := datastore.NewKey("/.other/x")
+	if err := d.Put(ctx, allowed, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, allowed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReservedPrefixLRU(t *testing.T) {
+	const prefix = "/.pebbleds/"
+	ctx := context.Background()
+	path := t.TempDir()
+	open := func() *LRUDatastore {
+		d, err := NewDatastoreWithOptions(path, nil, WithReservedPrefix(prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := NewLRUDatastore(d, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	l := open()
+	key := datastore.NewKey("/lru/x")
+	if err := l.Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(ctx, datastore.NewKey(prefix+"lru/k/x"), nil); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("expected writes to the index to fail with ErrReservedKey, got %v", err)
+	}
+	size := l.Size()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = open()
+	defer l.Close()
+	if l.Size() != size {
+		t.Fatalf("expected size %d after reopening, got %d", size, l.Size())
+	}
+
+	// the index lives under the reserved prefix, and is hidden from queries.
+	iter, err := l.ds.db.NewIter(&pebble.IterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var internal int
+	for iter.First(); iter.Valid(); iter.Next() {
+		if k := iter.Key(); !bytes.Equal(k, key.Bytes()) {
+			if !bytes.HasPrefix(k, []byte(prefix+"lru/")) {
+				t.Fatalf("unexpected key %q", k)
+			}
+			internal++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if internal != 2 {
+		t.Fatalf("expected 2 index keys, got %d", internal)
+	}
+	res, err := l.Query(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != key.String() {
+		t.Fatalf("expected only the user key, got %v", entries)
+	}
+}
+
+func TestReservedPrefixHiddenFromReads(t *testing.T) {
+	testcases := []struct {
+		name string
+		opts []Option
+	}{
+		{"default prefix", []Option{WithMetadata(true)}},
+		{"custom prefix", []Option{WithMetadata(true), WithReservedPrefix("/.pebbleds/")}},
+		{"custom prefix with raw prefixes", []Option{WithMetadata(true), WithReservedPrefix("/.pebbleds/"), WithPrefixMode(RawPrefix)}},
+		{"default prefix with raw prefixes", []Option{WithMetadata(true), WithPrefixMode(RawPrefix)}},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, tc.opts...)
+			defer cleanup()
+
+			ctx := context.Background()
+			// the sidecar of /a sorts before /z and after /, whatever the
+			// prefix, so that it sits at the edge or in the middle of reads.
+			for _, k := range []string{"/a", "/z"} {
+				if err := d.PutWithMeta(ctx, datastore.NewKey(k), []byte("v"), []byte("m")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := []string{"/a", "/z"}
+			check := func(what string, entries []query.Entry) {
+				t.Helper()
+				var got []string
+				for _, e := range entries {
+					got = append(got, e.Key)
+				}
+				if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+					t.Fatalf("%s: expected %v, got %v", what, want, got)
+				}
+			}
+
+			prefix := "/"
+			if d.conf.prefixMode == RawPrefix {
+				prefix = ""
+			}
+			check("query", queryEntries(t, d, query.Query{Prefix: prefix}))
+			check("descending query", reverseEntries(queryEntries(t, d, query.Query{Prefix: prefix, Orders: []query.Order{query.OrderByKeyDescending{}}})))
+
+			res, err := d.QueryRange(ctx, datastore.Key{}, datastore.Key{}, query.Query{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("range query", entries)
+
+			first, _, err := d.FirstKey(ctx, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last, _, err := d.LastKey(ctx, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.String() != "/a" || last.String() != "/z" {
+				t.Fatalf("expected /a and /z as first and last keys, got %s and %s", first, last)
+			}
+
+			splits, err := d.SuggestSplits(ctx, prefix, 4, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range splits {
+				if err := d.checkUserKey(s.Bytes()); err != nil {
+					t.Fatalf("unexpected split: %v", err)
+				}
+			}
+
+			// reads within the reserved prefix see nothing.
+			reserved := d.conf.reservedPrefix
+			if d.conf.prefixMode != RawPrefix && reserved == defaultReservedPrefix {
+				return
+			}
+			if _, _, err := d.FirstKey(ctx, reserved); !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("expected ds.ErrNotFound under the reserved prefix, got %v", err)
+			}
+			if entries := queryEntries(t, d, query.Query{Prefix: reserved}); len(entries) != 0 {
+				t.Fatalf("expected no entries under the reserved prefix, got %v", entries)
+			}
+		})
+	}
+}
+
+func reverseEntries(entries []query.Entry) []query.Entry {
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
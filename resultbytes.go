@@ -0,0 +1,50 @@
+package pebbleds
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+// ErrResultBytesExceeded is returned as the last result of query results
+// wrapped with LimitResultBytes when they were cut short.
+var ErrResultBytesExceeded = errors.New("query results exceed the byte limit")
+
+// LimitResultBytes wraps query results so that the total size of the values
+// returned stays within maxBytes. The entry that would take the total past
+// maxBytes is dropped, and replaced with a final ErrResultBytesExceeded
+// result, after which the wrapped results are closed. This bounds the memory
+// a consumer collecting results needs, whatever the size of the values,
+// unlike Limit which only bounds their count.
+//
+// Only values count towards the limit, using their length as returned, so
+// KeysOnly results are returned as is.
+func LimitResultBytes(res query.Results, maxBytes int) query.Results {
+	if res.Query().KeysOnly {
+		return res
+	}
+	var (
+		total int
+		done  bool
+	)
+	return query.ResultsFromIterator(res.Query(), query.Iterator{
+		Next: func() (query.Result, bool) {
+			if done {
+				return query.Result{}, false
+			}
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			total += len(r.Value)
+			if total > maxBytes {
+				done = true
+				// release the underlying iterator right away.
+				_ = res.Close()
+				return query.Result{Error: ErrResultBytesExceeded}, true
+			}
+			return r, true
+		},
+		Close: res.Close,
+	})
+}
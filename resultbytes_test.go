@@ -0,0 +1,64 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestLimitResultBytes(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/bytes/%d", i)), make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collect := func(q query.Query, maxBytes int) ([]query.Entry, error) {
+		t.Helper()
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = LimitResultBytes(res, maxBytes)
+		defer res.Close()
+
+		var entries []query.Entry
+		for r := range res.Next() {
+			if r.Error != nil {
+				if _, ok := <-res.Next(); ok {
+					t.Fatal("expected no result after the error")
+				}
+				return entries, r.Error
+			}
+			entries = append(entries, r.Entry)
+		}
+		return entries, nil
+	}
+
+	entries, err := collect(query.Query{Prefix: "/bytes"}, 350)
+	if !errors.Is(err, ErrResultBytesExceeded) {
+		t.Fatalf("expected ErrResultBytesExceeded, got %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries within the limit, got %d", len(entries))
+	}
+
+	// exactly at the limit.
+	entries, err = collect(query.Query{Prefix: "/bytes"}, 1000)
+	if err != nil || len(entries) != 10 {
+		t.Fatalf("expected every entry, got %d and %v", len(entries), err)
+	}
+
+	entries, err = collect(query.Query{Prefix: "/bytes", KeysOnly: true}, 1)
+	if err != nil || len(entries) != 10 {
+		t.Fatalf("expected keys-only queries to ignore the limit, got %d and %v", len(entries), err)
+	}
+}
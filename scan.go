@@ -0,0 +1,123 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrStopScan can be returned by a ScanPrefix callback to stop the scan early
+// without failing it.
+var ErrStopScan = errors.New("stop scan")
+
+// LazyEntry is an entry visited by ScanPrefix, whose value is only fetched
+// when asked for.
+//
+// A LazyEntry is bound to the position of the iterator backing the scan: it
+// is only valid for the duration of the callback it is passed to and must not
+// be retained afterwards. Copy the value out with Value if it's needed later.
+type LazyEntry struct {
+	Key string
+
+	lv pebble.LazyValue
+	ds *Datastore
+
+	// prefetched is set if the value has been read ahead, into value or
+	// valueErr, with WithPrefetch.
+	prefetched bool
+	value      []byte
+	valueErr   error
+}
+
+// Value fetches and returns a copy of the value of the entry.
+func (e *LazyEntry) Value() ([]byte, error) {
+	if e.prefetched {
+		return e.value, e.valueErr
+	}
+	val, _, err := e.lv.Value(nil)
+	if err != nil {
+		return nil, err
+	}
+	val, err = e.ds.decodeValue([]byte(e.Key), val)
+	if err != nil {
+		return nil, err
+	}
+	cpy := make([]byte, len(val))
+	copy(cpy, val)
+	return cpy, nil
+}
+
+// Len returns the length of the value, without fetching it.
+func (e *LazyEntry) Len() int {
+	if e.prefetched {
+		return len(e.value)
+	}
+	return e.ds.valueLen(e.lv.Len())
+}
+
+// ScanPrefix calls fn, in key order, for every entry under the given prefix,
+// which is interpreted as in Query. Unlike Query, values are neither fetched
+// nor copied unless fn asks for them, which saves IO and allocations for
+// selective scans that decide on keys alone. Pebble only defers reading the
+// value from storage when it is stored separately (see
+// pebble.Options.Experimental.EnableValueBlocks); otherwise the savings come
+// from not copying values that are not needed.
+//
+// The scan stops at the first error returned by fn, which is returned, unless
+// it is ErrStopScan. With WithPrefetch, entries are read ahead of fn, values
+// included, which gives up on the savings above for traversals that visit
+// most values anyway.
+func (d *Datastore) ScanPrefix(ctx context.Context, prefix string, fn func(e *LazyEntry) error) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.wg.Done()
+
+	ctx, cancel := d.operationContext(ctx)
+	defer cancel()
+
+	opts, ok := d.userIterOptions(d.prefixBounds(prefix))
+	if !ok {
+		return nil
+	}
+	iter, err := d.db.NewIterWithContext(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	if n := d.conf.prefetch; n > 0 {
+		complete, err := d.scanPrefetched(ctx, iter, n, fn)
+		if errors.Is(err, ErrStopScan) {
+			return nil
+		}
+		if err != nil || !complete {
+			return err
+		}
+		if err := iter.Error(); err != nil {
+			return fmt.Errorf("pebble error during scan: %w", err)
+		}
+		return nil
+	}
+
+	e := LazyEntry{ds: d}
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.Key = string(iter.Key())
+		e.lv = iter.LazyValue()
+		if err := fn(&e); err != nil {
+			if errors.Is(err, ErrStopScan) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("pebble error during scan: %w", err)
+	}
+	return nil
+}
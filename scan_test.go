@@ -0,0 +1,137 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestScanPrefix(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, k := range []string{"/a", "/p/1", "/p/2", "/p/3", "/q"} {
+		if err := d.Put(ctx, datastore.NewKey(k), []byte("val"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	var values [][]byte
+	err := d.ScanPrefix(ctx, "/p", func(e *LazyEntry) error {
+		keys = append(keys, e.Key)
+		if e.Len() != len("val"+e.Key) {
+			t.Fatalf("unexpected length %d for %s", e.Len(), e.Key)
+		}
+		// values are only fetched when asked for.
+		if e.Key == "/p/2" {
+			val, err := e.Value()
+			if err != nil {
+				return err
+			}
+			values = append(values, val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "/p/1 /p/2 /p/3" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if len(values) != 1 || !bytes.Equal(values[0], []byte("val/p/2")) {
+		t.Fatalf("unexpected values: %q", values)
+	}
+
+	keys = nil
+	err = d.ScanPrefix(ctx, "/p", func(e *LazyEntry) error {
+		keys = append(keys, e.Key)
+		return ErrStopScan
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected the scan to stop after one entry, got %v", keys)
+	}
+
+	boom := errors.New("boom")
+	if err := d.ScanPrefix(ctx, "/p", func(*LazyEntry) error { return boom }); err != boom {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+}
+
+func setupSelectiveScan(b *testing.B) (*Datastore, func()) {
+	d, cleanup := newDatastore(b)
+
+	ctx := context.Background()
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	val := bytes.Repeat([]byte("v"), 4096)
+	for i := 0; i < 10000; i++ {
+		if err := batch.Put(ctx, datastore.NewKey(fmt.Sprintf("/p/%05d", i)), val); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		b.Fatal(err)
+	}
+	return d, cleanup
+}
+
+// selected rejects all but 1% of the keys.
+func selected(key string) bool {
+	return strings.HasSuffix(key, "00")
+}
+
+func BenchmarkSelectiveScanPrefix(b *testing.B) {
+	d, cleanup := setupSelectiveScan(b)
+	defer cleanup()
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := d.ScanPrefix(ctx, "/p", func(e *LazyEntry) error {
+			if !selected(e.Key) {
+				return nil
+			}
+			_, err := e.Value()
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type keyFilter func(string) bool
+
+func (f keyFilter) Filter(e query.Entry) bool { return f(e.Key) }
+
+func BenchmarkSelectiveQuery(b *testing.B) {
+	d, cleanup := setupSelectiveScan(b)
+	defer cleanup()
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := d.Query(ctx, query.Query{Prefix: "/p", Filters: []query.Filter{keyFilter(selected)}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := res.Rest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
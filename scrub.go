@@ -0,0 +1,91 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// scrubLoop scrubs the store every interval until the datastore is closed.
+func (d *Datastore) scrubLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-d.closing
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			n, err := d.scrub(ctx)
+			if err != nil {
+				// interrupted by Close.
+				return
+			}
+			d.log.Debugf("pebble scrub read %d bytes in %s", n, time.Since(start))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scrub reads every entry of the store, which makes Pebble verify the
+// checksums of the blocks it reads, and verifies the checksums of the values
+// of user keys if enabled.
+// Corruption is reported to the configured callback. Reads are throttled to
+// the configured budget. It returns the number of bytes read, and fails only
+// if ctx is done.
+func (d *Datastore) scrub(ctx context.Context) (int64, error) {
+	report := d.conf.scrubReport
+	iter, err := d.db.NewIterWithContext(ctx, nil)
+	if err != nil {
+		report(fmt.Errorf("pebble error during scrub: %w", err))
+		return 0, nil
+	}
+	defer iter.Close()
+
+	var (
+		read  int64
+		start = time.Now()
+	)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return read, err
+		}
+		val, err := iter.ValueAndErr()
+		if err != nil {
+			report(fmt.Errorf("pebble error during scrub of key %s: %w", iter.Key(), err))
+			continue
+		}
+		// internal keys, such as indexes and the LRU index, are stored
+		// without a value checksum; reading them verifies their blocks.
+		if d.checkUserKey(iter.Key()) == nil {
+			if _, err := d.decodeValue(iter.Key(), val); err != nil {
+				report(err)
+			}
+		}
+
+		read += int64(len(iter.Key()) + len(val))
+		if budget := d.conf.scrubBytesPerSec; budget > 0 {
+			// sleep off any time we are ahead of the budget.
+			ahead := time.Duration(read*int64(time.Second)/budget) - time.Since(start)
+			if ahead > 0 {
+				select {
+				case <-time.After(ahead):
+				case <-ctx.Done():
+					return read, ctx.Err()
+				}
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		report(fmt.Errorf("pebble error during scrub: %w", err))
+	}
+	return read, nil
+}
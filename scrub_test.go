@@ -0,0 +1,130 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+)
+
+func TestScrubber(t *testing.T) {
+	reports := make(chan error, 10)
+	report := func(err error) { reports <- err }
+	d, cleanup := newDatastore(t, WithValueChecksums(true), WithScrubber(10*time.Millisecond, 0, report))
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/scrub/%03d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("expected the scrub to read the store")
+	}
+	select {
+	case err := <-reports:
+		t.Fatalf("expected a healthy store to scrub cleanly, got %s", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// flip a byte of a stored value behind the datastore's back.
+	bad := datastore.NewKey("/scrub/042")
+	stored, closer, err := d.db.Get(bad.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Clone(stored)
+	_ = closer.Close()
+	corrupted[0] ^= 0xff
+	if err := d.db.Set(bad.Bytes(), corrupted, pebble.NoSync); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-reports:
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expected ErrChecksumMismatch, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scrubber to report the corruption")
+	}
+}
+
+func TestScrubberInternalKeys(t *testing.T) {
+	var reports []error
+	report := func(err error) { reports = append(reports, err) }
+	d, cleanup := newDatastore(t, WithValueChecksums(true), WithScrubber(time.Hour, 0, report))
+	defer cleanup()
+
+	ctx := context.Background()
+	err := d.RegisterIndex("x", func(key datastore.Key, value []byte) []datastore.Key {
+		return []datastore.Key{datastore.NewKey(string(value))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLRUDatastore(d, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := d.Put(ctx, datastore.NewKey("/a"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(ctx, datastore.NewKey("/b"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.scrub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Fatalf("expected the internal keys to scrub cleanly, got %v", reports)
+	}
+}
+
+func TestScrubberThrottling(t *testing.T) {
+	report := func(err error) { t.Errorf("unexpected corruption: %s", err) }
+	// a single, heavily throttled pass.
+	d, cleanup := newDatastore(t, WithScrubber(time.Millisecond, 4000, report))
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/scrub/%03d", i)), make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2000 bytes at 4000 bytes per second.
+	start := time.Now()
+	if _, err := d.scrub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Fatalf("expected the scrub to be throttled, took %s", took)
+	}
+
+	// Close interrupts the pass under way.
+	start = time.Now()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 400*time.Millisecond {
+		t.Fatalf("expected Close to interrupt the scrubber, took %s", took)
+	}
+}
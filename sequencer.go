@@ -0,0 +1,92 @@
+package pebbleds
+
+import (
+	"context"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Sequencer commits batches in a guaranteed order: the order in which their
+// tickets were reserved, regardless of the order in which they are prepared or
+// handed over for commit. Pebble commits every batch atomically, but the order
+// of concurrent commits is otherwise up to the scheduler.
+//
+// Precisely, the batch committed with a ticket becomes visible only after the
+// batches of every ticket reserved before it on the same Sequencer have either
+// become visible, failed to commit, or been abandoned with Cancel. Batches
+// committed through different Sequencers, or directly, are not ordered with
+// respect to each other, so independent streams of batches should use
+// Sequencers of their own to keep committing concurrently.
+type Sequencer struct {
+	mu    sync.Mutex
+	queue []*Ticket
+}
+
+// Ticket is a slot in the commit order of a Sequencer. Every ticket must be
+// used, with either Commit or Cancel, as it holds back the tickets reserved
+// after it until then.
+type Ticket struct {
+	s        *Sequencer
+	ready    chan struct{}
+	released bool
+	finished bool
+}
+
+// NewSequencer returns a Sequencer with no ticket reserved yet.
+func NewSequencer() *Sequencer {
+	return &Sequencer{}
+}
+
+// Reserve returns the next ticket in commit order.
+func (s *Sequencer) Reserve() *Ticket {
+	t := &Ticket{s: s, ready: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		t.release()
+	}
+	s.queue = append(s.queue, t)
+	return t
+}
+
+func (t *Ticket) release() {
+	if !t.released {
+		t.released = true
+		close(t.ready)
+	}
+}
+
+// Commit waits for the batches of the earlier tickets to be committed, then
+// commits b. If ctx is done first, the ticket is cancelled and the batch is
+// not committed.
+func (t *Ticket) Commit(ctx context.Context, b ds.Batch) error {
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		t.Cancel()
+		return ctx.Err()
+	}
+	err := b.Commit(ctx)
+	t.Cancel()
+	return err
+}
+
+// Cancel gives up the ticket, letting the later ones through. It does
+// nothing once the ticket is used.
+func (t *Ticket) Cancel() {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	for len(s.queue) > 0 && s.queue[0].finished {
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+	}
+	if len(s.queue) > 0 {
+		s.queue[0].release()
+	}
+}
@@ -0,0 +1,98 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestSequencer(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewSequencer()
+
+	const n = 50
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	tickets := make([]*Ticket, n)
+	for i := range tickets {
+		tickets[i] = s.Reserve()
+	}
+	// hand the batches over in reverse order, at random times.
+	for i := n - 1; i >= 0; i-- {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+			ticket := tickets[i]
+			if i%10 == 5 {
+				// abandoned tickets do not hold back the later ones.
+				ticket.Cancel()
+				return
+			}
+			b, err := d.Batch(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := b.Put(ctx, datastore.NewKey(fmt.Sprintf("/seq/%02d", i)), nil); err != nil {
+				t.Error(err)
+				return
+			}
+			b.(*Batch).OnCommit(func(_, _ []datastore.Key) {
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+			})
+			if err := ticket.Commit(ctx, b); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var expect []int
+	for i := 0; i < n; i++ {
+		if i%10 != 5 {
+			expect = append(expect, i)
+		}
+	}
+	if !reflect.DeepEqual(order, expect) {
+		t.Fatalf("expected the batches to commit in order %v, got %v", expect, order)
+	}
+
+	// a ticket waiting for an earlier one gives up once its context is done.
+	first, second := s.Reserve(), s.Reserve()
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, datastore.NewKey("/seq/late"), nil); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := second.Commit(timeout, b); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the commit to time out, got %v", err)
+	}
+	if has, _ := d.Has(ctx, datastore.NewKey("/seq/late")); has {
+		t.Fatal("expected the timed out batch not to be committed")
+	}
+	first.Cancel()
+	if third := s.Reserve(); third.Commit(ctx, b) != nil {
+		t.Fatal("expected the sequencer to go on after cancellations")
+	}
+}
@@ -0,0 +1,51 @@
+package pebbleds
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-log/v2"
+)
+
+// slowLogInterval is the minimum interval between two slow operation logs.
+const slowLogInterval = time.Second
+
+// slowOpLogger logs the operations that take longer than a threshold, at
+// most once per slowLogInterval.
+type slowOpLogger struct {
+	threshold time.Duration
+	logf      func(format string, args ...interface{})
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func newSlowOpLogger(threshold time.Duration, log log.StandardLogger) *slowOpLogger {
+	return &slowOpLogger{threshold: threshold, logf: log.Warnf}
+}
+
+// observe logs the operation on key started at start if it took longer than
+// the threshold, unless another one was logged less than slowLogInterval
+// ago.
+func (l *slowOpLogger) observe(op string, key string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed < l.threshold {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.last) < slowLogInterval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	l.last = now
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	l.logf("slow pebble %s of %s: took %s (threshold %s, %d more slow operations not logged)",
+		op, key, elapsed, l.threshold, suppressed)
+}
@@ -0,0 +1,84 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/cockroachdb/pebble/vfs/errorfs"
+	"github.com/ipfs/go-datastore"
+)
+
+func TestSlowOpThreshold(t *testing.T) {
+	// reads from sstables take 50ms once slow is set.
+	var slow atomic.Bool
+	fs := errorfs.Wrap(vfs.NewMem(), errorfs.InjectorFunc(func(op errorfs.Op) error {
+		if slow.Load() && op.Kind == errorfs.OpFileReadAt {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}))
+	opts := &pebble.Options{FS: fs}
+	opts.EnsureDefaults()
+	d, err := NewDatastoreWithOptions("/db", opts, WithSlowOpThreshold(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	d.slowOps.logf = func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	ctx := context.Background()
+	fast, slowKey := datastore.NewKey("/fast"), datastore.NewKey("/slow")
+	if err := d.Put(ctx, slowKey, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// only the key in the memtable is served without touching the disk.
+	if err := d.Put(ctx, fast, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	slow.Store(true)
+	if _, err := d.Get(ctx, fast); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 0 {
+		t.Fatalf("expected fast operations not to be logged, got %v", logs)
+	}
+
+	if _, err := d.Get(ctx, slowKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "get of /slow") {
+		t.Fatalf("expected the slow get to be logged, got %v", logs)
+	}
+
+	// logs are rate limited.
+	long := time.Now().Add(-time.Second)
+	d.slowOps.observe("put", "/a", long)
+	if len(logs) != 1 {
+		t.Fatalf("expected logs to be rate limited, got %v", logs)
+	}
+	d.slowOps.last = time.Now().Add(-slowLogInterval)
+	d.slowOps.observe("put", "/b", long)
+	if len(logs) != 2 || !strings.Contains(logs[1], "put of /b") || !strings.Contains(logs[1], "1 more") {
+		t.Fatalf("expected the next slow operation to be logged with the count of those left out, got %v", logs)
+	}
+}
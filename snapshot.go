@@ -0,0 +1,130 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// Snapshot is a point-in-time view of a Datastore, created by
+// Datastore.Snapshot: its reads see the store as it was when the snapshot was
+// taken, whatever is written afterwards, so that long scans get a stable
+// view.
+//
+// Like named snapshots, a Snapshot keeps compactions from dropping the data
+// it sees for as long as it is held, so it must be closed once done with. It
+// is released on Datastore.Close otherwise, after which its reads fail with
+// ErrClosed.
+type Snapshot struct {
+	ds *Datastore
+
+	// mu is held for reading while the snapshot is read from, and for
+	// writing while it is released, after which snap is nil.
+	mu   sync.RWMutex
+	snap *pebble.Snapshot
+
+	once     sync.Once
+	done     chan struct{}
+	released chan struct{}
+	err      error
+}
+
+var _ ds.Read = (*Snapshot)(nil)
+
+// Snapshot takes a snapshot of the store.
+func (d *Datastore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the operation lasts until the snapshot is released, so that Close
+	// waits for it.
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	s := &Snapshot{
+		ds:       d,
+		snap:     d.db.NewSnapshot(),
+		done:     make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	go s.releaseOnClose()
+	return s, nil
+}
+
+// releaseOnClose releases the snapshot once it or the datastore is closed.
+func (s *Snapshot) releaseOnClose() {
+	defer s.ds.wg.Done()
+
+	select {
+	case <-s.done:
+	case <-s.ds.closing:
+	}
+	s.mu.Lock()
+	s.err = s.snap.Close()
+	s.snap = nil
+	s.mu.Unlock()
+	close(s.released)
+}
+
+// Close releases the snapshot. Queries still running over it keep streaming
+// the data they see.
+func (s *Snapshot) Close() error {
+	s.once.Do(func() { close(s.done) })
+	<-s.released
+	return s.err
+}
+
+// Get reads a key as of the snapshot, as Datastore.Get does.
+func (s *Snapshot) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.snap == nil {
+		return nil, ErrClosed
+	}
+	return s.ds.getFrom(s.snap, key.Bytes())
+}
+
+// Has reports whether the key exists as of the snapshot.
+func (s *Snapshot) Has(ctx context.Context, key ds.Key) (bool, error) {
+	_, err := s.Get(ctx, key)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return false, nil
+	case err == nil:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// GetSize returns the size of the value of the key as of the snapshot.
+func (s *Snapshot) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	val, err := s.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(val), nil
+}
+
+// Query runs the query over the store as of the snapshot, like
+// Datastore.Query otherwise.
+func (s *Snapshot) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.snap == nil {
+		return nil, ErrClosed
+	}
+	opts, ok := s.ds.queryIterOptions(q)
+	if !ok {
+		// no key can possibly match.
+		return query.ResultsWithEntries(q, []query.Entry{}), nil
+	}
+	return s.ds.query(ctx, s.snap, q, opts)
+}
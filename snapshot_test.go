@@ -0,0 +1,117 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestSnapshot(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/scan/%03d", i)), []byte("before")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := d.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := snap.Query(ctx, query.Query{Prefix: "/scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes racing with the scan are not seen by it.
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/scan/%03d", i)), []byte("after")); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	n := 0
+	for r := range res.Next() {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		if string(r.Value) != "before" {
+			t.Fatalf("%s: expected the value of the snapshot, got %q", r.Key, r.Value)
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatalf("expected the 100 entries of the snapshot, got %d", n)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := snap.Get(ctx, datastore.NewKey("/scan/000")); err != nil || string(val) != "before" {
+		t.Fatalf("expected the value of the snapshot, got %q, %v", val, err)
+	}
+	if has, err := snap.Has(ctx, datastore.NewKey("/scan/150")); err != nil || has {
+		t.Fatalf("expected a key written after the snapshot to be missing, got %v, %v", has, err)
+	}
+	if val, _ := d.Get(ctx, datastore.NewKey("/scan/000")); string(val) != "after" {
+		t.Fatalf("expected the store to see the writes, got %q", val)
+	}
+
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.Get(ctx, datastore.NewKey("/scan/000")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := snap.Query(ctx, query.Query{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSnapshotReleasedOnClose(t *testing.T) {
+	d, cleanup := newDatastore(t)
+
+	ctx := context.Background()
+	if err := d.Put(ctx, datastore.NewKey("/key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := d.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot is abandoned without being closed.
+	done := make(chan struct{})
+	go func() {
+		cleanup()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not release the snapshot")
+	}
+	if _, err := snap.Get(ctx, datastore.NewKey("/key")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Snapshot(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package pebbleds
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-log/v2"
+)
+
+// snapshotCache holds the snapshot that reads are served from when
+// WithSnapshotReads is enabled.
+type snapshotCache struct {
+	db  *pebble.DB
+	log log.StandardLogger
+
+	// mu is held for reading while the snapshot is read from, and for
+	// writing while it is replaced, so that it is never released under a
+	// reader.
+	mu   sync.RWMutex
+	snap *pebble.Snapshot
+}
+
+func newSnapshotCache(db *pebble.DB, log log.StandardLogger) *snapshotCache {
+	return &snapshotCache{db: db, log: log, snap: db.NewSnapshot()}
+}
+
+// NewIterWithContext creates an iterator over the current snapshot. Iterators
+// pin the state they read on their own, so they stay valid after the
+// snapshot is replaced.
+func (c *snapshotCache) NewIterWithContext(ctx context.Context, o *pebble.IterOptions) (*pebble.Iterator, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.snap.NewIterWithContext(ctx, o)
+}
+
+// refresh replaces the snapshot with a new one and releases the previous
+// one.
+func (c *snapshotCache) refresh() {
+	snap := c.db.NewSnapshot()
+	c.mu.Lock()
+	old := c.snap
+	c.snap = snap
+	c.mu.Unlock()
+	if err := old.Close(); err != nil {
+		c.log.Errorf("pebble error releasing snapshot: %s", err)
+	}
+}
+
+// close releases the snapshot. It must only be called once no more reads
+// can happen.
+func (c *snapshotCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.snap.Close(); err != nil {
+		c.log.Errorf("pebble error releasing snapshot: %s", err)
+	}
+	c.snap = nil
+}
+
+// snapshotLoop refreshes the snapshot cache every interval until the
+// datastore is closed.
+func (d *Datastore) snapshotLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.snapshots.refresh()
+		case <-d.closing:
+			return
+		}
+	}
+}
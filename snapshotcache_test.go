@@ -0,0 +1,114 @@
+package pebbleds
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestSnapshotReads(t *testing.T) {
+	// refreshed by hand below.
+	d, cleanup := newDatastore(t, WithSnapshotReads(time.Hour))
+	defer cleanup()
+
+	ctx := context.Background()
+	k := datastore.NewKey("/snap/a")
+	count := func() int {
+		res, err := d.Query(ctx, query.Query{Prefix: "/snap"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	if err := d.Put(ctx, k, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := d.Has(ctx, k); err != nil || has {
+		t.Fatalf("expected the write to be invisible until the refresh, got %v, %v", has, err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("expected no entries until the refresh, got %d", n)
+	}
+
+	d.snapshots.refresh()
+	val, err := d.Get(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, []byte("v1")) {
+		t.Fatalf("expected v1, got %q", val)
+	}
+
+	// queries keep reading the snapshot they started on.
+	res, err := d.Query(ctx, query.Query{Prefix: "/snap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, k, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, datastore.NewKey("/snap/b"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	d.snapshots.refresh()
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !bytes.Equal(entries[0].Value, []byte("v1")) {
+		t.Fatalf("expected the query to see v1 only, got %v", entries)
+	}
+
+	val, err = d.Get(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, []byte("v2")) {
+		t.Fatalf("expected v2 after the refresh, got %q", val)
+	}
+	if n := count(); n != 2 {
+		t.Fatalf("expected 2 entries after the refresh, got %d", n)
+	}
+}
+
+func TestSnapshotReadsRefresh(t *testing.T) {
+	d, cleanup := newDatastore(t, WithSnapshotReads(20*time.Millisecond))
+	defer cleanup()
+
+	ctx := context.Background()
+	k := datastore.NewKey("/snap/a")
+	if err := d.Put(ctx, k, []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		has, err := d.Has(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the write to become visible after the refresh interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d.snapshots.snap != nil {
+		t.Fatal("expected the snapshot to be released on close")
+	}
+}
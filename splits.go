@@ -0,0 +1,121 @@
+package pebbleds
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// SuggestSplits suggests n-1 keys splitting the entries under the given
+// prefix, which is interpreted as in Query, into n ranges of roughly equal
+// size, counting both keys and values. Range i spans from split i-1
+// (inclusive) to split i (exclusive), the first and last ranges being open
+// ended. This is meant to pick shard boundaries or to parallelize scans, e.g.
+// with QueryRange.
+//
+// The splits are estimated from a sample of sampleSize entries, picked with a
+// probability proportional to their size while walking every key under the
+// prefix. Values are not read, only their lengths. Larger samples give more
+// balanced ranges at the cost of memory. Fewer splits are returned if there
+// are not enough entries to tell them apart.
+func (d *Datastore) SuggestSplits(ctx context.Context, prefix string, n, sampleSize int) ([]ds.Key, error) {
+	if n < 1 || sampleSize < 1 {
+		return nil, fmt.Errorf("invalid split parameters: %d ranges, sample size %d", n, sampleSize)
+	}
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.wg.Done()
+
+	opts, ok := d.userIterOptions(d.prefixBounds(prefix))
+	if !ok {
+		return nil, nil
+	}
+	iter, err := d.db.NewIterWithContext(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	// priority sampling (Duffield, Lund and Thorup): every entry gets a random
+	// priority proportional to its size, and the entries with the highest
+	// priorities are kept, plus one more to serve as the threshold. Big
+	// entries are thus likely to be sampled, and the threshold tells how many
+	// bytes each of the small ones stands for.
+	samples := make(sampleHeap, 0, sampleSize+1)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lv := iter.LazyValue()
+		size := len(iter.Key()) + lv.Len()
+		priority := float64(size) / (1 - rand.Float64())
+		switch {
+		case len(samples) < sampleSize+1:
+			heap.Push(&samples, sample{key: append([]byte(nil), iter.Key()...), size: size, priority: priority})
+		case priority > samples[0].priority:
+			samples[0].key = append(samples[0].key[:0], iter.Key()...)
+			samples[0].size = size
+			samples[0].priority = priority
+			heap.Fix(&samples, 0)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("pebble error during split sampling: %w", err)
+	}
+
+	// the estimated size of a sampled entry is the larger of its actual size
+	// and the threshold. When every entry made it in, sizes are exact.
+	var threshold float64
+	if len(samples) == sampleSize+1 {
+		threshold = heap.Pop(&samples).(sample).priority
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return bytes.Compare(samples[i].key, samples[j].key) < 0
+	})
+	var total float64
+	for i := range samples {
+		samples[i].estimate = math.Max(float64(samples[i].size), threshold)
+		total += samples[i].estimate
+	}
+
+	splits := make([]ds.Key, 0, n-1)
+	var cum float64
+	for _, s := range samples {
+		if len(splits) == n-1 {
+			break
+		}
+		if cum > 0 && cum*float64(n) >= total*float64(len(splits)+1) {
+			splits = append(splits, ds.RawKey(string(s.key)))
+		}
+		cum += s.estimate
+	}
+	return splits, nil
+}
+
+type sample struct {
+	key      []byte
+	size     int
+	priority float64
+	estimate float64
+}
+
+// sampleHeap is a min-heap of samples by priority.
+type sampleHeap []sample
+
+func (h sampleHeap) Len() int           { return len(h) }
+func (h sampleHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+func (h sampleHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x any)        { *h = append(*h, x.(sample)) }
+func (h *sampleHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
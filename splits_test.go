@@ -0,0 +1,73 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestSuggestSplits(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// skewed: many small entries and a few big ones.
+	sizes := make(map[string]int)
+	put := func(k string, size int) {
+		if err := b.Put(ctx, datastore.NewKey(k), make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		sizes[datastore.NewKey(k).String()] = len(datastore.NewKey(k).String()) + size
+	}
+	for i := 0; i < 8000; i++ {
+		put(fmt.Sprintf("/skew/a/%05d", i), 16)
+	}
+	for i := 0; i < 200; i++ {
+		put(fmt.Sprintf("/skew/z/%05d", i), 4096)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var total int
+	for _, s := range sizes {
+		total += s
+	}
+
+	for _, sampleSize := range []int{1000, 100000} {
+		t.Run(fmt.Sprintf("sample=%d", sampleSize), func(t *testing.T) {
+			const n = 4
+			splits, err := d.SuggestSplits(ctx, "/skew", n, sampleSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(splits) != n-1 {
+				t.Fatalf("expected %d splits, got %v", n-1, splits)
+			}
+
+			ranges := make([]int, n)
+			for k, s := range sizes {
+				i := 0
+				for i < len(splits) && k >= splits[i].String() {
+					i++
+				}
+				ranges[i] += s
+			}
+			for i, r := range ranges {
+				if r < total/n/2 || r > total/n*3/2 {
+					t.Fatalf("range %d is unbalanced: %d bytes out of %d (%v)", i, r, total, ranges)
+				}
+			}
+		})
+	}
+
+	if _, err := d.SuggestSplits(ctx, "/skew", 0, 10); err == nil {
+		t.Fatal("expected an error for zero ranges")
+	}
+}
@@ -0,0 +1,89 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestExportSSTables(t *testing.T) {
+	opts := &pebble.Options{}
+	opts.EnsureDefaults()
+	for i := range opts.Levels {
+		opts.Levels[i].TargetFileSize = 16 << 10
+	}
+	src, err := NewDatastore(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	ctx := context.Background()
+	// incompressible values, for the export to span several sstables.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		val := make([]byte, 100)
+		rng.Read(val)
+		if err := src.Put(ctx, datastore.NewKey(fmt.Sprintf("/export/%04d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// some entries only live in the memtable, and some are deleted.
+	for i := 0; i < 1000; i += 10 {
+		if err := src.Delete(ctx, datastore.NewKey(fmt.Sprintf("/export/%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.Put(ctx, datastore.NewKey(fmt.Sprintf("/export/%04d/new", i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst, cleanup := newDatastore(t)
+	defer cleanup()
+
+	paths, err := src.ExportSSTables(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("expected the export to be split over several sstables, got %v", paths)
+	}
+	if err := dst.IngestSSTables(ctx, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	all := func(d *Datastore) []query.Entry {
+		res, err := d.Query(ctx, query.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	expect, got := all(src), all(dst)
+	if len(got) != 1000 {
+		t.Fatalf("expected 1000 entries, got %d", len(got))
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatal("expected the ingested store to hold the same entries")
+	}
+
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.ExportSSTables(ctx, t.TempDir()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
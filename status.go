@@ -0,0 +1,70 @@
+package pebbleds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Status summarizes the health of the store, as returned by StatusJSON. The
+// JSON field names are stable and safe for monitoring to depend on.
+type Status struct {
+	// Open is false once the datastore is closed, in which case every other
+	// field is zero.
+	Open bool `json:"open"`
+	// DiskUsageBytes is the space taken on disk, as reported by DiskUsage.
+	DiskUsageBytes uint64 `json:"disk_usage_bytes"`
+	// L0Files is the number of sstables in L0. Writes stall once it reaches
+	// pebble.Options.L0StopWritesThreshold.
+	L0Files int64 `json:"l0_files"`
+	// ReadAmp is the number of sorted runs a read may have to look into.
+	ReadAmp int `json:"read_amp"`
+	// WriteAmp is the number of bytes written to disk per byte written to
+	// the store, since it was opened.
+	WriteAmp float64 `json:"write_amp"`
+	// CompactionDebtBytes is the estimate reported by CompactionDebt.
+	CompactionDebtBytes uint64 `json:"compaction_debt_bytes"`
+	// BlockCacheHitRatio is the fraction of block reads served by the block
+	// cache since the store was opened, between 0 and 1.
+	BlockCacheHitRatio float64 `json:"block_cache_hit_ratio"`
+}
+
+// Status returns the Status of the store, or ErrClosed once it is closed.
+func (d *Datastore) Status(ctx context.Context) (Status, error) {
+	if err := ctx.Err(); err != nil {
+		return Status{}, err
+	}
+	if err := d.acquire(); err != nil {
+		return Status{}, err
+	}
+	defer d.wg.Done()
+
+	m := d.db.Metrics()
+	total := m.Total()
+	s := Status{
+		Open:                true,
+		DiskUsageBytes:      m.DiskSpaceUsage(),
+		L0Files:             m.Levels[0].NumFiles,
+		ReadAmp:             m.ReadAmp(),
+		WriteAmp:            total.WriteAmp(),
+		CompactionDebtBytes: m.Compact.EstimatedDebt,
+	}
+	if reads := m.BlockCache.Hits + m.BlockCache.Misses; reads > 0 {
+		s.BlockCacheHitRatio = float64(m.BlockCache.Hits) / float64(reads)
+	}
+	return s, nil
+}
+
+// StatusJSON returns the Status of the store marshalled as JSON, ready to be
+// served from an HTTP status or health endpoint. Unlike most methods, it does
+// not fail with ErrClosed on a closed datastore but reports it as not open.
+func (d *Datastore) StatusJSON(ctx context.Context) ([]byte, error) {
+	s, err := d.Status(ctx)
+	switch {
+	case errors.Is(err, ErrClosed):
+		return json.Marshal(Status{})
+	case err != nil:
+		return nil, err
+	}
+	return json.Marshal(s)
+}
@@ -0,0 +1,85 @@
+package pebbleds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestStatusJSON(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, datastore.NewKey(fmt.Sprintf("/status/%03d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := d.Get(ctx, datastore.NewKey(fmt.Sprintf("/status/%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := d.StatusJSON(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	expect := []string{
+		"block_cache_hit_ratio",
+		"compaction_debt_bytes",
+		"disk_usage_bytes",
+		"l0_files",
+		"open",
+		"read_amp",
+		"write_amp",
+	}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("expected fields %v, got %v", expect, keys)
+	}
+
+	var s Status
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Open || s.DiskUsageBytes == 0 || s.L0Files != 1 || s.ReadAmp != 1 {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+	if s.BlockCacheHitRatio <= 0 || s.BlockCacheHitRatio > 1 {
+		t.Fatalf("expected a block cache hit ratio within (0, 1], got %v", s.BlockCacheHitRatio)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = d.StatusJSON(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = Status{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != (Status{}) {
+		t.Fatalf("expected a closed status, got %+v", s)
+	}
+}
@@ -0,0 +1,169 @@
+package pebbleds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// TenantDatastore is a view of a Datastore restricted to the keyspace of a
+// single tenant, for stores shared by many tenants. Keys are transparently
+// namespaced under /<tenantID>, and every operation, Query included, is
+// confined to that namespace: a tenant can neither read, scan nor delete the
+// keys of another one, whatever the keys, prefixes or filters it uses.
+//
+// Keys outside of the tenant namespaces are not protected from tenants
+// sharing their first component, so stores shared by tenants should not hold
+// any other keys at the top level.
+type TenantDatastore struct {
+	ds     *Datastore
+	tenant ds.Key
+	// prefix is the prefix of the keys of the tenant.
+	prefix string
+}
+
+var _ ds.Datastore = (*TenantDatastore)(nil)
+var _ ds.Batching = (*TenantDatastore)(nil)
+
+// NewTenantDatastore returns the view of d restricted to the tenant. The
+// tenant ID must be a single, non-empty key component: it must not contain
+// any "/", which would nest it into the namespace of another tenant.
+func NewTenantDatastore(d *Datastore, tenantID string) (*TenantDatastore, error) {
+	if tenantID == "" || strings.Contains(tenantID, "/") {
+		return nil, fmt.Errorf("invalid tenant ID %q", tenantID)
+	}
+	tenant := ds.NewKey(tenantID)
+	return &TenantDatastore{ds: d, tenant: tenant, prefix: tenant.String() + "/"}, nil
+}
+
+// TenantID returns the ID of the tenant of the view.
+func (t *TenantDatastore) TenantID() string {
+	return t.tenant.String()[1:]
+}
+
+func (t *TenantDatastore) key(key ds.Key) ds.Key {
+	return t.tenant.Child(key)
+}
+
+func (t *TenantDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return t.ds.Get(ctx, t.key(key))
+}
+
+func (t *TenantDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return t.ds.Has(ctx, t.key(key))
+}
+
+func (t *TenantDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return t.ds.GetSize(ctx, t.key(key))
+}
+
+func (t *TenantDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return t.ds.Put(ctx, t.key(key), value)
+}
+
+func (t *TenantDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return t.ds.Delete(ctx, t.key(key))
+}
+
+// Query runs the query over the keys of the tenant, which it returns
+// relative to the tenant namespace. The prefix is interpreted as in
+// Datastore.Query, relative to the namespace as well. Filters, as well as
+// orders other than by key, see the relative keys and are applied in memory.
+func (t *TenantDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	base := query.Query{
+		KeysOnly:     q.KeysOnly,
+		ReturnsSizes: q.ReturnsSizes,
+		// keeps the query from escaping the namespace, whatever its prefix.
+		Filters: []query.Filter{query.FilterKeyPrefix{Prefix: t.prefix}},
+	}
+	if t.ds.conf.prefixMode == RawPrefix {
+		base.Prefix = t.tenant.String() + q.Prefix
+	} else {
+		base.Prefix = t.key(ds.NewKey(q.Prefix)).String()
+	}
+
+	naive := query.Query{Filters: q.Filters, Orders: q.Orders, Offset: q.Offset, Limit: q.Limit}
+	if len(q.Filters) == 0 && (len(q.Orders) == 0 || len(q.Orders) == 1 && isOrderByKey(q.Orders[0])) {
+		base.Orders, base.Offset, base.Limit = q.Orders, q.Offset, q.Limit
+		naive = query.Query{}
+	}
+
+	res, err := t.ds.Query(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	relative := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			r, ok := res.NextSync()
+			if ok && r.Error == nil {
+				r.Key = strings.TrimPrefix(r.Key, t.tenant.String())
+			}
+			return r, ok
+		},
+		Close: res.Close,
+	})
+	return query.NaiveQueryApply(naive, relative), nil
+}
+
+// DeleteRange atomically deletes every key of the tenant under the prefix,
+// not including the prefix key itself, or every key of the tenant if the
+// prefix is the root key. The keys of other tenants are never touched.
+func (t *TenantDatastore) DeleteRange(ctx context.Context, prefix ds.Key) error {
+	if err := t.ds.acquire(); err != nil {
+		return err
+	}
+	defer t.ds.wg.Done()
+
+	lower := []byte(t.key(prefix).String() + "/")
+	b := t.ds.db.NewBatch()
+	defer b.Close()
+	if err := t.ds.deleteUserRange(ctx, b, lower, prefixUpperBound(lower)); err != nil {
+		return fmt.Errorf("pebble error during delete range within batch: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.Commit(t.ds.writeOptions()); err != nil {
+		return fmt.Errorf("pebble error during delete range: %w", err)
+	}
+	t.ds.bumpGeneration()
+	return nil
+}
+
+func (t *TenantDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return t.ds.Sync(ctx, t.key(prefix))
+}
+
+func (t *TenantDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := t.ds.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tenantBatch{t: t, b: b}, nil
+}
+
+// Close is a no-op: the view does not own the underlying Datastore, which
+// must be closed on its own once no tenant uses it anymore.
+func (t *TenantDatastore) Close() error {
+	return nil
+}
+
+type tenantBatch struct {
+	t *TenantDatastore
+	b ds.Batch
+}
+
+func (b *tenantBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return b.b.Put(ctx, b.t.key(key), value)
+}
+
+func (b *tenantBatch) Delete(ctx context.Context, key ds.Key) error {
+	return b.b.Delete(ctx, b.t.key(key))
+}
+
+func (b *tenantBatch) Commit(ctx context.Context) error {
+	return b.b.Commit(ctx)
+}
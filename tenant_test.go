@@ -0,0 +1,118 @@
+package pebbleds
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func tenantKeys(t *testing.T, td *TenantDatastore, q query.Query) []string {
+	t.Helper()
+	res, err := td.Query(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestTenantIsolation(t *testing.T) {
+	modes := []struct {
+		name string
+		mode PrefixMode
+	}{{"namespaced", NamespacedPrefix}, {"raw", RawPrefix}}
+	for _, m := range modes {
+		m := m
+		t.Run(m.name, func(t *testing.T) {
+			d, cleanup := newDatastore(t, WithPrefixMode(m.mode))
+			defer cleanup()
+
+			ctx := context.Background()
+			// "ab" shares a byte prefix with "a", which must not leak.
+			tenants := map[string]*TenantDatastore{}
+			for _, id := range []string{"a", "ab"} {
+				td, err := NewTenantDatastore(d, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tenants[id] = td
+				for _, k := range []string{"/x", "/x/1", "/x/2", "/y"} {
+					if err := td.Put(ctx, datastore.NewKey(k), []byte(id)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			a, ab := tenants["a"], tenants["ab"]
+			if err := ab.Put(ctx, datastore.NewKey("/only-ab"), []byte("ab")); err != nil {
+				t.Fatal(err)
+			}
+
+			if v, err := a.Get(ctx, datastore.NewKey("/x")); err != nil || string(v) != "a" {
+				t.Fatalf("got %q, %v", v, err)
+			}
+			if _, err := a.Get(ctx, datastore.NewKey("/only-ab")); !errors.Is(err, datastore.ErrNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+			if v, err := d.Get(ctx, datastore.NewKey("/ab/x")); err != nil || string(v) != "ab" {
+				t.Fatalf("got %q, %v", v, err)
+			}
+
+			all := tenantKeys(t, a, query.Query{})
+			if want := []string{"/x", "/x/1", "/x/2", "/y"}; !reflect.DeepEqual(all, want) {
+				t.Fatalf("got keys %v, expected %v", all, want)
+			}
+			// a raw prefix still cannot escape into "ab".
+			if keys := tenantKeys(t, a, query.Query{Prefix: "b"}); len(keys) != 0 {
+				t.Fatalf("query escaped the tenant: %v", keys)
+			}
+			filtered := tenantKeys(t, a, query.Query{
+				Filters: []query.Filter{query.FilterKeyCompare{Op: query.NotEqual, Key: "/y"}},
+				Orders:  []query.Order{query.OrderByKeyDescending{}},
+				Limit:   2,
+			})
+			if want := []string{"/x/1", "/x/2"}; !reflect.DeepEqual(filtered, want) {
+				t.Fatalf("got keys %v, expected %v", filtered, want)
+			}
+
+			if err := a.DeleteRange(ctx, datastore.NewKey("/x")); err != nil {
+				t.Fatal(err)
+			}
+			if keys := tenantKeys(t, a, query.Query{}); !reflect.DeepEqual(keys, []string{"/x", "/y"}) {
+				t.Fatalf("got keys %v after deleting /x", keys)
+			}
+			if err := a.DeleteRange(ctx, datastore.NewKey("/")); err != nil {
+				t.Fatal(err)
+			}
+			if keys := tenantKeys(t, a, query.Query{}); len(keys) != 0 {
+				t.Fatalf("got keys %v after deleting everything", keys)
+			}
+			if keys := tenantKeys(t, ab, query.Query{}); len(keys) != 5 {
+				t.Fatalf("delete range touched another tenant: %v", keys)
+			}
+		})
+	}
+}
+
+func TestTenantInvalidID(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	for _, id := range []string{"", "a/b", "/a"} {
+		if _, err := NewTenantDatastore(d, id); err == nil {
+			t.Fatalf("expected tenant ID %q to be rejected", id)
+		}
+	}
+}
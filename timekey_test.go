@@ -0,0 +1,85 @@
+package pebbleds
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestTimestampKeys(t *testing.T) {
+	d, cleanup := newDatastore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	base := time.Date(2023, 11, 21, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		time.Unix(0, -1), // right before the epoch
+		base,
+		base.Add(time.Nanosecond),
+		base.Add(time.Hour),
+		base.Add(24 * time.Hour),
+	}
+	for _, ts := range times {
+		if err := d.Put(ctx, datastore.NewKey("/events").ChildString(EncodeTimestamp(ts)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put(ctx, datastore.NewKey("/inverted").ChildString(EncodeInvertedTimestamp(ts)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var newestFirst []time.Time
+	for i := len(times) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, times[i])
+	}
+
+	read := func(q query.Query, decode func(string) (time.Time, error)) []time.Time {
+		t.Helper()
+		q.KeysOnly = true
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []time.Time
+		for _, e := range entries {
+			ts, err := decode(datastore.RawKey(e.Key).BaseNamespace())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ts.UTC())
+		}
+		return got
+	}
+	utc := func(ts []time.Time) []time.Time {
+		out := make([]time.Time, len(ts))
+		for i := range ts {
+			out[i] = ts[i].UTC()
+		}
+		return out
+	}
+
+	got := read(query.Query{Prefix: "/events"}, DecodeTimestamp)
+	if !reflect.DeepEqual(got, utc(times)) {
+		t.Fatalf("expected oldest first %v, got %v", times, got)
+	}
+	got = read(query.Query{Prefix: "/events", Orders: []query.Order{query.OrderByKeyDescending{}}}, DecodeTimestamp)
+	if !reflect.DeepEqual(got, utc(newestFirst)) {
+		t.Fatalf("expected newest first %v, got %v", newestFirst, got)
+	}
+	got = read(query.Query{Prefix: "/inverted"}, DecodeInvertedTimestamp)
+	if !reflect.DeepEqual(got, utc(newestFirst)) {
+		t.Fatalf("expected newest first %v, got %v", newestFirst, got)
+	}
+
+	if _, err := DecodeTimestamp("nothex"); err == nil {
+		t.Fatal("expected an error for an invalid segment")
+	}
+}